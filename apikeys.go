@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+)
+
+type CreateAPIKeyRequest struct {
+	Name             string   `json:"name"`
+	Scopes           []string `json:"scopes"`
+	ExpiresInSeconds *int     `json:"expires_in_seconds,omitempty"`
+}
+
+type APIKeyResponse struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Key is only ever returned once, when the key is created.
+	Key string `json:"key,omitempty"`
+}
+
+func apiKeyToResponse(apiKey database.ApiKey) APIKeyResponse {
+	resp := APIKeyResponse{
+		ID:        apiKey.ID,
+		Name:      apiKey.Name,
+		Prefix:    apiKey.Prefix,
+		Scopes:    auth.ParseScopes(apiKey.Scopes),
+		CreatedAt: apiKey.CreatedAt,
+	}
+	if apiKey.ExpiresAt.Valid {
+		resp.ExpiresAt = &apiKey.ExpiresAt.Time
+	}
+	if apiKey.LastUsedAt.Valid {
+		resp.LastUsedAt = &apiKey.LastUsedAt.Time
+	}
+	return resp
+}
+
+func (apiCfg *apiConfig) CreateAPIKey(rw http.ResponseWriter, r *http.Request) {
+	// API keys can only be managed with a real login, never with another key
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
+	if err != nil {
+		writeAuthError(rw, r, err)
+		return
+	}
+
+	req := CreateAPIKeyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
+		return
+	}
+
+	if req.Name == "" {
+		problem.Invalid(rw, r, "name", "required", "Key name is required")
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		problem.Invalid(rw, r, "scopes", "required", "At least one scope is required")
+		return
+	}
+
+	for _, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			problem.Invalid(rw, r, "scopes", "invalid", "Unknown scope: "+scope)
+			return
+		}
+	}
+
+	expiresAt := sql.NullTime{}
+	if req.ExpiresInSeconds != nil {
+		if *req.ExpiresInSeconds <= 0 {
+			problem.Invalid(rw, r, "expires_in_seconds", "invalid", "expires_in_seconds must be positive")
+			return
+		}
+		expiresAt = sql.NullTime{
+			Time:  time.Now().Add(time.Duration(*req.ExpiresInSeconds) * time.Second),
+			Valid: true,
+		}
+	}
+
+	key, err := auth.MakeAPIKey()
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Error creating API key")
+		return
+	}
+
+	apiKey, err := apiCfg.storage.CreateAPIKey(r.Context(), database.CreateAPIKeyParams{
+		UserID:    userID,
+		Name:      req.Name,
+		Prefix:    key[:auth.APIKeyPrefixLength],
+		KeyHash:   auth.HashToken(key),
+		Scopes:    auth.JoinScopes(req.Scopes),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error storing API key", "error", err)
+		problem.Error(rw, r, problem.Internal, "Error storing API key")
+		return
+	}
+
+	resp := apiKeyToResponse(apiKey)
+	resp.Key = key
+
+	writeJSONResponse(rw, http.StatusCreated, resp)
+}
+
+func (apiCfg *apiConfig) GetAPIKeys(rw http.ResponseWriter, r *http.Request) {
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
+	if err != nil {
+		writeAuthError(rw, r, err)
+		return
+	}
+
+	apiKeys, err := apiCfg.storage.GetAPIKeysForUser(r.Context(), userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting API keys", "error", err)
+		problem.Error(rw, r, problem.Internal, "Error getting API keys")
+		return
+	}
+
+	responseKeys := []APIKeyResponse{}
+	for _, apiKey := range apiKeys {
+		responseKeys = append(responseKeys, apiKeyToResponse(apiKey))
+	}
+
+	writeJSONResponse(rw, http.StatusOK, responseKeys)
+}
+
+func (apiCfg *apiConfig) DeleteAPIKey(rw http.ResponseWriter, r *http.Request) {
+	keyID, err := uuid.Parse(r.PathValue("keyID"))
+	if err != nil {
+		problem.Invalid(rw, r, "keyID", "invalid", "Invalid API key ID")
+		return
+	}
+
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
+	if err != nil {
+		writeAuthError(rw, r, err)
+		return
+	}
+
+	// Scoping the delete to the user means someone else's key looks missing
+	deleted, err := apiCfg.storage.DeleteAPIKey(r.Context(), database.DeleteAPIKeyParams{
+		ID:     keyID,
+		UserID: userID,
+	})
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Failed to delete API key")
+		return
+	}
+
+	if deleted == 0 {
+		problem.Error(rw, r, problem.NotFound, "API key not found")
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
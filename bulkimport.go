@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/importer"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/migrate"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
+)
+
+type importSummaryResponse struct {
+	Summary importer.Summary `json:"summary"`
+}
+
+// ImportData streams an import from the request body. The response is JSON
+// Lines: one object per rejected row as it happens, then the summary.
+func (cfg *apiConfig) ImportData(rw http.ResponseWriter, r *http.Request) {
+	if !cfg.authorizeAdmin(r) {
+		problem.Error(rw, r, problem.Forbidden, "Admin token required")
+		return
+	}
+
+	query := r.URL.Query()
+	opts := importer.Options{
+		Kind:   query.Get("type"),
+		Format: query.Get("format"),
+		DryRun: query.Get("dry_run") == "true",
+	}
+	if opts.Format == "" {
+		opts.Format = importer.FormatFromContentType(r.Header.Get("Content-Type"))
+	}
+	if batchSize := query.Get("batch_size"); batchSize != "" {
+		size, err := strconv.Atoi(batchSize)
+		if err != nil {
+			problem.Invalid(rw, r, "batch_size", "invalid", "batch_size must be an integer")
+			return
+		}
+		opts.BatchSize = size
+	}
+
+	if err := opts.Validate(); err != nil {
+		problem.Error(rw, r, problem.ValidationFailed, err.Error())
+		return
+	}
+
+	// Row errors are written while the body is still being read
+	rc := http.NewResponseController(rw)
+	if err := rc.EnableFullDuplex(); err != nil {
+		slog.ErrorContext(r.Context(), "Error enabling full duplex for import", "error", err)
+	}
+	// A big import takes much longer than the server's usual timeouts allow
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		slog.ErrorContext(r.Context(), "Error clearing read deadline for import", "error", err)
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		slog.ErrorContext(r.Context(), "Error clearing write deadline for import", "error", err)
+	}
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(rw)
+
+	// A long import mustn't hold up shutdown; batches already committed stay
+	ctx, cancel := cfg.streamContext(r.Context())
+	defer cancel()
+
+	summary, err := importer.Run(ctx, cfg.storage, r.Body, opts, func(rowErr importer.RowError) {
+		encoder.Encode(rowErr)
+		rc.Flush()
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error importing", "kind", opts.Kind, "error", err)
+		// Too late for a status code, so the failure goes in the stream
+		encoder.Encode(problem.New(r, problem.Internal, "Import stopped: "+err.Error()))
+	}
+
+	encoder.Encode(importSummaryResponse{Summary: summary})
+}
+
+// runImportCommand implements `chirpy import`, which reads the same files as
+// the admin endpoint straight from disk.
+func runImportCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "jsonl or csv (default: from the file extension)")
+	dryRun := flags.Bool("dry-run", false, "check every row without saving anything")
+	batchSize := flags.Int("batch-size", importer.DefaultBatchSize, "rows per transaction")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: chirpy import [flags] users|chirps FILE")
+		fmt.Fprintln(flags.Output(), "FILE may be - to read from standard input.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	kind, path := flags.Arg(0), flags.Arg(1)
+
+	opts := importer.Options{
+		Kind:      kind,
+		Format:    *format,
+		DryRun:    *dryRun,
+		BatchSize: *batchSize,
+	}
+	if opts.Format == "" {
+		opts.Format = importer.FormatFromName(path)
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	input := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		input = f
+	}
+
+	dbURL, err := configuredDBURL()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	db, dialect, err := openDatabase(dbURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var storage store.Storage = store.NewPostgres(db)
+	if dialect == migrate.SQLite {
+		storage = store.NewSQLite(db)
+	}
+	defer storage.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	summary, err := importer.Run(ctx, storage, input, opts, func(rowErr importer.RowError) {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, rowErr.Line, rowErr.Error)
+	})
+
+	verb := "imported"
+	if summary.DryRun {
+		verb = "would import"
+	}
+	fmt.Printf("%d rows: %s %d, skipped %d already present, %d failed\n",
+		summary.Rows, verb, summary.Imported, summary.Skipped, summary.Failed)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import stopped:", err)
+		return 1
+	}
+	if summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
@@ -10,6 +12,8 @@ import (
 	"github.com/google/uuid"
 	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
 	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
 )
 
 type Chirp struct {
@@ -20,22 +24,25 @@ type Chirp struct {
 	UserID    uuid.UUID `json:"user_id"`
 }
 
+var errNotAuthor = errors.New("user is not the author of the chirp")
+
 func (apiCfg *apiConfig) CreateChirp(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Set("Content-Type", "application/json")
 
-	// Get token from Authorization header
-	token, err := auth.GetBearerToken(r.Header)
+	// Accept a Bearer JWT or an API key with write access
+	userID, err := apiCfg.authenticate(r, auth.ScopeChirpsWrite)
 	if err != nil {
-		resp := errorResponse{Error: "Authentication required"}
-		writeJSONResponse(rw, http.StatusUnauthorized, resp)
+		writeAuthError(rw, r, err)
 		return
 	}
 
-	// Validate JWT and get userID directly
-	userID, err := auth.ValidateJWT(token, apiCfg.secret)
+	verified, err := apiCfg.requireVerified(r.Context(), userID)
 	if err != nil {
-		resp := errorResponse{Error: "Invalid token"}
-		writeJSONResponse(rw, http.StatusUnauthorized, resp)
+		problem.Error(rw, r, problem.Internal, "Internal server error")
+		return
+	}
+	if !verified {
+		problem.Error(rw, r, problem.EmailNotVerified, "Verify your email address before posting")
 		return
 	}
 
@@ -43,21 +50,18 @@ func (apiCfg *apiConfig) CreateChirp(rw http.ResponseWriter, r *http.Request) {
 	c := Chirp{}
 	err = decoder.Decode(&c)
 	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		resp := errorResponse{Error: "Invalid JSON payload"}
-		writeJSONResponse(rw, 400, resp)
+		slog.ErrorContext(r.Context(), "Error decoding parameters", "error", err)
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
 		return
 	}
 
 	if c.Body == "" {
-		resp := errorResponse{Error: "Chirp body is required"}
-		writeJSONResponse(rw, 400, resp)
+		problem.Invalid(rw, r, "body", "required", "Chirp body is required")
 		return
 	}
 
 	if len(c.Body) > 140 {
-		resp := errorResponse{Error: "Chirp is too long"}
-		writeJSONResponse(rw, 400, resp)
+		problem.Invalid(rw, r, "body", "too_long", "Chirp is too long")
 		return
 	}
 
@@ -78,13 +82,13 @@ func (apiCfg *apiConfig) CreateChirp(rw http.ResponseWriter, r *http.Request) {
 		UserID: userID,
 	}
 
-	createdChirp, err := apiCfg.database.CreateChirp(r.Context(), chirp)
+	createdChirp, err := apiCfg.storage.CreateChirp(r.Context(), chirp)
 	if err != nil {
-		log.Printf("Error creating chirp in database: %s", err)
-		resp := errorResponse{Error: "Failed to save chirp to database"}
-		writeJSONResponse(rw, 500, resp)
+		slog.ErrorContext(r.Context(), "Error creating chirp in database", "error", err)
+		problem.Error(rw, r, problem.Internal, "Failed to save chirp to database")
 		return
 	}
+	apiCfg.metrics.ChirpsCreated.Inc()
 
 	resp := Chirp{
 		ID:        createdChirp.ID,
@@ -95,8 +99,8 @@ func (apiCfg *apiConfig) CreateChirp(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := writeJSONResponse(rw, 201, resp); err != nil {
-		log.Printf("Error writing JSON response: %s", err)
-		rw.WriteHeader(500)
+		slog.ErrorContext(r.Context(), "Error writing JSON response", "error", err)
+		problem.Error(rw, r, problem.Internal, "Internal server error")
 		return
 	}
 }
@@ -104,10 +108,10 @@ func (apiCfg *apiConfig) CreateChirp(rw http.ResponseWriter, r *http.Request) {
 func (apiCfg *apiConfig) GetChirps(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Set("Content-Type", "application/json")
 
-	arrayOfChirps, err := apiCfg.database.GetAllChirps(r.Context())
+	arrayOfChirps, err := apiCfg.storage.GetAllChirps(r.Context())
 	if err != nil {
-		log.Printf("Error getting Chirps: %s", err)
-		rw.WriteHeader(500)
+		slog.ErrorContext(r.Context(), "Error getting Chirps", "error", err)
+		problem.Error(rw, r, problem.Internal, "Failed to get chirps")
 		return
 	}
 
@@ -127,7 +131,7 @@ func (apiCfg *apiConfig) GetChirps(rw http.ResponseWriter, r *http.Request) {
 
 	rw.WriteHeader(200)
 	if err := json.NewEncoder(rw).Encode(responseChirps); err != nil {
-		log.Printf("Error encoding response: %v", err)
+		slog.ErrorContext(r.Context(), "Error encoding response", "error", err)
 		return
 	}
 }
@@ -140,15 +144,15 @@ func (apiCfg *apiConfig) GetChirp(rw http.ResponseWriter, r *http.Request) {
 	chirpID, err := uuid.Parse(chirpIDStr)
 	if err != nil {
 		// Handle the error appropriately if the ID is not a valid UUID
-		http.Error(rw, "Invalid Chirp ID", http.StatusBadRequest)
+		problem.Invalid(rw, r, "chirpID", "invalid", "Invalid chirp ID")
 		return
 	}
 
 	// Fetch the chirp from the database using the valid chirpID
-	chirp, err := apiCfg.database.GetOneChirp(r.Context(), chirpID)
+	chirp, err := apiCfg.storage.GetOneChirp(r.Context(), chirpID)
 	if err != nil {
 		// Handle the case where the chirp is not found
-		http.Error(rw, "Chirp not found", http.StatusNotFound)
+		problem.Error(rw, r, problem.NotFound, "Chirp not found")
 		return
 	}
 
@@ -168,46 +172,42 @@ func (apiCfg *apiConfig) DeleteChirp(rw http.ResponseWriter, r *http.Request) {
 	chirpIDStr := r.PathValue("chirpID")
 	chirpID, err := uuid.Parse(chirpIDStr)
 	if err != nil {
-		resp := errorResponse{Error: "Invalid chirp ID"}
-		writeJSONResponse(rw, http.StatusBadRequest, resp)
+		problem.Invalid(rw, r, "chirpID", "invalid", "Invalid chirp ID")
 		return
 	}
 
-	// Get token from Authorization header
-	token, err := auth.GetBearerToken(r.Header)
+	// Accept a Bearer JWT or an API key with write access
+	userID, err := apiCfg.authenticate(r, auth.ScopeChirpsWrite)
 	if err != nil {
-		resp := errorResponse{Error: "Authentication required"}
-		writeJSONResponse(rw, http.StatusUnauthorized, resp)
+		writeAuthError(rw, r, err)
 		return
 	}
 
-	// Validate JWT and get userID directly
-	userID, err := auth.ValidateJWT(token, apiCfg.secret)
-	if err != nil {
-		resp := errorResponse{Error: "Invalid token"}
-		writeJSONResponse(rw, http.StatusUnauthorized, resp)
-		return
-	}
+	// Read, check and delete in one transaction so the chirp can't change
+	// hands in between
+	err = apiCfg.storage.Atomic(r.Context(), func(q store.Queries) error {
+		chirp, err := q.GetOneChirp(r.Context(), chirpID)
+		if err != nil {
+			return err
+		}
 
-	chirp, err := apiCfg.database.GetOneChirp(r.Context(), chirpID)
-	if err != nil {
-		resp := errorResponse{Error: "Chirp not found"}
-		writeJSONResponse(rw, http.StatusNotFound, resp)
+		// Check if user is the author
+		if chirp.UserID != userID {
+			return errNotAuthor
+		}
+
+		return q.DeleteOneChirp(r.Context(), chirpID)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Error(rw, r, problem.NotFound, "Chirp not found")
 		return
 	}
-
-	// Check if user is the author
-	if chirp.UserID != userID {
-		resp := errorResponse{Error: "Forbidden"}
-		writeJSONResponse(rw, http.StatusForbidden, resp)
+	if errors.Is(err, errNotAuthor) {
+		problem.Error(rw, r, problem.Forbidden, "Forbidden")
 		return
 	}
-
-	// Delete the chirp
-	err = apiCfg.database.DeleteOneChirp(r.Context(), chirpID)
 	if err != nil {
-		resp := errorResponse{Error: "Failed to delete chirp"}
-		writeJSONResponse(rw, http.StatusInternalServerError, resp)
+		problem.Error(rw, r, problem.Internal, "Failed to delete chirp")
 		return
 	}
 
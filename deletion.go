@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
+)
+
+const (
+	accountRestoreLifetime = 15 * time.Minute
+	deletionPurgeInterval  = time.Hour
+)
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type DeleteAccountResponse struct {
+	DeletionScheduledFor time.Time `json:"deletion_scheduled_for"`
+}
+
+type RestoreAccountRequest struct {
+	RestoreToken string `json:"restore_token"`
+}
+
+func (apiCfg *apiConfig) deletionScheduledFor(user database.User) time.Time {
+	return user.DeletionRequestedAt.Time.Add(apiCfg.deletionGracePeriod)
+}
+
+// writePendingDeletion tells a user who just proved their password that the
+// account is about to go, and hands them a token to stop that. The restore
+// token can be exchanged at /api/users/restore to keep the account.
+func (apiCfg *apiConfig) writePendingDeletion(rw http.ResponseWriter, r *http.Request, user database.User) {
+	token, err := auth.MakeScopedJWT(user.ID, apiCfg.secret, accountRestoreLifetime, auth.ScopeAccountRestore)
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Error creating token")
+		return
+	}
+
+	p := problem.New(r, problem.AccountPendingDeletion, "Send the restore token to POST /api/users/restore to keep the account")
+	p.With("deletion_scheduled_for", apiCfg.deletionScheduledFor(user))
+	p.With("restore_token", token)
+	problem.Write(rw, p)
+}
+
+func (apiCfg *apiConfig) DeleteMe(rw http.ResponseWriter, r *http.Request) {
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
+	if err != nil {
+		writeAuthError(rw, r, err)
+		return
+	}
+
+	req := DeleteAccountRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
+		return
+	}
+
+	if req.Password == "" {
+		problem.Invalid(rw, r, "password", "required", "Password is required to delete the account")
+		return
+	}
+
+	user, err := apiCfg.storage.GetUserByID(r.Context(), userID)
+	if err != nil {
+		problem.Error(rw, r, problem.NotFound, "User not found")
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := apiCfg.loginRetryAfter(r.Context(), user.Email, ip)
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Internal server error")
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(rw, r, wait)
+		return
+	}
+
+	if err := apiCfg.checkPassword(r.Context(), user, req.Password); err != nil {
+		apiCfg.recordLoginFailure(r.Context(), user.Email, ip)
+		problem.Error(rw, r, problem.InvalidCredentials, "Password is incorrect")
+		return
+	}
+
+	// Hiding the chirps needs no extra step: they disappear from every
+	// listing as soon as deletion_requested_at is set
+	err = apiCfg.storage.Atomic(r.Context(), func(q store.Queries) error {
+		var err error
+		user, err = q.RequestUserDeletion(r.Context(), userID)
+		if err != nil {
+			return err
+		}
+		return q.RevokeAllRefreshTokensForUser(r.Context(), userID)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Error(rw, r, problem.Conflict, "Account is already scheduled for deletion")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error scheduling account deletion", "error", err)
+		problem.Error(rw, r, problem.Internal, "Couldn't delete account")
+		return
+	}
+
+	response := DeleteAccountResponse{
+		DeletionScheduledFor: apiCfg.deletionScheduledFor(user),
+	}
+	writeJSONResponse(rw, http.StatusAccepted, response)
+}
+
+func (apiCfg *apiConfig) RestoreAccount(rw http.ResponseWriter, r *http.Request) {
+	req := RestoreAccountRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
+		return
+	}
+
+	userID, scope, err := auth.ValidateScopedJWT(req.RestoreToken, apiCfg.secret)
+	if err != nil || scope != auth.ScopeAccountRestore {
+		problem.Error(rw, r, problem.InvalidToken, "Invalid or expired restore token")
+		return
+	}
+
+	restored, err := apiCfg.storage.CancelUserDeletion(r.Context(), userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error restoring account", "error", err)
+		problem.Error(rw, r, problem.Internal, "Couldn't restore account")
+		return
+	}
+
+	// Either already restored, or the grace period ran out and it's gone
+	if restored == 0 {
+		problem.Error(rw, r, problem.NotFound, "Account is not scheduled for deletion")
+		return
+	}
+
+	// Tokens come from a normal login, so 2FA still applies afterwards
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// purgeDeletedAccounts hard-deletes accounts whose grace period has run out.
+// Everything the user owns goes with them through ON DELETE CASCADE.
+func (apiCfg *apiConfig) purgeDeletedAccounts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		cutoff := sql.NullTime{Time: time.Now().Add(-apiCfg.deletionGracePeriod), Valid: true}
+		purged, err := apiCfg.storage.PurgeDeletedUsers(ctx, cutoff)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error purging deleted accounts", "error", err)
+		} else if purged > 0 {
+			slog.InfoContext(ctx, "Purged deleted accounts", "count", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
+)
+
+const (
+	exportStatusPending = "pending"
+	exportStatusFailed  = "failed"
+
+	exportBuildTimeout = 5 * time.Minute
+	// Archives hold everything about a user, so they are deleted a week
+	// after they're built
+	exportLifetime      = 7 * 24 * time.Hour
+	exportSweepInterval = time.Hour
+)
+
+type DataExportResponse struct {
+	ID          uuid.UUID  `json:"id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+type exportProfile struct {
+	ID                  uuid.UUID  `json:"id"`
+	Email               string     `json:"email"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+	EmailVerifiedAt     *time.Time `json:"email_verified_at"`
+	DeletionRequestedAt *time.Time `json:"deletion_requested_at"`
+	TwoFactorEnabled    bool       `json:"two_factor_enabled"`
+}
+
+type exportSession struct {
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+// exportLike is the shape likes.json will have once chirps can be liked.
+// Until then every archive carries an empty list.
+type exportLike struct {
+	ChirpID   uuid.UUID `json:"chirp_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var exportIndexTemplate = template.Must(template.New("export").Parse(`<html>
+<head><meta charset="utf-8"><title>Your Chirpy data</title></head>
+<body>
+<h1>Your Chirpy data</h1>
+<p>Exported {{.ExportedAt.Format "2 January 2006 15:04 MST"}} for {{.Profile.Email}}.</p>
+<h2>Profile</h2>
+<ul>
+<li>Account ID: {{.Profile.ID}}</li>
+<li>Email: {{.Profile.Email}}</li>
+<li>Joined: {{.Profile.CreatedAt.Format "2 January 2006"}}</li>
+<li>Email verified: {{if .Profile.EmailVerifiedAt}}yes{{else}}no{{end}}</li>
+<li>Two-factor authentication: {{if .Profile.TwoFactorEnabled}}on{{else}}off{{end}}</li>
+</ul>
+<h2>Chirps ({{len .Chirps}})</h2>
+<ul>
+{{range .Chirps}}<li>{{.CreatedAt.Format "2006-01-02 15:04"}}: {{.Body}}</li>
+{{end}}</ul>
+<h2>Sessions ({{len .Sessions}})</h2>
+<ul>
+{{range .Sessions}}<li>Started {{.CreatedAt.Format "2006-01-02 15:04"}}, {{if .RevokedAt}}logged out {{.RevokedAt.Format "2006-01-02 15:04"}}{{else}}expires {{.ExpiresAt.Format "2006-01-02 15:04"}}{{end}}</li>
+{{end}}</ul>
+<h2>Likes ({{len .Likes}})</h2>
+<h2>Files in this archive</h2>
+<ul>
+<li>profile.json</li>
+<li>chirps.json</li>
+<li>sessions.json</li>
+<li>likes.json</li>
+</ul>
+</body>
+</html>`))
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func dataExportToResponse(export database.DataExport) DataExportResponse {
+	return DataExportResponse{
+		ID:          export.ID,
+		Status:      export.Status,
+		CreatedAt:   export.CreatedAt,
+		CompletedAt: nullTimePtr(export.CompletedAt),
+		ExpiresAt:   nullTimePtr(export.ExpiresAt),
+	}
+}
+
+// buildExportArchive collects everything stored about the user into a zip.
+func (apiCfg *apiConfig) buildExportArchive(ctx context.Context, userID uuid.UUID) ([]byte, error) {
+	user, err := apiCfg.storage.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	twoFactor, err := apiCfg.twoFactorEnabled(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	dbChirps, err := apiCfg.storage.GetChirpsForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	dbSessions, err := apiCfg.storage.GetSessionsForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := exportProfile{
+		ID:                  user.ID,
+		Email:               user.Email,
+		CreatedAt:           user.CreatedAt,
+		UpdatedAt:           user.UpdatedAt,
+		EmailVerifiedAt:     nullTimePtr(user.EmailVerifiedAt),
+		DeletionRequestedAt: nullTimePtr(user.DeletionRequestedAt),
+		TwoFactorEnabled:    twoFactor,
+	}
+
+	chirps := []Chirp{}
+	for _, chirp := range dbChirps {
+		chirps = append(chirps, Chirp{
+			ID:        chirp.ID,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
+			Body:      chirp.Body,
+			UserID:    chirp.UserID,
+		})
+	}
+
+	sessions := []exportSession{}
+	for _, session := range dbSessions {
+		sessions = append(sessions, exportSession{
+			CreatedAt: session.CreatedAt,
+			ExpiresAt: session.ExpiresAt,
+			RevokedAt: nullTimePtr(session.RevokedAt),
+		})
+	}
+
+	likes := []exportLike{}
+
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", profile},
+		{"chirps.json", chirps},
+		{"sessions.json", sessions},
+		{"likes.json", likes},
+	}
+	for _, file := range files {
+		w, err := archive.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.data); err != nil {
+			return nil, err
+		}
+	}
+
+	w, err := archive.Create("index.html")
+	if err != nil {
+		return nil, err
+	}
+	err = exportIndexTemplate.Execute(w, struct {
+		ExportedAt time.Time
+		Profile    exportProfile
+		Chirps     []Chirp
+		Sessions   []exportSession
+		Likes      []exportLike
+	}{time.Now().UTC(), profile, chirps, sessions, likes})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// runDataExport builds the archive in the background and records the
+// outcome on the export row. Shutdown stops the build, and the export fails.
+func (apiCfg *apiConfig) runDataExport(exportID, userID uuid.UUID) {
+	ctx, cancel := context.WithTimeout(apiCfg.stopping, exportBuildTimeout)
+	defer cancel()
+
+	archive, err := apiCfg.buildExportArchive(ctx, userID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error building data export", "error", err)
+		if err := apiCfg.storage.FailDataExport(context.WithoutCancel(ctx), exportID); err != nil {
+			slog.ErrorContext(ctx, "Error marking data export failed", "error", err)
+		}
+		return
+	}
+
+	err = apiCfg.storage.CompleteDataExport(ctx, database.CompleteDataExportParams{
+		ID:        exportID,
+		Archive:   archive,
+		ExpiresAt: sql.NullTime{Time: time.Now().Add(exportLifetime), Valid: true},
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error storing data export", "error", err)
+	}
+}
+
+// sweepDataExports deletes archives once they expire, and fails exports
+// left pending by a server that stopped before finishing them, so that
+// the user can ask again.
+func (apiCfg *apiConfig) sweepDataExports(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		deleted, err := apiCfg.storage.DeleteExpiredDataExports(ctx, sql.NullTime{Time: now, Valid: true})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error deleting expired data exports", "error", err)
+		} else if deleted > 0 {
+			slog.InfoContext(ctx, "Deleted expired data exports", "count", deleted)
+		}
+
+		failed, err := apiCfg.storage.FailStaleDataExports(ctx, now.Add(-exportBuildTimeout))
+		if err != nil {
+			slog.ErrorContext(ctx, "Error failing stale data exports", "error", err)
+		} else if failed > 0 {
+			slog.WarnContext(ctx, "Failed data exports left unfinished", "count", failed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (apiCfg *apiConfig) StartDataExport(rw http.ResponseWriter, r *http.Request) {
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
+	if err != nil {
+		writeAuthError(rw, r, err)
+		return
+	}
+
+	// Only the latest export is kept
+	var export database.DataExport
+	err = apiCfg.storage.Atomic(r.Context(), func(q store.Queries) error {
+		if err := q.DeleteDataExportsForUser(r.Context(), userID); err != nil {
+			return err
+		}
+
+		var err error
+		export, err = q.CreateDataExport(r.Context(), userID)
+		return err
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating data export", "error", err)
+		problem.Error(rw, r, problem.Internal, "Couldn't start export")
+		return
+	}
+
+	apiCfg.goBackground(func() {
+		apiCfg.runDataExport(export.ID, userID)
+	})
+
+	rw.Header().Set("Location", "/api/users/me/export/"+export.ID.String())
+	writeJSONResponse(rw, http.StatusAccepted, dataExportToResponse(export))
+}
+
+func (apiCfg *apiConfig) GetDataExport(rw http.ResponseWriter, r *http.Request) {
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
+	if err != nil {
+		writeAuthError(rw, r, err)
+		return
+	}
+
+	exportID, err := uuid.Parse(r.PathValue("exportID"))
+	if err != nil {
+		problem.Invalid(rw, r, "exportID", "invalid", "Invalid export ID")
+		return
+	}
+
+	export, err := apiCfg.storage.GetDataExport(r.Context(), database.GetDataExportParams{
+		ID:     exportID,
+		UserID: userID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Error(rw, r, problem.NotFound, "Export not found")
+		return
+	}
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Failed to get export")
+		return
+	}
+
+	switch export.Status {
+	case exportStatusPending:
+		writeJSONResponse(rw, http.StatusAccepted, dataExportToResponse(export))
+		return
+	case exportStatusFailed:
+		problem.Error(rw, r, problem.Internal, "Export failed, please request a new one")
+		return
+	}
+
+	if export.ExpiresAt.Valid && time.Now().After(export.ExpiresAt.Time) {
+		problem.Error(rw, r, problem.Gone, "Export has expired, please request a new one")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/zip")
+	rw.Header().Set("Content-Disposition", `attachment; filename="chirpy-export-`+export.ID.String()+`.zip"`)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(export.Archive)
+}
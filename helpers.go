@@ -1,47 +1,116 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/lib/pq"
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/health"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
 )
 
-type errorResponse struct {
-	Error string `json:"error"`
-}
-
 var BannedWords = []string{"kerfuffle",
 	"sharbert",
 	"fornax",
 }
 
 func isDuplicateKeyError(err error) bool {
-	// Check if the error is of type pq.Error
-	pqErr, ok := err.(*pq.Error)
-	if !ok {
-		return false
-	}
-	// Check if the SQL state matches PostgreSQL's unique_violation code
-	return pqErr.Code == "23505"
+	// Covers Postgres' unique_violation as well as the other stores
+	return store.IsUniqueViolation(err)
 }
 
-func Readiness(rw http.ResponseWriter, r *http.Request) {
+// Readiness fails as soon as shutdown starts, so load balancers stop
+// sending traffic before connections are drained.
+func (apiCfg *apiConfig) Readiness(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if apiCfg.shuttingDown.Load() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte("Shutting down"))
+		return
+	}
 	rw.WriteHeader(200)
 	rw.Write([]byte("OK"))
 }
 
+var errShuttingDown = errors.New("shutting down")
+
+// Livez only shows the process is serving requests. It checks nothing else,
+// so an outage elsewhere doesn't get the server restarted.
+func (apiCfg *apiConfig) Livez(rw http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(rw, http.StatusOK, map[string]string{"status": health.StatusOK})
+}
+
+// Readyz runs every registered check and fails if any of them does,
+// including once shutdown has started.
+func (apiCfg *apiConfig) Readyz(rw http.ResponseWriter, r *http.Request) {
+	report := apiCfg.health.Run(r.Context())
+	status := http.StatusOK
+	if !report.OK() {
+		status = http.StatusServiceUnavailable
+		for name, result := range report.Checks {
+			if result.Status != health.StatusOK && name != "shutdown" {
+				slog.WarnContext(r.Context(), "Readiness check failed", "check", name, "error", result.Error)
+			}
+		}
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	writeJSONResponse(rw, status, report)
+}
+
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits.Add(1)
+		cfg.metrics.FileserverHit()
 		next.ServeHTTP(rw, r)
 	})
 }
 
+// authorizeAdmin checks for the ADMIN_TOKEN as a bearer token. Admin routes
+// are disabled entirely when no token is configured.
+func (cfg *apiConfig) authorizeAdmin(r *http.Request) bool {
+	if cfg.adminToken == "" {
+		return false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.adminToken)) == 1
+}
+
+// clientIP is the address realIP settled on.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// checkPasswordPolicy writes a 400 listing every broken rule and returns
+// false if the password isn't acceptable.
+func (cfg *apiConfig) checkPasswordPolicy(rw http.ResponseWriter, r *http.Request, password, email string) bool {
+	violations := cfg.passwordPolicy.Check(password, email)
+	if len(violations) == 0 {
+		return true
+	}
+
+	p := problem.New(r, problem.ValidationFailed, "Password does not meet the password policy")
+	for _, violation := range violations {
+		p.WithField("password", violation.Code, violation.Message)
+	}
+	problem.Write(rw, p)
+	return false
+}
+
 func writeJSONResponse(w http.ResponseWriter, status int, data interface{}) error {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(data)
@@ -53,23 +122,96 @@ func writeJSONResponse(w http.ResponseWriter, status int, data interface{}) erro
 	return nil
 }
 
+var (
+	errNoCredentials     = errors.New("no bearer token or api key provided")
+	errInsufficientScope = errors.New("credentials are missing the required scope")
+	errPendingDeletion   = errors.New("account is scheduled for deletion")
+)
+
+// authenticate accepts either a Bearer JWT or an ApiKey. JWTs from the user's
+// own login may do anything; API keys and OAuth tokens are limited to their
+// scopes.
+func (apiCfg *apiConfig) authenticate(r *http.Request, scope string) (uuid.UUID, error) {
+	if token, err := auth.GetBearerToken(r.Header); err == nil {
+		userID, tokenScope, err := auth.ValidateScopedJWT(token, apiCfg.secret)
+		if err != nil {
+			return uuid.UUID{}, err
+		}
+		if tokenScope != "" && !auth.HasScope(tokenScope, scope) {
+			return uuid.UUID{}, errInsufficientScope
+		}
+
+		// Access tokens outlive the refresh tokens revoked on deletion, so
+		// the account itself has to be checked
+		user, err := apiCfg.storage.GetUserByID(r.Context(), userID)
+		if err != nil {
+			return uuid.UUID{}, err
+		}
+		if user.DeletionRequestedAt.Valid {
+			return uuid.UUID{}, errPendingDeletion
+		}
+
+		setRequestUser(r, userID)
+		return userID, nil
+	}
+
+	key, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		return uuid.UUID{}, errNoCredentials
+	}
+
+	apiKey, err := apiCfg.storage.GetAPIKeyByHash(r.Context(), auth.HashToken(key))
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	if apiKey.ExpiresAt.Valid && apiKey.ExpiresAt.Time.Before(time.Now()) {
+		return uuid.UUID{}, errors.New("api key has expired")
+	}
+
+	if !auth.HasScope(apiKey.Scopes, scope) {
+		return uuid.UUID{}, errInsufficientScope
+	}
+
+	if err := apiCfg.storage.TouchAPIKey(r.Context(), apiKey.ID); err != nil {
+		slog.ErrorContext(r.Context(), "Error updating api key last use", "error", err)
+	}
+
+	setRequestUser(r, apiKey.UserID)
+	return apiKey.UserID, nil
+}
+
+func writeAuthError(rw http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errInsufficientScope) {
+		problem.Error(rw, r, problem.InsufficientScope, "Token does not have the required scope")
+		return
+	}
+	if errors.Is(err, errNoCredentials) {
+		problem.Error(rw, r, problem.Unauthorized, "Authentication required")
+		return
+	}
+	if errors.Is(err, errPendingDeletion) {
+		problem.Error(rw, r, problem.AccountPendingDeletion, "Restore the account with POST /api/users/restore to use it again")
+		return
+	}
+	problem.Error(rw, r, problem.InvalidToken, "Invalid token")
+}
+
 func (apiCfg *apiConfig) RefreshToken(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Set("Content-Type", "application/json")
 
 	// Get token from Authorization header
 	authHeader := r.Header.Get("Authorization")
 	if !strings.HasPrefix(authHeader, "Bearer ") {
-		resp := errorResponse{Error: "Authorization header is required"}
-		writeJSONResponse(rw, http.StatusUnauthorized, resp)
+		problem.Error(rw, r, problem.Unauthorized, "Authorization header is required")
 		return
 	}
 	refreshToken := strings.TrimPrefix(authHeader, "Bearer ")
 
 	// Get user from refresh token
-	user, err := apiCfg.database.GetUserFromRefreshToken(r.Context(), refreshToken)
+	user, err := apiCfg.storage.GetUserFromRefreshToken(r.Context(), refreshToken)
 	if err != nil {
-		resp := errorResponse{Error: "Invalid refresh token"}
-		writeJSONResponse(rw, http.StatusUnauthorized, resp)
+		problem.Error(rw, r, problem.InvalidToken, "Invalid refresh token")
 		return
 	}
 
@@ -83,8 +225,7 @@ func (apiCfg *apiConfig) RefreshToken(rw http.ResponseWriter, r *http.Request) {
 	// Sign the token
 	tokenString, err := token.SignedString([]byte(apiCfg.secret))
 	if err != nil {
-		resp := errorResponse{Error: "Error creating token"}
-		writeJSONResponse(rw, http.StatusInternalServerError, resp)
+		problem.Error(rw, r, problem.Internal, "Error creating token")
 		return
 	}
 
@@ -102,17 +243,15 @@ func (apiCfg *apiConfig) RevokeToken(rw http.ResponseWriter, r *http.Request) {
 	// Get token from Authorization header
 	authHeader := r.Header.Get("Authorization")
 	if !strings.HasPrefix(authHeader, "Bearer ") {
-		resp := errorResponse{Error: "Authorization header is required"}
-		writeJSONResponse(rw, http.StatusUnauthorized, resp)
+		problem.Error(rw, r, problem.Unauthorized, "Authorization header is required")
 		return
 	}
 	refreshToken := strings.TrimPrefix(authHeader, "Bearer ")
 
 	// Revoke the token
-	err := apiCfg.database.RevokeRefreshToken(r.Context(), refreshToken)
+	err := apiCfg.storage.RevokeRefreshToken(r.Context(), refreshToken)
 	if err != nil {
-		resp := errorResponse{Error: "Could not revoke token"}
-		writeJSONResponse(rw, http.StatusInternalServerError, resp)
+		problem.Error(rw, r, problem.Internal, "Could not revoke token")
 		return
 	}
 
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/idempotency"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotencySweepInterval = time.Hour
+	maxIdempotencyKeyLength  = 255
+	idempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// setupIdempotency shares keys through Postgres when running on it, so a
+// retry is recognised whichever replica it reaches.
+func (apiCfg *apiConfig) setupIdempotency() {
+	if apiCfg.postgres != nil {
+		apiCfg.idempotency = idempotency.NewPostgres(apiCfg.database)
+		return
+	}
+	apiCfg.idempotency = idempotency.NewMemory()
+}
+
+// idempotent lets clients safely retry next. The first request with a given
+// Idempotency-Key is handled and its response saved; retries with the same
+// key and body within the TTL get that response back instead of being
+// handled again. Keys are per route and per caller, or per client IP for
+// requests without credentials, so nobody sees a response meant for someone
+// else. Server errors aren't saved, so those can be retried for real.
+func (apiCfg *apiConfig) idempotent(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(rw, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			problem.Invalid(rw, r, idempotencyKeyHeader, "too_long", "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			problem.Error(rw, r, problem.BadRequest, "Couldn't read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Saving the response has to happen even if the client hangs up
+		ctx := context.WithoutCancel(r.Context())
+		storeKey := r.Pattern + "\x00" + apiCfg.rateLimitKey(r) + "\x00" + key
+		fingerprint := idempotency.Fingerprint(body)
+		now := time.Now()
+
+		claimed, existing, err := apiCfg.idempotency.Claim(ctx, storeKey, fingerprint, now, now.Add(-apiCfg.config.IdempotencyKeyTTL))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error claiming idempotency key", "error", err)
+			problem.Error(rw, r, problem.Internal, "Internal server error")
+			return
+		}
+		if !claimed {
+			switch {
+			case existing.Fingerprint != fingerprint:
+				problem.Error(rw, r, problem.IdempotencyKeyReused, "Use a new Idempotency-Key for a different request")
+			case existing.Response == nil:
+				rw.Header().Set("Retry-After", "1")
+				problem.Error(rw, r, problem.IdempotencyKeyInUse, "Retry once the first request has finished")
+			default:
+				rw.Header().Set("Content-Type", existing.Response.ContentType)
+				rw.Header().Set(idempotentReplayedHeader, "true")
+				rw.WriteHeader(existing.Response.Status)
+				rw.Write(existing.Response.Body)
+			}
+			return
+		}
+
+		recorder := &responseCapture{statusRecorder: statusRecorder{ResponseWriter: rw}}
+		completed := false
+		defer func() {
+			// The handler panicked or failed; let the client try again
+			if !completed {
+				if err := apiCfg.idempotency.Release(ctx, storeKey); err != nil {
+					slog.ErrorContext(r.Context(), "Error releasing idempotency key", "error", err)
+				}
+			}
+		}()
+
+		next(recorder, r)
+
+		status := recorder.statusCode()
+		if status >= 500 {
+			return
+		}
+		err = apiCfg.idempotency.Complete(ctx, storeKey, idempotency.Response{
+			Status:      status,
+			ContentType: rw.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error saving idempotent response", "error", err)
+			return
+		}
+		completed = true
+	})
+}
+
+// responseCapture keeps a copy of the body written through it.
+type responseCapture struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.statusRecorder.Write(b)
+}
+
+// sweepIdempotencyKeys forgets keys older than the TTL.
+func (apiCfg *apiConfig) sweepIdempotencyKeys(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := apiCfg.idempotency.Sweep(ctx, time.Now().Add(-apiCfg.config.IdempotencyKeyTTL)); err != nil {
+			slog.ErrorContext(ctx, "Error sweeping idempotency keys", "error", err)
+		}
+	}
+}
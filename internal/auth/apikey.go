@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	ScopeChirpsWrite = "chirps:write"
+	// ScopeAccount is never granted to API keys or OAuth clients, so only a
+	// token from the user's own login can manage their account.
+	ScopeAccount = "account"
+)
+
+// APIKeyPrefixLength is how many characters of a key are kept in clear text
+// so users can tell their keys apart.
+const APIKeyPrefixLength = 12
+
+const apiKeyTag = "chirpy_"
+
+var validScopes = map[string]bool{
+	ScopeChirpsWrite: true,
+}
+
+func MakeAPIKey() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return apiKeyTag + hex.EncodeToString(b), nil
+}
+
+func GetAPIKey(headers http.Header) (string, error) {
+	authHeader := headers.Get("Authorization")
+	if len(authHeader) == 0 {
+		return "", errors.New("empty auth header")
+	}
+
+	if !strings.HasPrefix(authHeader, "ApiKey ") {
+		return "", errors.New("auth header doesnt start with ApiKey")
+	}
+
+	s := strings.TrimSpace(strings.TrimPrefix(authHeader, "ApiKey "))
+	if len(s) == 0 {
+		return "", errors.New("api key is empty")
+	}
+
+	return s, nil
+}
+
+func ValidScope(scope string) bool {
+	return validScopes[scope]
+}
+
+// Scopes are stored space separated, the same way OAuth2 transmits them.
+func JoinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+func ParseScopes(scopes string) []string {
+	return strings.Fields(scopes)
+}
+
+func HasScope(scopes string, want string) bool {
+	for _, s := range ParseScopes(scopes) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,16 @@
 package auth
 
 import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestJWTCreationAndValidation(t *testing.T) {
@@ -77,3 +83,329 @@ func TestJWTCreationAndValidation(t *testing.T) {
 		}
 	})
 }
+
+func TestAPIKeys(t *testing.T) {
+	t.Run("hash is stable and hides the key", func(t *testing.T) {
+		key, err := MakeAPIKey()
+		if err != nil {
+			t.Fatalf("Error creating api key: %v", err)
+		}
+
+		if HashToken(key) != HashToken(key) {
+			t.Error("Expected hashing the same key twice to match")
+		}
+		if HashToken(key) == key {
+			t.Error("Expected hash to differ from the key")
+		}
+	})
+
+	t.Run("reads ApiKey header", func(t *testing.T) {
+		headers := http.Header{}
+		headers.Set("Authorization", "ApiKey chirpy_abc")
+
+		key, err := GetAPIKey(headers)
+		if err != nil {
+			t.Fatalf("Error reading api key: %v", err)
+		}
+		if key != "chirpy_abc" {
+			t.Errorf("Got key %q, want %q", key, "chirpy_abc")
+		}
+	})
+
+	t.Run("rejects bearer header", func(t *testing.T) {
+		headers := http.Header{}
+		headers.Set("Authorization", "Bearer some.jwt.token")
+
+		_, err := GetAPIKey(headers)
+		if err == nil {
+			t.Error("Expected error for bearer header, got nil")
+		}
+	})
+
+	t.Run("scopes", func(t *testing.T) {
+		scopes := JoinScopes([]string{ScopeAccount, ScopeChirpsWrite})
+		if !HasScope(scopes, ScopeChirpsWrite) {
+			t.Errorf("Expected %q to include %q", scopes, ScopeChirpsWrite)
+		}
+		if HasScope(ScopeAccount, ScopeChirpsWrite) {
+			t.Errorf("Expected %q not to include %q", ScopeAccount, ScopeChirpsWrite)
+		}
+		// Reading chirps needs no credentials, so there's no scope for it
+		for _, scope := range []string{ScopeAccount, "chirps:read"} {
+			if ValidScope(scope) {
+				t.Errorf("Expected %q not to be grantable", scope)
+			}
+		}
+	})
+}
+
+func TestScopedJWT(t *testing.T) {
+	userID := uuid.New()
+	tokenSecret := "your-test-secret"
+
+	token, err := MakeScopedJWT(userID, tokenSecret, time.Hour, ScopeChirpsWrite)
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+
+	// Scoped tokens still pass the plain validation every handler uses
+	gotUserID, err := ValidateJWT(token, tokenSecret)
+	if err != nil {
+		t.Fatalf("Error validating token: %v", err)
+	}
+	if gotUserID != userID {
+		t.Errorf("Got user ID %v, want %v", gotUserID, userID)
+	}
+
+	_, scope, err := ValidateScopedJWT(token, tokenSecret)
+	if err != nil {
+		t.Fatalf("Error validating token: %v", err)
+	}
+	if scope != ScopeChirpsWrite {
+		t.Errorf("Got scope %q, want %q", scope, ScopeChirpsWrite)
+	}
+}
+
+func TestVerifyPKCE(t *testing.T) {
+	// Example from RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if !VerifyPKCE(verifier, challenge) {
+		t.Error("Expected RFC 7636 example verifier to match")
+	}
+	if VerifyPKCE(verifier+"x", challenge) {
+		t.Error("Expected altered verifier not to match")
+	}
+	if VerifyPKCE("short", challenge) {
+		t.Error("Expected too short verifier to be rejected")
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// Base32 of the SHA-1 test key from RFC 6238 appendix B
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	t.Run("RFC 6238 test vectors", func(t *testing.T) {
+		cases := map[int64]string{
+			59:         "287082",
+			1111111109: "081804",
+			2000000000: "279037",
+		}
+		for unix, want := range cases {
+			got, err := TOTPCode(secret, TOTPStep(time.Unix(unix, 0)))
+			if err != nil {
+				t.Fatalf("Error creating code: %v", err)
+			}
+			if got != want {
+				t.Errorf("At %d got code %s, want %s", unix, got, want)
+			}
+		}
+	})
+
+	t.Run("window allows clock drift", func(t *testing.T) {
+		now := time.Unix(1111111109, 0)
+		previous, err := TOTPCode(secret, TOTPStep(now)-1)
+		if err != nil {
+			t.Fatalf("Error creating code: %v", err)
+		}
+
+		step, ok := ValidateTOTP(secret, previous, now, 1)
+		if !ok {
+			t.Fatal("Expected code from previous step to be accepted")
+		}
+		if step != TOTPStep(now)-1 {
+			t.Errorf("Got step %d, want %d", step, TOTPStep(now)-1)
+		}
+
+		if _, ok := ValidateTOTP(secret, previous, now, 0); ok {
+			t.Error("Expected code from previous step to be rejected with no window")
+		}
+	})
+
+	t.Run("recovery codes normalize", func(t *testing.T) {
+		codes, err := MakeRecoveryCodes(2)
+		if err != nil {
+			t.Fatalf("Error creating recovery codes: %v", err)
+		}
+		typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+		if NormalizeRecoveryCode(typed) != codes[0] {
+			t.Errorf("Got %q, want %q", NormalizeRecoveryCode(typed), codes[0])
+		}
+		if codes[0] == codes[1] {
+			t.Error("Expected recovery codes to differ")
+		}
+	})
+}
+
+func TestPasswordHasher(t *testing.T) {
+	// Small parameters keep the test fast; production uses DefaultArgon2Params
+	fastArgon2 := Argon2Params{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	hasher := &PasswordHasher{Algorithm: AlgorithmArgon2id, Argon2: fastArgon2, BcryptCost: bcrypt.MinCost}
+
+	t.Run("argon2id round trip", func(t *testing.T) {
+		hash, err := hasher.Hash("hunter2")
+		if err != nil {
+			t.Fatalf("Error hashing password: %v", err)
+		}
+		if !strings.HasPrefix(hash, "$argon2id$v=19$m=8192,t=1,p=1$") {
+			t.Errorf("Unexpected hash format %q", hash)
+		}
+
+		needsRehash, err := hasher.Verify("hunter2", hash)
+		if err != nil {
+			t.Fatalf("Error verifying password: %v", err)
+		}
+		if needsRehash {
+			t.Error("Expected hash with current parameters not to need a rehash")
+		}
+
+		if _, err := hasher.Verify("hunter3", hash); !errors.Is(err, ErrMismatchedPassword) {
+			t.Errorf("Got error %v, want %v", err, ErrMismatchedPassword)
+		}
+	})
+
+	t.Run("bcrypt hashes verify and need a rehash", func(t *testing.T) {
+		legacy, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("Error hashing password: %v", err)
+		}
+
+		needsRehash, err := hasher.Verify("hunter2", string(legacy))
+		if err != nil {
+			t.Fatalf("Error verifying password: %v", err)
+		}
+		if !needsRehash {
+			t.Error("Expected bcrypt hash to need a rehash")
+		}
+
+		if _, err := hasher.Verify("hunter3", string(legacy)); !errors.Is(err, ErrMismatchedPassword) {
+			t.Errorf("Got error %v, want %v", err, ErrMismatchedPassword)
+		}
+	})
+
+	t.Run("changed parameters need a rehash", func(t *testing.T) {
+		hash, err := hasher.Hash("hunter2")
+		if err != nil {
+			t.Fatalf("Error hashing password: %v", err)
+		}
+
+		stronger := &PasswordHasher{Algorithm: AlgorithmArgon2id, Argon2: fastArgon2}
+		stronger.Argon2.Iterations = 2
+		needsRehash, err := stronger.Verify("hunter2", hash)
+		if err != nil {
+			t.Fatalf("Error verifying password: %v", err)
+		}
+		if !needsRehash {
+			t.Error("Expected hash with old parameters to need a rehash")
+		}
+	})
+
+	t.Run("unset password", func(t *testing.T) {
+		if _, err := hasher.Verify("unset", UnsetPasswordHash); !errors.Is(err, ErrNoPassword) {
+			t.Errorf("Got error %v, want %v", err, ErrNoPassword)
+		}
+	})
+
+	t.Run("recognises hash formats", func(t *testing.T) {
+		hash, err := hasher.Hash("hunter2")
+		if err != nil {
+			t.Fatalf("Error hashing password: %v", err)
+		}
+		legacy, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("Error hashing password: %v", err)
+		}
+
+		for _, valid := range []string{hash, string(legacy)} {
+			if !IsPasswordHash(valid) {
+				t.Errorf("Expected %q to be recognised", valid)
+			}
+		}
+		for _, invalid := range []string{"", UnsetPasswordHash, "hunter2", "$argon2id$v=19$broken", "$2a$nope"} {
+			if IsPasswordHash(invalid) {
+				t.Errorf("Expected %q not to be recognised", invalid)
+			}
+		}
+
+		// c2FsdHNhbHQ is "saltsalt" and a2V5a2V5a2V5a2V5a2V5aw is a 16 byte key
+		outOfBounds := []struct {
+			name string
+			hash string
+		}{
+			{"no iterations", "$argon2id$v=19$m=16,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5aw"},
+			{"no parallelism", "$argon2id$v=19$m=16,t=1,p=0$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5aw"},
+			{"empty key", "$argon2id$v=19$m=16,t=1,p=1$c2FsdHNhbHQ$"},
+			{"empty salt", "$argon2id$v=19$m=16,t=1,p=1$$a2V5a2V5a2V5a2V5a2V5aw"},
+			{"too little memory", "$argon2id$v=19$m=4,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5aw"},
+			{"too much memory", "$argon2id$v=19$m=4194304,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5aw"},
+			{"too many iterations", "$argon2id$v=19$m=16,t=1000000,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5aw"},
+		}
+		for _, tc := range outOfBounds {
+			if IsPasswordHash(tc.hash) {
+				t.Errorf("%s: expected %q not to be recognised", tc.name, tc.hash)
+			}
+			if _, err := DefaultHasher.Verify("password", tc.hash); !errors.Is(err, ErrUnknownHashFormat) {
+				t.Errorf("%s: expected ErrUnknownHashFormat from Verify, got %v", tc.name, err)
+			}
+		}
+
+		minimal := "$argon2id$v=19$m=16,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5aw"
+		if !IsPasswordHash(minimal) {
+			t.Errorf("Expected %q to be recognised", minimal)
+		}
+	})
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	dir := t.TempDir()
+	corpus := filepath.Join(dir, "breached.txt")
+	// SHA-1 of "Tr0ub4dor&3", in the Pwned Passwords "HASH:COUNT" format
+	err := os.WriteFile(corpus, []byte("# test corpus\n874572E7A5AE6A49466A6AC578B98ADBA78C6AA6:3\n"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing corpus: %v", err)
+	}
+	breached, err := LoadBreachedPasswords(corpus)
+	if err != nil {
+		t.Fatalf("Error loading corpus: %v", err)
+	}
+
+	policy := &PasswordPolicy{MinLength: 8, MinEntropyBits: 40, Breached: breached}
+
+	codes := func(violations []PolicyViolation) []string {
+		out := []string{}
+		for _, v := range violations {
+			out = append(out, v.Code)
+		}
+		return out
+	}
+
+	cases := []struct {
+		name     string
+		password string
+		email    string
+		want     []string
+	}{
+		{"strong password", "plum-Kettle-41-violin", "walt@example.com", []string{}},
+		{"empty", "", "walt@example.com", []string{ViolationTooShort}},
+		{"short and weak", "abc", "walt@example.com", []string{ViolationTooShort, ViolationTooWeak}},
+		{"repeated characters", "aaaaaaaaaaaa", "walt@example.com", []string{ViolationTooWeak}},
+		{"contains email", "Walt@Example.com-2024", "walt@example.com", []string{ViolationHasEmail}},
+		{"contains local part", "zebra-WALT-9-quartz", "walt@example.com", []string{ViolationHasEmail}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := codes(policy.Check(tc.password, tc.email))
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("Got violations %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("breached", func(t *testing.T) {
+		got := codes(policy.Check("Tr0ub4dor&3", "walt@example.com"))
+		if strings.Join(got, ",") != ViolationBreached {
+			t.Errorf("Got violations %v, want %v", got, []string{ViolationBreached})
+		}
+	})
+}
@@ -1,21 +1,232 @@
 package auth
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+// UnsetPasswordHash is the default migration 003 gave accounts that existed
+// before passwords did. Those accounts have no password at all.
+const UnsetPasswordHash = "unset"
+
+var (
+	ErrMismatchedPassword = errors.New("password does not match")
+	ErrNoPassword         = errors.New("account has no password set")
+	ErrUnknownHashFormat  = errors.New("unknown password hash format")
+)
+
+type Argon2Params struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the OWASP recommendation for argon2id.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Limits on the parameters of an argon2id hash that will be verified. Hashes
+// can be imported, and verifying one runs with whatever it says, so a
+// hash asking for a gigabyte would cost that on every login. Configuration
+// is held to the same limits, or the server would make hashes it then
+// refuses to verify.
+const (
+	MaxArgon2Memory      = 256 * 1024
+	MaxArgon2Iterations  = 16
+	MaxArgon2Parallelism = 16
+
+	minArgon2SaltLength = 8
+	maxArgon2SaltLength = 64
+	minArgon2KeyLength  = 16
+	maxArgon2KeyLength  = 64
+)
+
+// PasswordHasher hashes new passwords with one configured algorithm but can
+// verify any hash an older configuration produced, and reports when a stored
+// hash should be upgraded.
+type PasswordHasher struct {
+	Algorithm  string
+	Argon2     Argon2Params
+	BcryptCost int
+
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+var DefaultHasher = &PasswordHasher{
+	Algorithm:  AlgorithmArgon2id,
+	Argon2:     DefaultArgon2Params,
+	BcryptCost: bcrypt.DefaultCost,
+}
 
 func HashPassword(password string) (string, error) {
-	bytePassword := []byte(password)
-	hashedPassword, err := bcrypt.GenerateFromPassword(bytePassword, bcrypt.DefaultCost)
+	return DefaultHasher.Hash(password)
+}
+
+func CheckPasswordHash(password, hash string) error {
+	_, err := DefaultHasher.Verify(password, hash)
+	return err
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case AlgorithmArgon2id:
+		return hashArgon2id(password, h.Argon2)
+	case AlgorithmBcrypt:
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hashedPassword), nil
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm %q", h.Algorithm)
+	}
+}
+
+// Verify checks password against hash. On success it also reports whether
+// the hash was made with an outdated algorithm or parameters.
+func (h *PasswordHasher) Verify(password, hash string) (bool, error) {
+	switch {
+	case hash == "" || hash == UnsetPasswordHash:
+		return false, ErrNoPassword
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, err := verifyArgon2id(password, hash)
+		if err != nil {
+			return false, err
+		}
+		return h.Algorithm != AlgorithmArgon2id || params != h.Argon2, nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, ErrMismatchedPassword
+		}
+		if err != nil {
+			return false, err
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return false, err
+		}
+		return h.Algorithm != AlgorithmBcrypt || cost != h.BcryptCost, nil
+	default:
+		return false, ErrUnknownHashFormat
+	}
+}
+
+// IsPasswordHash reports whether hash is in a format Verify understands, so
+// hashes brought over from another system can be checked before they are
+// stored.
+func IsPasswordHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, _, _, err := parseArgon2id(hash)
+		return err == nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err == nil
+	default:
+		return false
+	}
+}
+
+// DummyVerify spends as long as a real password check, so a login for an
+// unknown email or an account without a password takes as long as one with
+// a wrong password.
+func (h *PasswordHasher) DummyVerify(password string) {
+	h.dummyOnce.Do(func() {
+		h.dummyHash, _ = h.Hash("chirpy-timing-equalizer")
+	})
+	h.Verify(password, h.dummyHash)
+}
+
+// Argon2id hashes use the PHC string format, the same one the reference
+// implementation and most other libraries produce:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func hashArgon2id(password string, p Argon2Params) (string, error) {
+	salt := make([]byte, p.SaltLength)
+	_, err := rand.Read(salt)
 	if err != nil {
 		return "", err
 	}
 
-	return string(hashedPassword), nil
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
 }
 
-func CheckPasswordHash(password, hash string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+func verifyArgon2id(password, hash string) (Argon2Params, error) {
+	p, salt, key, err := parseArgon2id(hash)
 	if err != nil {
-		return err
+		return Argon2Params{}, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return Argon2Params{}, ErrMismatchedPassword
+	}
+
+	return p, nil
+}
+
+func parseArgon2id(hash string) (Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
 	}
-	return nil
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+
+	p := Argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+
+	if p.Iterations < 1 || p.Iterations > MaxArgon2Iterations ||
+		p.Parallelism < 1 || p.Parallelism > MaxArgon2Parallelism ||
+		p.Memory < 8*uint32(p.Parallelism) || p.Memory > MaxArgon2Memory ||
+		p.SaltLength < minArgon2SaltLength || p.SaltLength > maxArgon2SaltLength ||
+		p.KeyLength < minArgon2KeyLength || p.KeyLength > maxArgon2KeyLength {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+
+	return p, salt, key, nil
 }
@@ -11,14 +11,32 @@ import (
 	"github.com/google/uuid"
 )
 
+// ScopeAccountRestore marks the token a login hands out for an account that
+// is waiting to be deleted. It can only be used to cancel the deletion.
+const ScopeAccountRestore = "account_restore"
+
+// scopedClaims adds the OAuth2 scope claim. Tokens without it were issued
+// to the user themselves and are not limited to any scope.
+type scopedClaims struct {
+	jwt.RegisteredClaims
+	Scope string `json:"scope,omitempty"`
+}
+
 func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
+	return MakeScopedJWT(userID, tokenSecret, expiresIn, "")
+}
+
+func MakeScopedJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration, scope string) (string, error) {
 	issuedAt := jwt.NewNumericDate(time.Now().UTC())
 
-	claims := jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		Subject:   userID.String(),
-		IssuedAt:  issuedAt,
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+	claims := scopedClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "chirpy",
+			Subject:   userID.String(),
+			IssuedAt:  issuedAt,
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+		},
+		Scope: scope,
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -27,9 +45,16 @@ func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (str
 }
 
 func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+	userID, _, err := ValidateScopedJWT(tokenString, tokenSecret)
+	return userID, err
+}
+
+// ValidateScopedJWT also returns the scope claim, which is empty for tokens
+// the user obtained by logging in directly.
+func ValidateScopedJWT(tokenString, tokenSecret string) (uuid.UUID, string, error) {
 	token, err := jwt.ParseWithClaims(
 		tokenString,
-		&jwt.RegisteredClaims{},
+		&scopedClaims{},
 		func(token *jwt.Token) (interface{}, error) {
 			// Return the key used to sign the token
 			return []byte(tokenSecret), nil
@@ -37,24 +62,24 @@ func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
 	)
 
 	if err != nil {
-		return uuid.UUID{}, err
+		return uuid.UUID{}, "", err
 	}
 
 	if !token.Valid {
-		return uuid.UUID{}, fmt.Errorf("invalid token")
+		return uuid.UUID{}, "", fmt.Errorf("invalid token")
 	}
 
-	claims, ok := token.Claims.(*jwt.RegisteredClaims)
+	claims, ok := token.Claims.(*scopedClaims)
 	if !ok {
-		return uuid.UUID{}, fmt.Errorf("invalid claims")
+		return uuid.UUID{}, "", fmt.Errorf("invalid claims")
 	}
 
 	userID, err := uuid.Parse(claims.Subject)
 	if err != nil {
-		return uuid.UUID{}, fmt.Errorf("invalid user ID in token")
+		return uuid.UUID{}, "", fmt.Errorf("invalid user ID in token")
 	}
 
-	return userID, nil
+	return userID, claims.Scope, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
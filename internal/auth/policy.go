@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const (
+	ViolationTooShort    = "too_short"
+	ViolationTooWeak     = "too_weak"
+	ViolationHasEmail    = "contains_email"
+	ViolationBreached    = "breached"
+	breachedPrefixLength = 5
+)
+
+type PolicyViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicy decides whether a new password is acceptable. Breached is
+// optional; without it the corpus check is skipped.
+type PasswordPolicy struct {
+	MinLength      int
+	MinEntropyBits float64
+	Breached       *BreachedPasswords
+}
+
+var DefaultPasswordPolicy = &PasswordPolicy{
+	MinLength:      8,
+	MinEntropyBits: 40,
+}
+
+// Check returns every rule the password breaks, so the user can fix them
+// all at once instead of one per attempt.
+func (p *PasswordPolicy) Check(password, email string) []PolicyViolation {
+	violations := []PolicyViolation{}
+
+	length := len([]rune(password))
+	if length < p.MinLength {
+		violations = append(violations, PolicyViolation{
+			Code:    ViolationTooShort,
+			Message: fmt.Sprintf("Password must be at least %d characters long", p.MinLength),
+		})
+	}
+
+	if length > 0 && EstimateEntropy(password) < p.MinEntropyBits {
+		violations = append(violations, PolicyViolation{
+			Code:    ViolationTooWeak,
+			Message: "Password is too easy to guess; use a longer password or more kinds of characters",
+		})
+	}
+
+	if containsEmail(password, email) {
+		violations = append(violations, PolicyViolation{
+			Code:    ViolationHasEmail,
+			Message: "Password must not contain your email address",
+		})
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		violations = append(violations, PolicyViolation{
+			Code:    ViolationBreached,
+			Message: "Password has appeared in a data breach; choose a different one",
+		})
+	}
+
+	return violations
+}
+
+func containsEmail(password, email string) bool {
+	password = strings.ToLower(password)
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return false
+	}
+	if strings.Contains(password, email) {
+		return true
+	}
+
+	// Very short local parts like "jo" would reject far too many passwords
+	local, _, _ := strings.Cut(email, "@")
+	return len(local) >= 3 && strings.Contains(password, local)
+}
+
+// EstimateEntropy gives a rough strength in bits: the size of the character
+// pool the password draws from, times its length. Characters that repeat or
+// continue a run like "abc" or "123" don't count towards the length.
+func EstimateEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	effective := 0
+	var prev rune
+	for i, r := range []rune(password) {
+		switch {
+		case unicode.IsLower(r) && r < unicode.MaxASCII:
+			lower = true
+		case unicode.IsUpper(r) && r < unicode.MaxASCII:
+			upper = true
+		case unicode.IsDigit(r) && r < unicode.MaxASCII:
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+
+		if i == 0 || (r != prev && r != prev+1 && r != prev-1) {
+			effective++
+		}
+		prev = r
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	return float64(effective) * math.Log2(float64(pool))
+}
+
+// BreachedPasswords holds SHA-1 hashes of known breached passwords, bucketed
+// by the first five hex characters the same way the Pwned Passwords range
+// API does. Lookups only ever compare suffixes within one bucket.
+type BreachedPasswords struct {
+	buckets map[string]map[string]struct{}
+}
+
+// LoadBreachedPasswords reads a file with one uppercase or lowercase SHA-1
+// per line, optionally followed by ":count" as in the Pwned Passwords dumps.
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &BreachedPasswords{buckets: map[string]map[string]struct{}{}}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash", path, line)
+		}
+
+		prefix, suffix := hash[:breachedPrefixLength], hash[breachedPrefixLength:]
+		if b.buckets[prefix] == nil {
+			b.buckets[prefix] = map[string]struct{}{}
+		}
+		b.buckets[prefix][suffix] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *BreachedPasswords) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	bucket := b.buckets[hash[:breachedPrefixLength]]
+	_, ok := bucket[hash[breachedPrefixLength:]]
+	return ok
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 )
 
@@ -15,3 +16,10 @@ func MakeRefreshToken() (string, error) {
 
 	return s, nil
 }
+
+// HashToken uses a plain SHA-256 rather than bcrypt: tokens are 256 bits of
+// randomness, and the hash has to be deterministic so it can be looked up.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
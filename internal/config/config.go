@@ -0,0 +1,501 @@
+// Package config loads the server's settings into one struct. Each setting
+// can come from, in increasing priority: its default, a YAML or TOML config
+// file, an environment variable (a .env file is read if there is one), and
+// a command-line flag.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/ratelimit"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is every setting. The env tag names the environment variable; the
+// flag is the same name in lower case with dashes. Fields tagged secret are
+// redacted when printed.
+type Config struct {
+	Addr        string `yaml:"addr" toml:"addr" env:"ADDR" usage:"address to listen on"`
+	H2C         bool   `yaml:"h2c" toml:"h2c" env:"H2C" usage:"accept HTTP/2 without TLS, for use behind a proxy"`
+	TLSCertFile string `yaml:"tls_cert_file" toml:"tls_cert_file" env:"TLS_CERT_FILE" usage:"serve HTTPS with this certificate; reloaded on SIGHUP"`
+	TLSKeyFile  string `yaml:"tls_key_file" toml:"tls_key_file" env:"TLS_KEY_FILE" usage:"private key for tls_cert_file"`
+	// TrustedProxies may set X-Forwarded-For; the client IP is the last
+	// address in it that isn't one of them
+	TrustedProxies string `yaml:"trusted_proxies" toml:"trusted_proxies" env:"TRUSTED_PROXIES" usage:"comma-separated IPs or CIDRs of proxies whose X-Forwarded-For is believed"`
+
+	ReadHeaderTimeout  time.Duration `yaml:"read_header_timeout" toml:"read_header_timeout" env:"READ_HEADER_TIMEOUT" usage:"time allowed to send request headers"`
+	ReadTimeout        time.Duration `yaml:"read_timeout" toml:"read_timeout" env:"READ_TIMEOUT" usage:"time allowed to send a whole request; 0 for none"`
+	WriteTimeout       time.Duration `yaml:"write_timeout" toml:"write_timeout" env:"WRITE_TIMEOUT" usage:"time allowed to write a response; 0 for none"`
+	IdleTimeout        time.Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"IDLE_TIMEOUT" usage:"how long an idle keep-alive connection is kept open"`
+	MaxBodyBytes       int           `yaml:"max_body_bytes" toml:"max_body_bytes" env:"MAX_BODY_BYTES" usage:"largest request body accepted"`
+	ImportMaxBodyBytes int           `yaml:"import_max_body_bytes" toml:"import_max_body_bytes" env:"IMPORT_MAX_BODY_BYTES" usage:"largest upload accepted by /admin/import"`
+
+	ShutdownDelay    time.Duration `yaml:"shutdown_delay" toml:"shutdown_delay" env:"SHUTDOWN_DELAY" usage:"how long readiness fails before draining starts"`
+	ShutdownTimeout  time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" usage:"how long to wait for requests and background work to finish"`
+	ReadinessTimeout time.Duration `yaml:"readiness_timeout" toml:"readiness_timeout" env:"READINESS_TIMEOUT" usage:"how long readiness checks may take before they count as failed"`
+	BaseURL          string        `yaml:"base_url" toml:"base_url" env:"BASE_URL" usage:"public URL of the server, used in links in emails"`
+	Platform         string        `yaml:"platform" toml:"platform" env:"PLATFORM" usage:"dev or prod; dev allows resetting all users"`
+
+	LogLevel  string `yaml:"log_level" toml:"log_level" env:"LOG_LEVEL" usage:"debug, info, warn or error"`
+	LogFormat string `yaml:"log_format" toml:"log_format" env:"LOG_FORMAT" usage:"json or text"`
+	LogPII    bool   `yaml:"log_pii" toml:"log_pii" env:"LOG_PII" usage:"log email and IP addresses instead of redacting them"`
+
+	TraceExporter    string  `yaml:"trace_exporter" toml:"trace_exporter" env:"TRACE_EXPORTER" usage:"none, stdout or otlp"`
+	OTLPEndpoint     string  `yaml:"otlp_endpoint" toml:"otlp_endpoint" env:"OTLP_ENDPOINT" usage:"http(s) URL of the OTLP collector; empty uses the OTEL_EXPORTER_OTLP_* variables"`
+	TraceSampleRatio float64 `yaml:"trace_sample_ratio" toml:"trace_sample_ratio" env:"TRACE_SAMPLE_RATIO" usage:"fraction of new traces to record, from 0 to 1"`
+
+	Secret     string `yaml:"secret" toml:"secret" env:"SECRET" secret:"true" usage:"key for signing JWTs"`
+	AdminToken string `yaml:"admin_token" toml:"admin_token" env:"ADMIN_TOKEN" secret:"true" usage:"bearer token for /admin routes; empty disables them"`
+
+	Storage     string `yaml:"storage" toml:"storage" env:"STORAGE" usage:"memory, or empty to use db_url"`
+	DBURL       string `yaml:"db_url" toml:"db_url" env:"DB_URL" secret:"url" usage:"postgres:// or sqlite: URL of the database"`
+	AutoMigrate bool   `yaml:"auto_migrate" toml:"auto_migrate" env:"AUTO_MIGRATE" usage:"apply pending migrations at startup"`
+
+	TOTPWindow           int           `yaml:"totp_window" toml:"totp_window" env:"TOTP_WINDOW" usage:"30 second steps either side of now that a TOTP code may be from"`
+	RequireVerifiedEmail bool          `yaml:"require_verified_email" toml:"require_verified_email" env:"REQUIRE_VERIFIED_EMAIL" usage:"stop unverified accounts from posting"`
+	DeletionGracePeriod  time.Duration `yaml:"deletion_grace_period" toml:"deletion_grace_period" env:"DELETION_GRACE_PERIOD" usage:"how long a deleted account can be restored"`
+	IdempotencyKeyTTL    time.Duration `yaml:"idempotency_key_ttl" toml:"idempotency_key_ttl" env:"IDEMPOTENCY_KEY_TTL" usage:"how long a response is replayed to retries with the same Idempotency-Key"`
+
+	Password  PasswordConfig  `yaml:"password" toml:"password"`
+	Mail      MailConfig      `yaml:"mail" toml:"mail"`
+	RateLimit RateLimitConfig `yaml:"rate_limit" toml:"rate_limit"`
+}
+
+type PasswordConfig struct {
+	Hash              string  `yaml:"hash" toml:"hash" env:"PASSWORD_HASH" usage:"argon2id or bcrypt, for new hashes"`
+	BcryptCost        int     `yaml:"bcrypt_cost" toml:"bcrypt_cost" env:"BCRYPT_COST" usage:"bcrypt cost"`
+	Argon2MemoryKiB   int     `yaml:"argon2_memory_kib" toml:"argon2_memory_kib" env:"ARGON2_MEMORY_KIB" usage:"argon2id memory in KiB"`
+	Argon2Iterations  int     `yaml:"argon2_iterations" toml:"argon2_iterations" env:"ARGON2_ITERATIONS" usage:"argon2id iterations"`
+	Argon2Parallelism int     `yaml:"argon2_parallelism" toml:"argon2_parallelism" env:"ARGON2_PARALLELISM" usage:"argon2id parallelism"`
+	MinLength         int     `yaml:"min_length" toml:"min_length" env:"PASSWORD_MIN_LENGTH" usage:"shortest password accepted"`
+	MinEntropy        float64 `yaml:"min_entropy" toml:"min_entropy" env:"PASSWORD_MIN_ENTROPY" usage:"lowest estimated entropy in bits accepted"`
+	BreachedFile      string  `yaml:"breached_file" toml:"breached_file" env:"BREACHED_PASSWORDS_FILE" usage:"file of breached passwords to refuse, one per line"`
+}
+
+// RateLimitConfig limits each route group, per user when the request has a
+// valid access token and per client IP otherwise. Limits look like 10/1m,
+// or off.
+type RateLimitConfig struct {
+	Store  string `yaml:"store" toml:"store" env:"RATE_LIMIT_STORE" usage:"memory, or postgres to share limits between replicas"`
+	Auth   string `yaml:"auth" toml:"auth" env:"RATE_LIMIT_AUTH" usage:"limit for logins, token refreshes and password resets"`
+	Signup string `yaml:"signup" toml:"signup" env:"RATE_LIMIT_SIGNUP" usage:"limit for creating accounts"`
+	Chirps string `yaml:"chirps" toml:"chirps" env:"RATE_LIMIT_CHIRPS" usage:"limit for posting chirps"`
+	API    string `yaml:"api" toml:"api" env:"RATE_LIMIT_API" usage:"limit for every other API route"`
+}
+
+type MailConfig struct {
+	Mailer       string `yaml:"mailer" toml:"mailer" env:"MAILER" usage:"log, file or smtp"`
+	File         string `yaml:"file" toml:"file" env:"MAILER_FILE" usage:"where the file mailer writes"`
+	From         string `yaml:"from" toml:"from" env:"MAIL_FROM" usage:"sender address"`
+	SMTPHost     string `yaml:"smtp_host" toml:"smtp_host" env:"SMTP_HOST" usage:"SMTP server"`
+	SMTPPort     string `yaml:"smtp_port" toml:"smtp_port" env:"SMTP_PORT" usage:"SMTP port"`
+	SMTPUsername string `yaml:"smtp_username" toml:"smtp_username" env:"SMTP_USERNAME" usage:"SMTP username"`
+	SMTPPassword string `yaml:"smtp_password" toml:"smtp_password" env:"SMTP_PASSWORD" secret:"true" usage:"SMTP password"`
+}
+
+func Default() *Config {
+	return &Config{
+		Addr:                ":8080",
+		ReadHeaderTimeout:   5 * time.Second,
+		ReadTimeout:         30 * time.Second,
+		WriteTimeout:        60 * time.Second,
+		IdleTimeout:         120 * time.Second,
+		MaxBodyBytes:        1 << 20,
+		ImportMaxBodyBytes:  1 << 30,
+		ShutdownTimeout:     30 * time.Second,
+		ReadinessTimeout:    2 * time.Second,
+		BaseURL:             "http://localhost:8080",
+		Platform:            "prod",
+		LogLevel:            "info",
+		LogFormat:           "json",
+		TraceExporter:       "none",
+		TraceSampleRatio:    1,
+		TOTPWindow:          1,
+		DeletionGracePeriod: 30 * 24 * time.Hour,
+		IdempotencyKeyTTL:   24 * time.Hour,
+		Password: PasswordConfig{
+			Hash:              auth.AlgorithmArgon2id,
+			BcryptCost:        bcrypt.DefaultCost,
+			Argon2MemoryKiB:   int(auth.DefaultArgon2Params.Memory),
+			Argon2Iterations:  int(auth.DefaultArgon2Params.Iterations),
+			Argon2Parallelism: int(auth.DefaultArgon2Params.Parallelism),
+			MinLength:         auth.DefaultPasswordPolicy.MinLength,
+			MinEntropy:        auth.DefaultPasswordPolicy.MinEntropyBits,
+		},
+		Mail: MailConfig{
+			Mailer:   "log",
+			File:     "mail.log",
+			SMTPPort: "587",
+		},
+		RateLimit: RateLimitConfig{
+			Store:  "memory",
+			Auth:   "10/1m",
+			Signup: "10/1h",
+			Chirps: "30/1m",
+			API:    "600/1m",
+		},
+	}
+}
+
+// Load registers a flag for every setting, plus -config, on flags, parses
+// args with it and merges all the sources. It doesn't validate the result.
+func Load(flags *flag.FlagSet, args []string) (*Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	configFile := flags.String("config", "", "YAML or TOML config file (env CONFIG_FILE)")
+	flagValues := map[string]*flagValue{}
+	for _, s := range settings {
+		fv := &flagValue{setting: s}
+		flagValues[s.flag] = fv
+		flags.Var(fv, s.flag, s.usage+" (env "+s.env+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("couldn't load .env: %w", err)
+	}
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := os.LookupEnv(s.env)
+		if !ok {
+			continue
+		}
+		if err := s.set(value); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.env, err)
+		}
+	}
+
+	// Only flags that were given override, not their defaults
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if fv, ok := flagValues[f.Name]; ok && err == nil {
+			if setErr := fv.setting.set(fv.raw); setErr != nil {
+				err = fmt.Errorf("-%s: %w", f.Name, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown setting %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("%s: config file must be .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// Validate checks every setting and reports all the problems at once.
+func (cfg *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(cfg.Addr != "", "addr must be set")
+	check((cfg.TLSCertFile == "") == (cfg.TLSKeyFile == ""), "tls_cert_file and tls_key_file must be set together")
+	check(!cfg.H2C || cfg.TLSCertFile == "", "h2c is for plain HTTP; HTTP/2 is always on with TLS")
+	_, err := ParseTrustedProxies(cfg.TrustedProxies)
+	check(err == nil, "trusted_proxies: %v", err)
+	// Without a header timeout a client can hold a connection open forever
+	// by sending headers slowly
+	check(cfg.ReadHeaderTimeout > 0, "read_header_timeout must be positive")
+	check(cfg.ReadTimeout >= 0 && cfg.WriteTimeout >= 0 && cfg.IdleTimeout >= 0, "timeouts must not be negative")
+	check(cfg.MaxBodyBytes > 0 && cfg.ImportMaxBodyBytes > 0, "max_body_bytes and import_max_body_bytes must be positive")
+	check(cfg.ShutdownDelay >= 0, "shutdown_delay must not be negative")
+	check(cfg.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+	check(cfg.ReadinessTimeout > 0, "readiness_timeout must be positive")
+	baseURL, err := url.Parse(cfg.BaseURL)
+	check(err == nil && (baseURL.Scheme == "http" || baseURL.Scheme == "https") && baseURL.Host != "",
+		"base_url must be an http:// or https:// URL")
+	check(cfg.Platform == "dev" || cfg.Platform == "prod", "platform must be dev or prod")
+	check(cfg.Secret != "", "secret must be set")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(cfg.LogLevel)) == nil, "log_level must be debug, info, warn or error")
+	check(cfg.LogFormat == "json" || cfg.LogFormat == "text", "log_format must be json or text")
+	check(cfg.TraceExporter == "none" || cfg.TraceExporter == "stdout" || cfg.TraceExporter == "otlp",
+		"trace_exporter must be none, stdout or otlp")
+	if cfg.OTLPEndpoint != "" {
+		otlpURL, err := url.Parse(cfg.OTLPEndpoint)
+		check(err == nil && (otlpURL.Scheme == "http" || otlpURL.Scheme == "https") && otlpURL.Host != "",
+			"otlp_endpoint must be an http:// or https:// URL")
+	}
+	check(cfg.TraceSampleRatio >= 0 && cfg.TraceSampleRatio <= 1, "trace_sample_ratio must be between 0 and 1")
+
+	check(cfg.Storage == "" || cfg.Storage == "memory", "storage must be memory or empty")
+	if cfg.Storage == "" {
+		check(strings.HasPrefix(cfg.DBURL, "postgres://") || strings.HasPrefix(cfg.DBURL, "postgresql://") ||
+			strings.HasPrefix(cfg.DBURL, "sqlite:"), "db_url must start with postgres:// or sqlite:")
+	}
+
+	check(cfg.TOTPWindow >= 0, "totp_window must not be negative")
+	check(cfg.DeletionGracePeriod >= 0, "deletion_grace_period must not be negative")
+	check(cfg.IdempotencyKeyTTL > 0, "idempotency_key_ttl must be positive")
+
+	password := cfg.Password
+	check(password.Hash == auth.AlgorithmArgon2id || password.Hash == auth.AlgorithmBcrypt,
+		"password.hash must be %s or %s", auth.AlgorithmArgon2id, auth.AlgorithmBcrypt)
+	check(password.BcryptCost >= bcrypt.MinCost && password.BcryptCost <= bcrypt.MaxCost,
+		"password.bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	check(password.Argon2MemoryKiB >= 8*1024 && password.Argon2MemoryKiB <= auth.MaxArgon2Memory,
+		"password.argon2_memory_kib must be between %d and %d", 8*1024, auth.MaxArgon2Memory)
+	check(password.Argon2Iterations >= 1 && password.Argon2Iterations <= auth.MaxArgon2Iterations,
+		"password.argon2_iterations must be between 1 and %d", auth.MaxArgon2Iterations)
+	check(password.Argon2Parallelism >= 1 && password.Argon2Parallelism <= auth.MaxArgon2Parallelism,
+		"password.argon2_parallelism must be between 1 and %d", auth.MaxArgon2Parallelism)
+	check(password.MinLength >= 1, "password.min_length must be positive")
+	check(password.MinEntropy >= 0, "password.min_entropy must not be negative")
+
+	mail := cfg.Mail
+	check(mail.Mailer == "log" || mail.Mailer == "file" || mail.Mailer == "smtp", "mail.mailer must be log, file or smtp")
+	if mail.Mailer == "smtp" {
+		check(mail.SMTPHost != "" && mail.From != "", "mail.smtp_host and mail.from are required for the smtp mailer")
+	}
+
+	rateLimit := cfg.RateLimit
+	check(rateLimit.Store == "memory" || rateLimit.Store == "postgres", "rate_limit.store must be memory or postgres")
+	if rateLimit.Store == "postgres" {
+		check(cfg.Storage == "" && (strings.HasPrefix(cfg.DBURL, "postgres://") || strings.HasPrefix(cfg.DBURL, "postgresql://")),
+			"rate_limit.store postgres needs a postgres:// db_url")
+	}
+	for name, spec := range map[string]string{
+		"auth": rateLimit.Auth, "signup": rateLimit.Signup, "chirps": rateLimit.Chirps, "api": rateLimit.API,
+	} {
+		_, err := ratelimit.ParseLimit(spec)
+		check(err == nil, "rate_limit.%s: %v", name, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// ParseTrustedProxies reads a comma-separated list of IPs and CIDRs.
+func ParseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Print writes the configuration as YAML that can be used as a config
+// file, with secrets redacted.
+func (cfg *Config) Print(w io.Writer) error {
+	redacted := *cfg
+	for _, s := range redacted.settings() {
+		if s.secret == "" || s.value.String() == "" {
+			continue
+		}
+		// Only the password in a URL is secret
+		if s.secret == "url" {
+			if u, err := url.Parse(s.value.String()); err == nil {
+				s.value.SetString(u.Redacted())
+				continue
+			}
+		}
+		s.value.SetString("REDACTED")
+	}
+
+	node, err := toNode(reflect.ValueOf(redacted))
+	if err != nil {
+		return err
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// toNode keeps the fields in the order they are declared, which
+// marshalling a map wouldn't.
+func toNode(v reflect.Value) (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: field.Tag.Get("yaml")}
+
+		var value *yaml.Node
+		switch fieldValue := v.Field(i); {
+		case field.Type.Kind() == reflect.Struct:
+			var err error
+			if value, err = toNode(fieldValue); err != nil {
+				return nil, err
+			}
+		case field.Type == durationType:
+			value = &yaml.Node{Kind: yaml.ScalarNode, Value: fieldValue.Interface().(time.Duration).String()}
+		default:
+			value = &yaml.Node{}
+			if err := value.Encode(fieldValue.Interface()); err != nil {
+				return nil, err
+			}
+		}
+		node.Content = append(node.Content, key, value)
+	}
+	return node, nil
+}
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// setting is one field of Config, found through its tags.
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	secret string
+	value  reflect.Value
+}
+
+func (cfg *Config) settings() []setting {
+	var settings []setting
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+				walk(v.Field(i))
+				continue
+			}
+			env := field.Tag.Get("env")
+			settings = append(settings, setting{
+				env:    env,
+				flag:   strings.ReplaceAll(strings.ToLower(env), "_", "-"),
+				usage:  field.Tag.Get("usage"),
+				secret: field.Tag.Get("secret"),
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem())
+	return settings
+}
+
+func (s setting) set(raw string) error {
+	switch {
+	case s.value.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("must be a duration such as 720h")
+		}
+		s.value.SetInt(int64(d))
+	case s.value.Kind() == reflect.String:
+		s.value.SetString(raw)
+	case s.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+		s.value.SetBool(b)
+	case s.value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		s.value.SetInt(int64(n))
+	case s.value.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		s.value.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.value.Type())
+	}
+	return nil
+}
+
+// flagValue holds a flag's text until the other sources have been loaded,
+// so that it can be applied last.
+type flagValue struct {
+	setting setting
+	raw     string
+}
+
+// String shows the default in -help.
+func (f *flagValue) String() string {
+	if f.raw != "" || !f.setting.value.IsValid() {
+		return f.raw
+	}
+	if f.setting.value.Type() == durationType {
+		return f.setting.value.Interface().(time.Duration).String()
+	}
+	return fmt.Sprint(f.setting.value.Interface())
+}
+
+func (f *flagValue) Set(raw string) error {
+	f.raw = raw
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be given as just -auto-migrate.
+func (f *flagValue) IsBoolFlag() bool {
+	return f.setting.value.Kind() == reflect.Bool
+}
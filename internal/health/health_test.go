@@ -0,0 +1,89 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChecker(t *testing.T) {
+	pass := func(context.Context) error { return nil }
+	fail := func(context.Context) error { return errors.New("connection refused") }
+	// hang ignores ctx, so only Run's own timeout can stop waiting for it
+	hang := func(context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}
+
+	cases := []struct {
+		name   string
+		checks map[string]Check
+		want   string
+		failed map[string]string
+	}{
+		{"no checks", nil, StatusOK, nil},
+		{"all pass", map[string]Check{"database": pass, "schema": pass}, StatusOK, nil},
+		{
+			"one fails",
+			map[string]Check{"database": fail, "schema": pass},
+			StatusFail,
+			map[string]string{"database": "connection refused"},
+		},
+		{
+			"one times out",
+			map[string]Check{"database": hang, "schema": pass},
+			StatusFail,
+			map[string]string{"database": context.DeadlineExceeded.Error()},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(50 * time.Millisecond)
+			for name, check := range tc.checks {
+				c.Register(name, check)
+			}
+
+			start := time.Now()
+			report := c.Run(context.Background())
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("Run took %v, want it to stop at the timeout", elapsed)
+			}
+
+			if report.Status != tc.want || report.OK() != (tc.want == StatusOK) {
+				t.Errorf("Got status %q, want %q", report.Status, tc.want)
+			}
+			if len(report.Checks) != len(tc.checks) {
+				t.Errorf("Got %d results, want %d", len(report.Checks), len(tc.checks))
+			}
+			for name, result := range report.Checks {
+				wantErr, failed := tc.failed[name]
+				switch {
+				case failed && (result.Status != StatusFail || result.Error != wantErr):
+					t.Errorf("%s: got %+v, want it failed with %q", name, result, wantErr)
+				case !failed && (result.Status != StatusOK || result.Error != ""):
+					t.Errorf("%s: got %+v, want it passed", name, result)
+				}
+			}
+		})
+	}
+
+	t.Run("register replaces", func(t *testing.T) {
+		c := New(time.Second)
+		c.Register("database", fail)
+		c.Register("database", pass)
+		if report := c.Run(context.Background()); !report.OK() {
+			t.Errorf("Got %+v, want the replacement check to run", report)
+		}
+	})
+
+	t.Run("cancelled caller", func(t *testing.T) {
+		c := New(time.Second)
+		c.Register("database", hang)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if report := c.Run(ctx); report.OK() {
+			t.Error("Expected checks to fail once the caller gave up")
+		}
+	})
+}
@@ -0,0 +1,47 @@
+// Package idempotency remembers the response to a request sent with an
+// Idempotency-Key header, so a client retrying it gets the same response
+// instead of repeating whatever the request did. Records live in memory, or
+// in Postgres so that every replica shares them.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Response is what gets replayed.
+type Response struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Record is what's known about a key someone already claimed.
+type Record struct {
+	Fingerprint string
+	// Response is nil while the first request is still being handled
+	Response *Response
+}
+
+// Store keeps the records.
+type Store interface {
+	// Claim takes key for a request with fingerprint, unless it was taken
+	// at or after expiredBefore. When it wasn't claimed, the record already
+	// there is returned instead.
+	Claim(ctx context.Context, key, fingerprint string, now, expiredBefore time.Time) (claimed bool, existing Record, err error)
+	// Complete saves the response to the request that claimed key.
+	Complete(ctx context.Context, key string, response Response) error
+	// Release gives key up, so that a retry is handled afresh.
+	Release(ctx context.Context, key string) error
+	// Sweep forgets keys claimed before before.
+	Sweep(ctx context.Context, before time.Time) error
+}
+
+// Fingerprint identifies a request body, so that reusing a key for a
+// different request can be caught.
+func Fingerprint(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
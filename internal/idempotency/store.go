@@ -0,0 +1,124 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+)
+
+// Memory keeps records in this process only, so a retry that reaches
+// another replica isn't recognised.
+type Memory struct {
+	mu      sync.Mutex
+	records map[string]*memoryRecord
+}
+
+type memoryRecord struct {
+	Record
+	createdAt time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{records: map[string]*memoryRecord{}}
+}
+
+func (m *Memory) Claim(ctx context.Context, key, fingerprint string, now, expiredBefore time.Time) (bool, Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.records[key]; ok && !existing.createdAt.Before(expiredBefore) {
+		return false, existing.Record, nil
+	}
+	m.records[key] = &memoryRecord{Record: Record{Fingerprint: fingerprint}, createdAt: now}
+	return true, Record{}, nil
+}
+
+func (m *Memory) Complete(ctx context.Context, key string, response Response) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if record, ok := m.records[key]; ok {
+		record.Response = &response
+	}
+	return nil
+}
+
+func (m *Memory) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, key)
+	return nil
+}
+
+func (m *Memory) Sweep(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, record := range m.records {
+		if record.createdAt.Before(before) {
+			delete(m.records, key)
+		}
+	}
+	return nil
+}
+
+// Postgres shares records between every replica using the same database.
+type Postgres struct {
+	queries *database.Queries
+}
+
+func NewPostgres(queries *database.Queries) *Postgres {
+	return &Postgres{queries: queries}
+}
+
+func (p *Postgres) Claim(ctx context.Context, key, fingerprint string, now, expiredBefore time.Time) (bool, Record, error) {
+	_, err := p.queries.ClaimIdempotencyKey(ctx, database.ClaimIdempotencyKeyParams{
+		Key:           key,
+		Fingerprint:   fingerprint,
+		CreatedAt:     now,
+		ExpiredBefore: expiredBefore,
+	})
+	if err == nil {
+		return true, Record{}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, Record{}, err
+	}
+
+	row, err := p.queries.GetIdempotencyKey(ctx, key)
+	if err != nil {
+		return false, Record{}, err
+	}
+	record := Record{Fingerprint: row.Fingerprint}
+	if row.StatusCode.Valid {
+		record.Response = &Response{
+			Status:      int(row.StatusCode.Int32),
+			ContentType: row.ContentType,
+			Body:        row.Body,
+		}
+	}
+	return false, record, nil
+}
+
+func (p *Postgres) Complete(ctx context.Context, key string, response Response) error {
+	return p.queries.CompleteIdempotencyKey(ctx, database.CompleteIdempotencyKeyParams{
+		Key:         key,
+		StatusCode:  sql.NullInt32{Int32: int32(response.Status), Valid: true},
+		ContentType: response.ContentType,
+		Body:        response.Body,
+	})
+}
+
+func (p *Postgres) Release(ctx context.Context, key string) error {
+	return p.queries.DeleteIdempotencyKey(ctx, key)
+}
+
+func (p *Postgres) Sweep(ctx context.Context, before time.Time) error {
+	_, err := p.queries.DeleteExpiredIdempotencyKeys(ctx, before)
+	return err
+}
@@ -0,0 +1,352 @@
+// Package importer loads users and chirps exported from another system.
+// Rows are streamed from JSON Lines or CSV and written in batches, one
+// transaction per batch, to any storage. Every row gets a stable ID, so
+// running the same file twice imports nothing the second time.
+package importer
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
+)
+
+const (
+	KindUsers  = "users"
+	KindChirps = "chirps"
+
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+
+	DefaultBatchSize = 500
+	maxChirpLength   = 140
+)
+
+// Rows without a UUID of their own get one derived from this namespace and
+// their contents.
+var idNamespace = uuid.MustParse("1df7a6a5-d705-4f69-8dd3-3b7bc6c2c45b")
+
+type Options struct {
+	Kind   string
+	Format string
+	// DryRun runs every insert but rolls each batch back
+	DryRun    bool
+	BatchSize int
+}
+
+func (o Options) Validate() error {
+	if o.Kind != KindUsers && o.Kind != KindChirps {
+		return fmt.Errorf("type must be %s or %s", KindUsers, KindChirps)
+	}
+	if o.Format != FormatJSONL && o.Format != FormatCSV {
+		return fmt.Errorf("format must be %s or %s", FormatJSONL, FormatCSV)
+	}
+	if o.BatchSize < 0 {
+		return errors.New("batch size must not be negative")
+	}
+	return nil
+}
+
+// RowError explains why one row was not imported. Line is the line of the
+// input the row starts on.
+type RowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type Summary struct {
+	Rows     int  `json:"rows"`
+	Imported int  `json:"imported"`
+	Skipped  int  `json:"skipped"`
+	Failed   int  `json:"failed"`
+	DryRun   bool `json:"dry_run"`
+}
+
+// UserRecord is one imported user. HashedPassword must be a bcrypt or
+// argon2id hash; users without one have to reset their password.
+type UserRecord struct {
+	ID             string `json:"id"`
+	Email          string `json:"email"`
+	HashedPassword string `json:"hashed_password"`
+	CreatedAt      string `json:"created_at"`
+}
+
+// ChirpRecord is one imported chirp. The author is found by UserID, using
+// the same ID the users import was given, or by UserEmail.
+type ChirpRecord struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	UserEmail string `json:"user_email"`
+	Body      string `json:"body"`
+	CreatedAt string `json:"created_at"`
+}
+
+type row struct {
+	line int
+	data []byte
+}
+
+// Run imports everything in r. Rows that can't be imported are passed to
+// report and counted as failed; the error is only for problems that stop
+// the whole import, such as the storage failing, and the summary still
+// covers the batches done so far.
+func Run(ctx context.Context, storage store.Storage, r io.Reader, opts Options, report func(RowError)) (Summary, error) {
+	summary := Summary{DryRun: opts.DryRun}
+	if err := opts.Validate(); err != nil {
+		return summary, err
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize == 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	apply := importUser
+	if opts.Kind == KindChirps {
+		apply = importChirp
+	}
+
+	var records recordReader
+	if opts.Format == FormatCSV {
+		records = newCSVReader(r)
+	} else {
+		records = newJSONLReader(r)
+	}
+
+	fail := func(line int, err error) {
+		summary.Failed++
+		report(RowError{Line: line, Error: err.Error()})
+	}
+
+	batch := make([]row, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := runBatch(ctx, storage, batch, opts.DryRun, apply, &summary, fail)
+		batch = batch[:0]
+		return err
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+
+		line, data, err := records.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *rowError
+		if errors.As(err, &rowErr) {
+			summary.Rows++
+			fail(rowErr.line, rowErr.err)
+			continue
+		}
+		if err != nil {
+			return summary, err
+		}
+
+		summary.Rows++
+		batch = append(batch, row{line: line, data: data})
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return summary, err
+			}
+		}
+	}
+
+	return summary, flush()
+}
+
+// errDryRun rolls back a dry run's batch once every row has been tried.
+var errDryRun = errors.New("dry run")
+
+// runBatch applies a batch in one transaction. Rows that are invalid are
+// left out and reported; any other error fails the whole batch.
+func runBatch(ctx context.Context, storage store.Storage, batch []row, dryRun bool,
+	apply func(context.Context, store.Queries, []byte) (bool, error),
+	summary *Summary, fail func(int, error)) error {
+	var imported, skipped int
+	var rejected []*rowError
+	err := storage.Atomic(ctx, func(q store.Queries) error {
+		// The transaction may be retried, so count from scratch each time
+		imported, skipped, rejected = 0, 0, nil
+		for _, row := range batch {
+			inserted, err := apply(ctx, q, row.data)
+			var rowErr *rowError
+			if errors.As(err, &rowErr) {
+				rejected = append(rejected, &rowError{line: row.line, err: rowErr.err})
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %w", row.line, err)
+			}
+
+			if inserted {
+				imported++
+			} else {
+				skipped++
+			}
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+
+	for _, rowErr := range rejected {
+		fail(rowErr.line, rowErr.err)
+	}
+	if err != nil && !errors.Is(err, errDryRun) {
+		return err
+	}
+
+	// Only count rows once their batch has actually been committed
+	summary.Imported += imported
+	summary.Skipped += skipped
+	return nil
+}
+
+// invalid marks err as a problem with the row itself, which only fails that
+// row.
+func invalid(err error) error {
+	return &rowError{err: err}
+}
+
+func decodeRecord(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return invalid(fmt.Errorf("invalid record: %w", err))
+	}
+	return nil
+}
+
+// deriveID keeps UUIDs from the old system and maps anything else to a
+// stable UUID, so re-runs and references between files line up.
+func deriveID(kind, raw string) uuid.UUID {
+	if id, err := uuid.Parse(raw); err == nil {
+		return id
+	}
+	return uuid.NewSHA1(idNamespace, []byte(kind+":"+raw))
+}
+
+func parseTimestamp(field, value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(value))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp", field)
+	}
+	return t.UTC(), nil
+}
+
+func importUser(ctx context.Context, q store.Queries, data []byte) (bool, error) {
+	rec := UserRecord{}
+	if err := decodeRecord(data, &rec); err != nil {
+		return false, err
+	}
+
+	email := strings.TrimSpace(rec.Email)
+	if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+		return false, invalid(errors.New("email is not a valid address"))
+	}
+
+	hashedPassword := rec.HashedPassword
+	if hashedPassword == "" {
+		hashedPassword = auth.UnsetPasswordHash
+	} else if !auth.IsPasswordHash(hashedPassword) {
+		return false, invalid(errors.New("hashed_password must be a bcrypt or argon2id hash"))
+	}
+
+	createdAt := time.Now().UTC()
+	if rec.CreatedAt != "" {
+		var err error
+		createdAt, err = parseTimestamp("created_at", rec.CreatedAt)
+		if err != nil {
+			return false, invalid(err)
+		}
+	}
+
+	id := deriveID("user", rec.ID)
+	if rec.ID == "" {
+		id = deriveID("user-email", strings.ToLower(email))
+	}
+
+	// An existing ID or email means the row was imported before
+	inserted, err := q.ImportUser(ctx, database.ImportUserParams{
+		ID:             id,
+		CreatedAt:      createdAt,
+		Email:          email,
+		HashedPassword: hashedPassword,
+	})
+	if err != nil {
+		return false, err
+	}
+	return inserted == 1, nil
+}
+
+func importChirp(ctx context.Context, q store.Queries, data []byte) (bool, error) {
+	rec := ChirpRecord{}
+	if err := decodeRecord(data, &rec); err != nil {
+		return false, err
+	}
+
+	if rec.Body == "" {
+		return false, invalid(errors.New("body is required"))
+	}
+	if len(rec.Body) > maxChirpLength {
+		return false, invalid(fmt.Errorf("body is longer than %d characters", maxChirpLength))
+	}
+
+	if rec.CreatedAt == "" {
+		return false, invalid(errors.New("created_at is required"))
+	}
+	createdAt, err := parseTimestamp("created_at", rec.CreatedAt)
+	if err != nil {
+		return false, invalid(err)
+	}
+
+	var user database.User
+	switch {
+	case rec.UserID != "":
+		user, err = q.GetUserByID(ctx, deriveID("user", rec.UserID))
+	case rec.UserEmail != "":
+		user, err = q.GetUser(ctx, strings.TrimSpace(rec.UserEmail))
+	default:
+		return false, invalid(errors.New("user_id or user_email is required"))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, invalid(errors.New("author not found; import users first"))
+	}
+	if err != nil {
+		return false, err
+	}
+
+	id := deriveID("chirp", rec.ID)
+	if rec.ID == "" {
+		id = deriveID("chirp-content", user.ID.String()+"|"+createdAt.Format(time.RFC3339Nano)+"|"+rec.Body)
+	}
+
+	inserted, err := q.ImportChirp(ctx, database.ImportChirpParams{
+		ID:        id,
+		CreatedAt: createdAt,
+		Body:      rec.Body,
+		UserID:    user.ID,
+	})
+	if err != nil {
+		return false, err
+	}
+	return inserted == 1, nil
+}
@@ -0,0 +1,248 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
+)
+
+// readAll drains records, returning each row as "line: data" and each row
+// error as "line: error".
+func readAll(t *testing.T, records recordReader) (rows, rowErrs []string, err error) {
+	t.Helper()
+
+	for {
+		line, data, err := records.next()
+		if errors.Is(err, io.EOF) {
+			return rows, rowErrs, nil
+		}
+		var rowErr *rowError
+		if errors.As(err, &rowErr) {
+			rowErrs = append(rowErrs, rowErr.Error())
+			continue
+		}
+		if err != nil {
+			return rows, rowErrs, err
+		}
+		rows = append(rows, fmt.Sprintf("%d: %s", line, data))
+	}
+}
+
+func TestReaders(t *testing.T) {
+	cases := []struct {
+		name    string
+		format  string
+		input   string
+		rows    []string
+		rowErrs []string
+		wantErr bool
+	}{
+		{
+			name:   "jsonl",
+			format: FormatJSONL,
+			input:  "{\"email\":\"a@example.com\"}\n{\"email\":\"b@example.com\"}\n",
+			rows:   []string{`1: {"email":"a@example.com"}`, `2: {"email":"b@example.com"}`},
+		},
+		{
+			name:   "jsonl skips blank lines",
+			format: FormatJSONL,
+			input:  "\n{\"email\":\"a@example.com\"}\n   \n\r\n{\"email\":\"b@example.com\"}",
+			rows:   []string{`2: {"email":"a@example.com"}`, `5: {"email":"b@example.com"}`},
+		},
+		{
+			name:   "jsonl leaves bad rows to the decoder",
+			format: FormatJSONL,
+			input:  "not json\n",
+			rows:   []string{`1: not json`},
+		},
+		{
+			name:    "jsonl line too long",
+			format:  FormatJSONL,
+			input:   strings.Repeat("x", maxLineLength+1),
+			wantErr: true,
+		},
+		{
+			name:   "csv",
+			format: FormatCSV,
+			input:  " Email ,hashed_password\na@example.com,\n\"b@example.com\",$2a$x\n",
+			rows:   []string{`2: {"email":"a@example.com","hashed_password":""}`, `3: {"email":"b@example.com","hashed_password":"$2a$x"}`},
+		},
+		{
+			name:   "csv skips blank lines",
+			format: FormatCSV,
+			input:  "email\n\na@example.com\n\n",
+			rows:   []string{`3: {"email":"a@example.com"}`},
+		},
+		{
+			name:    "csv bad rows",
+			format:  FormatCSV,
+			input:   "email,body\na@example.com\na@example.com,\"unclosed\nb@example.com,hi\n",
+			rowErrs: []string{"line 2: wrong number of fields", "line 3: extraneous or missing \" in quoted-field"},
+		},
+		{
+			name:   "csv with only a header",
+			format: FormatCSV,
+			input:  "email,body\n",
+		},
+		{
+			name:   "empty csv",
+			format: FormatCSV,
+			input:  "",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var records recordReader = newJSONLReader(strings.NewReader(tc.input))
+			if tc.format == FormatCSV {
+				records = newCSVReader(strings.NewReader(tc.input))
+			}
+
+			rows, rowErrs, err := readAll(t, records)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Got error %v, want error %t", err, tc.wantErr)
+			}
+			if strings.Join(rows, "\n") != strings.Join(tc.rows, "\n") {
+				t.Errorf("Got rows %q, want %q", rows, tc.rows)
+			}
+			if strings.Join(rowErrs, "\n") != strings.Join(tc.rowErrs, "\n") {
+				t.Errorf("Got row errors %q, want %q", rowErrs, tc.rowErrs)
+			}
+		})
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"users", Options{Kind: KindUsers, Format: FormatJSONL}, ""},
+		{"chirps dry run", Options{Kind: KindChirps, Format: FormatCSV, DryRun: true, BatchSize: 10}, ""},
+		{"no kind", Options{Format: FormatCSV}, "type must be users or chirps"},
+		{"unknown kind", Options{Kind: "likes", Format: FormatCSV}, "type must be users or chirps"},
+		{"no format", Options{Kind: KindUsers}, "format must be jsonl or csv"},
+		{"negative batch size", Options{Kind: KindUsers, Format: FormatCSV, BatchSize: -1}, "batch size must not be negative"},
+	}
+	for _, tc := range cases {
+		err := tc.opts.Validate()
+		if tc.want == "" && err != nil {
+			t.Errorf("%s: got error %v, want none", tc.name, err)
+		}
+		if tc.want != "" && (err == nil || err.Error() != tc.want) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+// run imports input and returns the summary and the rejected rows.
+func run(t *testing.T, storage store.Storage, input string, opts Options) (Summary, []RowError) {
+	t.Helper()
+
+	var rejected []RowError
+	summary, err := Run(context.Background(), storage, strings.NewReader(input), opts, func(rowErr RowError) {
+		rejected = append(rejected, rowErr)
+	})
+	if err != nil {
+		t.Fatalf("Error importing: %v", err)
+	}
+	return summary, rejected
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	users := strings.Join([]string{
+		`{"id": "legacy-1", "email": "walt@example.com", "created_at": "2020-01-02T03:04:05Z"}`,
+		`{"email": "jesse@example.com"}`,
+		``,
+		`{"email": "not an email"}`,
+		`{"email": "skyler@example.com", "hashed_password": "hunter2"}`,
+		`{"email": "hank@example.com", "admin": true}`,
+		`{"email": "marie@example.com", "created_at": "yesterday"}`,
+		`{"email": "saul@example.com"}`,
+	}, "\n")
+	usersOpts := Options{Kind: KindUsers, Format: FormatJSONL, BatchSize: 2}
+	wantRejected := []RowError{
+		{Line: 4, Error: "email is not a valid address"},
+		{Line: 5, Error: "hashed_password must be a bcrypt or argon2id hash"},
+		{Line: 6, Error: `invalid record: json: unknown field "admin"`},
+		{Line: 7, Error: "created_at must be an RFC 3339 timestamp"},
+	}
+
+	storage := store.NewMemory()
+
+	t.Run("dry run writes nothing", func(t *testing.T) {
+		opts := usersOpts
+		opts.DryRun = true
+		summary, rejected := run(t, storage, users, opts)
+		want := Summary{Rows: 7, Imported: 3, Failed: 4, DryRun: true}
+		if summary != want {
+			t.Errorf("Got %+v, want %+v", summary, want)
+		}
+		if fmt.Sprint(rejected) != fmt.Sprint(wantRejected) {
+			t.Errorf("Got rejected rows %+v, want %+v", rejected, wantRejected)
+		}
+		if _, err := storage.GetUser(ctx, "walt@example.com"); err == nil {
+			t.Errorf("Dry run imported a user")
+		}
+	})
+
+	t.Run("import", func(t *testing.T) {
+		summary, _ := run(t, storage, users, usersOpts)
+		if want := (Summary{Rows: 7, Imported: 3, Failed: 4}); summary != want {
+			t.Errorf("Got %+v, want %+v", summary, want)
+		}
+		walt, err := storage.GetUser(ctx, "walt@example.com")
+		if err != nil {
+			t.Fatalf("Error getting imported user: %v", err)
+		}
+		if walt.ID != deriveID("user", "legacy-1") || walt.CreatedAt.Year() != 2020 || walt.HashedPassword != "unset" {
+			t.Errorf("Got %+v, want the row's ID, timestamp and no password", walt)
+		}
+	})
+
+	t.Run("a second run skips what's there", func(t *testing.T) {
+		summary, _ := run(t, storage, users, usersOpts)
+		if want := (Summary{Rows: 7, Skipped: 3, Failed: 4}); summary != want {
+			t.Errorf("Got %+v, want %+v", summary, want)
+		}
+	})
+
+	t.Run("chirps find their authors", func(t *testing.T) {
+		chirps := "user_id,user_email,body,created_at\n" +
+			"legacy-1,,Say my name,2020-01-03T00:00:00Z\n" +
+			",jesse@example.com,Yeah science,2020-01-04T00:00:00Z\n" +
+			",nobody@example.com,Who?,2020-01-04T00:00:00Z\n" +
+			",jesse@example.com,,2020-01-04T00:00:00Z\n"
+		opts := Options{Kind: KindChirps, Format: FormatCSV}
+
+		summary, rejected := run(t, storage, chirps, opts)
+		if want := (Summary{Rows: 4, Imported: 2, Failed: 2}); summary != want {
+			t.Errorf("Got %+v, want %+v", summary, want)
+		}
+		want := []RowError{{Line: 4, Error: "author not found; import users first"}, {Line: 5, Error: "body is required"}}
+		if fmt.Sprint(rejected) != fmt.Sprint(want) {
+			t.Errorf("Got rejected rows %+v, want %+v", rejected, want)
+		}
+
+		if summary, _ := run(t, storage, chirps, opts); summary.Imported != 0 || summary.Skipped != 2 {
+			t.Errorf("Got %+v running again, want both chirps skipped", summary)
+		}
+		walts, err := storage.GetChirpsForUser(ctx, deriveID("user", "legacy-1"))
+		if err != nil || len(walts) != 1 || walts[0].Body != "Say my name" {
+			t.Errorf("Got %+v, %v, want walt's chirp", walts, err)
+		}
+	})
+
+	t.Run("csv without a header", func(t *testing.T) {
+		summary, rejected := run(t, storage, "gus@example.com\nmike@example.com\n", Options{Kind: KindUsers, Format: FormatCSV})
+		if summary.Imported != 0 || summary.Failed != 1 || len(rejected) != 1 || !strings.Contains(rejected[0].Error, "unknown field") {
+			t.Errorf("Got %+v and %+v, want the first row taken as the header and the second rejected", summary, rejected)
+		}
+	})
+}
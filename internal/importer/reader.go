@@ -0,0 +1,135 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// One JSON line may not be longer than this.
+const maxLineLength = 1024 * 1024
+
+// recordReader yields one row at a time as a JSON object, whatever the input
+// format, so both formats decode into the same records.
+type recordReader interface {
+	next() (line int, data []byte, err error)
+}
+
+// rowError is a problem with a single row; the rows after it can still be
+// read.
+type rowError struct {
+	line int
+	err  error
+}
+
+func (e *rowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.err)
+}
+
+type jsonlReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newJSONLReader(r io.Reader) *jsonlReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineLength)
+	return &jsonlReader{scanner: scanner}
+}
+
+func (j *jsonlReader) next() (int, []byte, error) {
+	for j.scanner.Scan() {
+		j.line++
+		data := bytes.TrimSpace(j.scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		// The scanner reuses its buffer
+		return j.line, bytes.Clone(data), nil
+	}
+	if err := j.scanner.Err(); err != nil {
+		return 0, nil, err
+	}
+	return 0, nil, io.EOF
+}
+
+// csvReader takes column names from the header row, which must use the same
+// names as the JSON fields.
+type csvReader struct {
+	reader *csv.Reader
+	header []string
+}
+
+func newCSVReader(r io.Reader) *csvReader {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	return &csvReader{reader: reader}
+}
+
+func (c *csvReader) next() (int, []byte, error) {
+	if c.header == nil {
+		header, err := c.reader.Read()
+		if errors.Is(err, io.EOF) {
+			return 0, nil, err
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("couldn't read CSV header: %w", err)
+		}
+		c.header = make([]string, len(header))
+		for i, name := range header {
+			c.header[i] = strings.ToLower(strings.TrimSpace(name))
+		}
+	}
+
+	fields, err := c.reader.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return 0, nil, &rowError{line: parseErr.StartLine, err: parseErr.Err}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	line, _ := c.reader.FieldPos(0)
+
+	record := make(map[string]string, len(fields))
+	for i, value := range fields {
+		record[c.header[i]] = value
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, nil, err
+	}
+	return line, data, nil
+}
+
+// FormatFromName guesses the format from a file name's extension.
+func FormatFromName(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return FormatCSV
+	case ".jsonl", ".ndjson", ".json":
+		return FormatJSONL
+	default:
+		return ""
+	}
+}
+
+// FormatFromContentType maps a request's Content-Type to a format.
+func FormatFromContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return FormatCSV
+	case "application/jsonl", "application/x-ndjson", "application/x-jsonlines":
+		return FormatJSONL
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,99 @@
+// Package logging sets up the server's structured logs: one JSON object per
+// line, tagged with the request and trace it was written for, with personal
+// data redacted unless asked for.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attribute keys that hold personal data. They are redacted unless the
+// logger is created with logPII.
+const (
+	KeyEmail = "email"
+	KeyIP    = "ip"
+)
+
+var piiKeys = map[string]bool{
+	KeyEmail: true,
+	KeyIP:    true,
+}
+
+const redacted = "REDACTED"
+
+// New returns a logger writing format ("json" or "text") to w.
+func New(w io.Writer, format, level string, logPII bool) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	if !logPII {
+		opts.ReplaceAttr = redactPII
+	}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+func redactPII(groups []string, attr slog.Attr) slog.Attr {
+	if piiKeys[attr.Key] {
+		return slog.String(attr.Key, redacted)
+	}
+	return attr
+}
+
+type requestIDKey struct{}
+
+// WithRequestID stores the request ID that every log line written with ctx
+// will carry.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID stored by WithRequestID, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds what it finds in the context to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", span.TraceID().String()),
+			slog.String("span_id", span.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,53 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testMessage = Message{
+	To:      "walt@example.com",
+	Subject: "Reset your Chirpy password",
+	Body:    "https://chirpy.example.com/reset?token=secret-token",
+}
+
+func TestLogMailer(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	if err := (LogMailer{}).Send(context.Background(), testMessage); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "secret-token") {
+		t.Errorf("The body was logged:\n%s", out)
+	}
+	if !strings.Contains(out, testMessage.Subject) {
+		t.Errorf("Expected the subject in:\n%s", out)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.txt")
+	m := &FileMailer{Path: path, From: "chirpy@example.com"}
+	for range 2 {
+		if err := m.Send(context.Background(), testMessage); err != nil {
+			t.Fatalf("Error sending: %v", err)
+		}
+	}
+
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading mail: %v", err)
+	}
+	if got := strings.Count(string(dat), "secret-token"); got != 2 {
+		t.Errorf("Got %d messages with the body, want 2:\n%s", got, dat)
+	}
+}
@@ -0,0 +1,115 @@
+// Package metrics holds the server's Prometheus metrics, all in one
+// registry served at /metrics.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chirpy"
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+
+	fileserverHits atomic.Uint64
+	// hitsAtReset is the fileserver hit count when it was last reset from
+	// the admin page. Prometheus counters only go up, so the page shows the
+	// difference instead.
+	hitsAtReset atomic.Uint64
+
+	ChirpsCreated prometheus.Counter
+	Logins        prometheus.Counter
+	FailedLogins  prometheus.Counter
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests served, by route pattern and status code.",
+		}, []string{"route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests, by route pattern and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "status"}),
+		ChirpsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "chirps_created_total",
+			Help:      "Chirps posted through the API.",
+		}),
+		Logins: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "logins_total",
+			Help:      "Successful logins.",
+		}),
+		FailedLogins: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "failed_logins_total",
+			Help:      "Logins refused for a wrong email or password. Second factors and password confirmations aren't counted.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fileserver_hits_total",
+			Help:      "Requests for files under /app/.",
+		}, func() float64 {
+			return float64(m.fileserverHits.Load())
+		}),
+		m.ChirpsCreated,
+		m.Logins,
+		m.FailedLogins,
+	)
+	return m
+}
+
+// RegisterDB reports the connection pool stats of db.
+func (m *Metrics) RegisterDB(db *sql.DB, name string) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// ObserveRequest records a served request under its mux pattern, not its
+// path, so the number of series stays bounded.
+func (m *Metrics) ObserveRequest(route string, status int, elapsed time.Duration) {
+	code := strconv.Itoa(status)
+	m.requests.WithLabelValues(route, code).Inc()
+	m.requestDuration.WithLabelValues(route, code).Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) FileserverHit() {
+	m.fileserverHits.Add(1)
+}
+
+// FileserverHits is the number of hits since the last ResetFileserverHits.
+func (m *Metrics) FileserverHits() uint64 {
+	return m.fileserverHits.Load() - m.hitsAtReset.Load()
+}
+
+func (m *Metrics) ResetFileserverHits() {
+	m.hitsAtReset.Store(m.fileserverHits.Load())
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
@@ -0,0 +1,376 @@
+// Package migrate applies the goose migrations in sql/schema and
+// sql/sqlite/schema from inside the binary. It keeps its bookkeeping in
+// goose's goose_db_version table, so databases migrated with the goose CLI
+// carry on from where they are.
+package migrate
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialect holds the SQL that differs between databases.
+type Dialect struct {
+	Name        string
+	createTable string
+	// insert records a version as applied or rolled back
+	insert string
+	// lock and unlock stop two servers migrating at the same time. They
+	// are empty where transactions already serialize migrations.
+	lock   string
+	unlock string
+}
+
+// lockID is the Postgres advisory lock held while migrating.
+const lockID = 5887940537704921958
+
+var (
+	Postgres = Dialect{
+		Name: "postgres",
+		createTable: `CREATE TABLE goose_db_version (
+    id serial NOT NULL,
+    version_id bigint NOT NULL,
+    is_applied boolean NOT NULL,
+    tstamp timestamp NULL DEFAULT now(),
+    PRIMARY KEY(id)
+)`,
+		insert: `INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, $2)`,
+		lock:   fmt.Sprintf(`SELECT pg_advisory_lock(%d)`, lockID),
+		unlock: fmt.Sprintf(`SELECT pg_advisory_unlock(%d)`, lockID),
+	}
+
+	// SQLite transactions are started with an immediate write lock, which
+	// is enough to keep two migrations apart.
+	SQLite = Dialect{
+		Name: "sqlite",
+		createTable: `CREATE TABLE goose_db_version (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    version_id INTEGER NOT NULL,
+    is_applied INTEGER NOT NULL,
+    tstamp TIMESTAMP DEFAULT (datetime('now'))
+)`,
+		insert: `INSERT INTO goose_db_version (version_id, is_applied) VALUES (?, ?)`,
+	}
+)
+
+// ErrSchemaBehind is returned by Check when migrations are pending.
+var ErrSchemaBehind = errors.New("database schema is behind")
+
+// Migration is one goose migration file.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and when it was applied, if it was.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies one directory of migrations to one database.
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+// New reads the .sql migrations at the top of fsys.
+func New(db *sql.DB, dialect Dialect, fsys fs.FS) (*Migrator, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, name := range names {
+		migration, err := load(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("%s and %s have the same version", migrations[i-1].Name, migrations[i].Name)
+		}
+	}
+
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+// load parses a file named like 001_users.sql, whose Up and Down sections
+// start with "-- +goose Up" and "-- +goose Down".
+func load(fsys fs.FS, name string) (Migration, error) {
+	prefix, _, ok := strings.Cut(path.Base(name), "_")
+	version, err := strconv.ParseInt(prefix, 10, 64)
+	if !ok || err != nil || version < 1 {
+		return Migration{}, fmt.Errorf("%s: name must start with a version number and an underscore", name)
+	}
+
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	migration := Migration{Version: version, Name: path.Base(name)}
+	var up, down strings.Builder
+	var section *strings.Builder
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		annotation, ok := strings.CutPrefix(strings.TrimSpace(line), "-- +goose ")
+		if !ok {
+			if section != nil {
+				section.WriteString(line)
+			}
+			continue
+		}
+		// StatementBegin and StatementEnd don't matter: each section runs
+		// as one Exec
+		switch strings.TrimSpace(annotation) {
+		case "Up":
+			section = &up
+		case "Down":
+			section = &down
+		}
+	}
+	migration.Up = strings.TrimSpace(up.String())
+	migration.Down = strings.TrimSpace(down.String())
+	if migration.Up == "" {
+		return Migration{}, fmt.Errorf("%s: no -- +goose Up section", name)
+	}
+	return migration, nil
+}
+
+// newest is the highest applied version, or 0 if none are.
+func newest(applied map[int64]time.Time) int64 {
+	var version int64
+	for v := range applied {
+		version = max(version, v)
+	}
+	return version
+}
+
+// Check returns ErrSchemaBehind unless every migration has been applied.
+func (m *Migrator) Check(ctx context.Context) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for _, status := range statuses {
+		if !status.Applied {
+			pending = append(pending, status.Name)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: %s not applied", ErrSchemaBehind, strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// Status lists every migration the binary has, oldest first.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses[i] = MigrationStatus{
+			Migration: migration,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		}
+	}
+	return statuses, nil
+}
+
+// Up applies every pending migration in order, each in its own
+// transaction, and returns the ones it applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		for _, migration := range m.migrations {
+			ran, err := m.run(ctx, conn, migration, true)
+			if err != nil {
+				return err
+			}
+			if ran {
+				done = append(done, migration)
+			}
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down rolls back the newest applied migration and returns it.
+func (m *Migrator) Down(ctx context.Context) (Migration, error) {
+	var done Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		version := newest(applied)
+		if version == 0 {
+			return errors.New("no migrations to roll back")
+		}
+
+		i := slices.IndexFunc(m.migrations, func(migration Migration) bool {
+			return migration.Version == version
+		})
+		if i < 0 {
+			return fmt.Errorf("version %d was applied by a newer binary and can't be rolled back by this one", version)
+		}
+		done = m.migrations[i]
+		_, err = m.run(ctx, conn, done, false)
+		return err
+	})
+	return done, err
+}
+
+// run applies migration, or rolls it back, unless that has already been
+// done. The check happens inside the transaction so that a migration
+// racing with another server is never applied twice.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, migration Migration, up bool) (bool, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	applied, err := m.applied(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := applied[migration.Version]; ok == up {
+		return false, nil
+	}
+
+	statement := migration.Up
+	if !up {
+		statement = migration.Down
+	}
+	if statement != "" {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return false, fmt.Errorf("%s: %w", migration.Name, err)
+		}
+	}
+	// Like goose, a rollback is a new row rather than a deleted one
+	if _, err := tx.ExecContext(ctx, m.dialect.insert, migration.Version, up); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.dialect.lock != "" {
+		if _, err := conn.ExecContext(ctx, m.dialect.lock); err != nil {
+			return fmt.Errorf("couldn't take the migration lock: %w", err)
+		}
+		// The lock belongs to the connection, so unlock with a fresh
+		// context in case ctx is what ended fn
+		defer conn.ExecContext(context.Background(), m.dialect.unlock)
+	}
+
+	if err := m.ensureTable(ctx, conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// ensureTable creates goose_db_version the way goose does, with a row for
+// version 0.
+func (m *Migrator) ensureTable(ctx context.Context, conn *sql.Conn) error {
+	rows, err := conn.QueryContext(ctx, `SELECT version_id FROM goose_db_version LIMIT 1`)
+	if err == nil {
+		return rows.Close()
+	}
+	if !isMissingTable(err) {
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.dialect.createTable); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, m.dialect.insert, 0, true); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// applied maps each applied version to when it was applied. Version 0 is
+// goose's marker for an empty database and isn't included.
+//
+// goose_db_version is a history: a version's latest row says whether it is
+// applied, and an is_applied = false row means it was rolled back.
+func (m *Migrator) applied(ctx context.Context, q querier) (map[int64]time.Time, error) {
+	rows, err := q.QueryContext(ctx, `SELECT version_id, is_applied, tstamp FROM goose_db_version ORDER BY id`)
+	if err != nil {
+		if isMissingTable(err) {
+			return map[int64]time.Time{}, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var version int64
+		var isApplied bool
+		var tstamp sql.NullTime
+		if err := rows.Scan(&version, &isApplied, &tstamp); err != nil {
+			return nil, err
+		}
+		switch {
+		case version == 0:
+		case isApplied:
+			applied[version] = tstamp.Time
+		default:
+			delete(applied, version)
+		}
+	}
+	return applied, rows.Err()
+}
+
+// isMissingTable reports whether err is because nothing has ever been
+// migrated, so goose_db_version doesn't exist yet.
+func isMissingTable(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "goose_db_version") &&
+		(strings.Contains(message, "does not exist") || strings.Contains(message, "no such table"))
+}
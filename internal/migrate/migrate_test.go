@@ -0,0 +1,108 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	_ "modernc.org/sqlite"
+)
+
+func newTestMigrator(t *testing.T) (*Migrator, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	fsys := fstest.MapFS{
+		"001_users.sql":  {Data: []byte("-- +goose Up\nCREATE TABLE users (id TEXT);\n\n-- +goose Down\nDROP TABLE users;\n")},
+		"002_chirps.sql": {Data: []byte("-- +goose Up\nCREATE TABLE chirps (id TEXT);\n\n-- +goose Down\nDROP TABLE chirps;\n")},
+	}
+	m, err := New(db, SQLite, fsys)
+	if err != nil {
+		t.Fatalf("Error loading migrations: %v", err)
+	}
+	return m, db
+}
+
+func appliedVersions(t *testing.T, m *Migrator) []int64 {
+	t.Helper()
+
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Error getting status: %v", err)
+	}
+	var versions []int64
+	for _, status := range statuses {
+		if status.Applied {
+			versions = append(versions, status.Version)
+		}
+	}
+	return versions
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("up applies each migration once", func(t *testing.T) {
+		m, _ := newTestMigrator(t)
+		if err := m.Check(ctx); !errors.Is(err, ErrSchemaBehind) {
+			t.Errorf("Got %v before migrating, want ErrSchemaBehind", err)
+		}
+
+		done, err := m.Up(ctx)
+		if err != nil || len(done) != 2 {
+			t.Fatalf("Got %d migrations applied, %v, want 2", len(done), err)
+		}
+		if done, err := m.Up(ctx); err != nil || len(done) != 0 {
+			t.Errorf("Got %d migrations applied again, %v, want none", len(done), err)
+		}
+		if err := m.Check(ctx); err != nil {
+			t.Errorf("Error checking migrated schema: %v", err)
+		}
+	})
+
+	t.Run("down records the rollback", func(t *testing.T) {
+		m, db := newTestMigrator(t)
+		m.Up(ctx)
+
+		undone, err := m.Down(ctx)
+		if err != nil || undone.Version != 2 {
+			t.Fatalf("Got version %d rolled back, %v, want 2", undone.Version, err)
+		}
+		if got := appliedVersions(t, m); len(got) != 1 || got[0] != 1 {
+			t.Errorf("Got %v applied, want [1]", got)
+		}
+
+		var rows int
+		db.QueryRow(`SELECT COUNT(*) FROM goose_db_version WHERE version_id = 2`).Scan(&rows)
+		if rows != 2 {
+			t.Errorf("Got %d rows for version 2, want the apply and the rollback", rows)
+		}
+
+		if done, err := m.Up(ctx); err != nil || len(done) != 1 || done[0].Version != 2 {
+			t.Errorf("Got %v, %v reapplying, want version 2", done, err)
+		}
+	})
+
+	t.Run("the latest row for a version wins", func(t *testing.T) {
+		m, db := newTestMigrator(t)
+		m.Up(ctx)
+
+		// goose's CLI leaves this history behind after down then up then down
+		for _, isApplied := range []bool{false, true, false} {
+			if _, err := db.Exec(SQLite.insert, 1, isApplied); err != nil {
+				t.Fatalf("Error inserting history: %v", err)
+			}
+		}
+		if got := appliedVersions(t, m); len(got) != 1 || got[0] != 2 {
+			t.Errorf("Got %v applied, want [2]", got)
+		}
+	})
+}
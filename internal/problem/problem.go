@@ -0,0 +1,135 @@
+// Package problem writes error responses as RFC 7807 problem details
+// (application/problem+json). Every problem has a stable code that clients
+// can switch on; its type URI is /problems/<code> on this server.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/logging"
+)
+
+const ContentType = "application/problem+json"
+
+// Type is a kind of problem. Code and Title are the same every time it
+// occurs; what went wrong this time goes in the problem's Detail.
+type Type struct {
+	Code   string
+	Title  string
+	Status int
+}
+
+var (
+	BadRequest       = Type{"bad_request", "Bad request", http.StatusBadRequest}
+	InvalidJSON      = Type{"invalid_json", "Request body is not valid JSON", http.StatusBadRequest}
+	ValidationFailed = Type{"validation_failed", "Request failed validation", http.StatusBadRequest}
+
+	Unauthorized       = Type{"unauthorized", "Authentication required", http.StatusUnauthorized}
+	InvalidCredentials = Type{"invalid_credentials", "Invalid credentials", http.StatusUnauthorized}
+	InvalidToken       = Type{"invalid_token", "Invalid or expired token", http.StatusUnauthorized}
+
+	Forbidden         = Type{"forbidden", "Forbidden", http.StatusForbidden}
+	InsufficientScope = Type{"insufficient_scope", "Insufficient scope", http.StatusForbidden}
+	EmailNotVerified  = Type{"email_not_verified", "Email address not verified", http.StatusForbidden}
+
+	AccountPendingDeletion = Type{"account_pending_deletion", "Account is scheduled for deletion", http.StatusForbidden}
+
+	NotFound        = Type{"not_found", "Not found", http.StatusNotFound}
+	Conflict        = Type{"conflict", "Conflict", http.StatusConflict}
+	EmailTaken      = Type{"email_taken", "Email address already in use", http.StatusConflict}
+	Gone            = Type{"gone", "Gone", http.StatusGone}
+	TooManyRequests = Type{"too_many_requests", "Too many requests", http.StatusTooManyRequests}
+
+	IdempotencyKeyInUse  = Type{"idempotency_key_in_use", "A request with this Idempotency-Key is still in progress", http.StatusConflict}
+	IdempotencyKeyReused = Type{"idempotency_key_reused", "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity}
+
+	Internal = Type{"internal_error", "Internal server error", http.StatusInternalServerError}
+)
+
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	// Extensions are extra members specific to the problem type, written
+	// alongside the standard ones.
+	Extensions map[string]any `json:"-"`
+}
+
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	type problem Problem
+	dat, err := json.Marshal((*problem)(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return dat, err
+	}
+
+	members := map[string]any{}
+	for k, v := range p.Extensions {
+		members[k] = v
+	}
+	// The standard members win over an extension of the same name
+	if err := json.Unmarshal(dat, &members); err != nil {
+		return nil, err
+	}
+	return json.Marshal(members)
+}
+
+// FieldError says what is wrong with one field of the request.
+type FieldError struct {
+	Field  string `json:"field"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+// New describes a problem of type t with the request r.
+func New(r *http.Request, t Type, detail string) *Problem {
+	return &Problem{
+		Type:      "/problems/" + t.Code,
+		Title:     t.Title,
+		Status:    t.Status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      t.Code,
+		RequestID: logging.RequestID(r.Context()),
+	}
+}
+
+// With adds an extension member.
+func (p *Problem) With(key string, value any) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = map[string]any{}
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+func (p *Problem) WithField(field, code, detail string) *Problem {
+	p.Errors = append(p.Errors, FieldError{Field: field, Code: code, Detail: detail})
+	return p
+}
+
+func Write(rw http.ResponseWriter, p *Problem) {
+	dat, err := json.Marshal(p)
+	if err != nil {
+		http.Error(rw, p.Title, p.Status)
+		return
+	}
+	rw.Header().Set("Content-Type", ContentType)
+	rw.WriteHeader(p.Status)
+	rw.Write(dat)
+}
+
+// Error writes a problem of type t, like http.Error does for plain text.
+func Error(rw http.ResponseWriter, r *http.Request, t Type, detail string) {
+	Write(rw, New(r, t, detail))
+}
+
+// Invalid writes a validation failure for a single field.
+func Invalid(rw http.ResponseWriter, r *http.Request, field, code, detail string) {
+	Write(rw, New(r, ValidationFailed, detail).WithField(field, code, detail))
+}
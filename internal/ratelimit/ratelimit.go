@@ -0,0 +1,119 @@
+// Package ratelimit limits how often a key, such as a user or an IP
+// address, may do something, with a token bucket per key. Buckets live in
+// memory, or in Postgres so that every replica shares them.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit allows Burst requests at once, refilling at Rate a second. The zero
+// Limit allows everything.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseLimit reads "N/period", such as "10/1m": N requests per period, all
+// of which may come at once. "off" is no limit.
+func ParseLimit(spec string) (Limit, error) {
+	if spec == "off" {
+		return Limit{}, nil
+	}
+	count, period, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("rate limit %q must look like 10/1m", spec)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return Limit{}, fmt.Errorf("rate limit %q must allow at least one request", spec)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q has an invalid period", spec)
+	}
+	return Limit{Rate: float64(n) / d.Seconds(), Burst: n}, nil
+}
+
+func (l Limit) Unlimited() bool {
+	return l.Burst == 0
+}
+
+// Window is how long an empty bucket takes to fill up again.
+func (l Limit) Window() time.Duration {
+	if l.Unlimited() {
+		return 0
+	}
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+// Store keeps the buckets.
+type Store interface {
+	// Take refills the bucket for key to now and takes a token from it if
+	// there is a whole one. It returns the tokens left and whether one was
+	// taken.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (tokens float64, allowed bool, err error)
+	// Sweep forgets buckets untouched since before. Those are full, so
+	// dropping them changes nothing.
+	Sweep(ctx context.Context, before time.Time) error
+}
+
+// Decision is the outcome of one request, with what the RateLimit headers
+// report.
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until a request would be allowed, if this one
+	// wasn't
+	RetryAfter time.Duration
+}
+
+type Limiter struct {
+	store Store
+	now   func() time.Time
+}
+
+func New(store Store) *Limiter {
+	return &Limiter{store: store, now: time.Now}
+}
+
+// Allow takes a token for key, if limit allows it.
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (Decision, error) {
+	if limit.Unlimited() {
+		return Decision{Allowed: true}, nil
+	}
+
+	tokens, allowed, err := l.store.Take(ctx, key, limit, l.now())
+	if err != nil {
+		return Decision{}, err
+	}
+
+	decision := Decision{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     seconds((float64(limit.Burst) - tokens) / limit.Rate),
+	}
+	if !allowed {
+		decision.RetryAfter = seconds((1 - tokens) / limit.Rate)
+	}
+	return decision, nil
+}
+
+// Sweep forgets buckets idle for longer than maxWindow, the longest Window
+// of any limit in use.
+func (l *Limiter) Sweep(ctx context.Context, maxWindow time.Duration) error {
+	return l.store.Sweep(ctx, l.now().Add(-maxWindow))
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Max(s, 0) * float64(time.Second))
+}
@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	cases := []struct {
+		spec    string
+		want    Limit
+		window  time.Duration
+		wantErr bool
+	}{
+		{"10/1m", Limit{Rate: 10.0 / 60, Burst: 10}, time.Minute, false},
+		{"1/1s", Limit{Rate: 1, Burst: 1}, time.Second, false},
+		{"300/1h", Limit{Rate: 300.0 / 3600, Burst: 300}, time.Hour, false},
+		{"off", Limit{}, 0, false},
+		{"10", Limit{}, 0, true},
+		{"0/1m", Limit{}, 0, true},
+		{"ten/1m", Limit{}, 0, true},
+		{"10/soon", Limit{}, 0, true},
+		{"10/-1m", Limit{}, 0, true},
+	}
+	for _, tc := range cases {
+		limit, err := ParseLimit(tc.spec)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseLimit(%q): got error %v, want error %t", tc.spec, err, tc.wantErr)
+			continue
+		}
+		if limit != tc.want {
+			t.Errorf("ParseLimit(%q): got %+v, want %+v", tc.spec, limit, tc.want)
+		}
+		if got := limit.Window(); got != tc.window {
+			t.Errorf("ParseLimit(%q): got window %v, want %v", tc.spec, got, tc.window)
+		}
+	}
+}
+
+// newTestLimiter is a Limiter on a memory store whose clock only moves
+// when the test advances it.
+func newTestLimiter() (*Limiter, *Memory, func(time.Duration)) {
+	store := NewMemory()
+	l := New(store)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, store, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	// 3 requests at once, then one every 20 seconds
+	limit, _ := ParseLimit("3/1m")
+
+	t.Run("bucket arithmetic", func(t *testing.T) {
+		l, _, advance := newTestLimiter()
+
+		steps := []struct {
+			name    string
+			advance time.Duration
+			want    Decision
+		}{
+			{"first", 0, Decision{Allowed: true, Limit: 3, Remaining: 2, Reset: 20 * time.Second}},
+			{"second", 0, Decision{Allowed: true, Limit: 3, Remaining: 1, Reset: 40 * time.Second}},
+			{"third", 0, Decision{Allowed: true, Limit: 3, Remaining: 0, Reset: time.Minute}},
+			{"empty", 0, Decision{Allowed: false, Limit: 3, Remaining: 0, Reset: time.Minute, RetryAfter: 20 * time.Second}},
+			{"half a token back", 10 * time.Second, Decision{Allowed: false, Limit: 3, Remaining: 0, Reset: 50 * time.Second, RetryAfter: 10 * time.Second}},
+			{"a whole token back", 10 * time.Second, Decision{Allowed: true, Limit: 3, Remaining: 0, Reset: time.Minute}},
+			{"refilled, not overfilled", time.Hour, Decision{Allowed: true, Limit: 3, Remaining: 2, Reset: 20 * time.Second}},
+		}
+		for _, step := range steps {
+			advance(step.advance)
+			got, err := l.Allow(ctx, "ip:192.0.2.1", limit)
+			if err != nil {
+				t.Fatalf("%s: error allowing: %v", step.name, err)
+			}
+			if got != step.want {
+				t.Errorf("%s: got %+v, want %+v", step.name, got, step.want)
+			}
+		}
+	})
+
+	t.Run("keys have their own buckets", func(t *testing.T) {
+		l, _, _ := newTestLimiter()
+		for range limit.Burst {
+			l.Allow(ctx, "ip:192.0.2.1", limit)
+		}
+		if got, _ := l.Allow(ctx, "ip:192.0.2.2", limit); !got.Allowed || got.Remaining != 2 {
+			t.Errorf("Got %+v for another key, want a full bucket", got)
+		}
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		l, store, _ := newTestLimiter()
+		for range 5 {
+			if got, _ := l.Allow(ctx, "ip:192.0.2.1", Limit{}); !got.Allowed {
+				t.Fatalf("Got %+v, want every request allowed", got)
+			}
+		}
+		if len(store.buckets) != 0 {
+			t.Errorf("Got %d buckets, want none for an unlimited limit", len(store.buckets))
+		}
+	})
+
+	t.Run("sweep forgets idle buckets", func(t *testing.T) {
+		l, store, advance := newTestLimiter()
+		l.Allow(ctx, "idle", limit)
+		advance(2 * time.Minute)
+		l.Allow(ctx, "busy", limit)
+		advance(30 * time.Second)
+
+		if err := l.Sweep(ctx, limit.Window()); err != nil {
+			t.Fatalf("Error sweeping: %v", err)
+		}
+		if _, ok := store.buckets["idle"]; ok {
+			t.Errorf("Idle bucket wasn't swept")
+		}
+		if _, ok := store.buckets["busy"]; !ok {
+			t.Errorf("Busy bucket was swept")
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+)
+
+// Memory keeps buckets in this process only, so each replica limits on
+// its own.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*bucket{}}
+}
+
+func (m *Memory) Take(ctx context.Context, key string, limit Limit, now time.Time) (float64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		m.buckets[key] = b
+	}
+	if now.After(b.updated) {
+		b.tokens = min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+		b.updated = now
+	}
+
+	if b.tokens < 1 {
+		return b.tokens, false, nil
+	}
+	b.tokens--
+	return b.tokens, true, nil
+}
+
+func (m *Memory) Sweep(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, b := range m.buckets {
+		if b.updated.Before(before) {
+			delete(m.buckets, key)
+		}
+	}
+	return nil
+}
+
+// Postgres shares buckets between every replica using the same database.
+type Postgres struct {
+	queries *database.Queries
+}
+
+func NewPostgres(queries *database.Queries) *Postgres {
+	return &Postgres{queries: queries}
+}
+
+func (p *Postgres) Take(ctx context.Context, key string, limit Limit, now time.Time) (float64, bool, error) {
+	row, err := p.queries.TakeRateLimitToken(ctx, database.TakeRateLimitTokenParams{
+		Key:   key,
+		Burst: float64(limit.Burst),
+		Now:   now,
+		Rate:  limit.Rate,
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return row.Tokens, row.Allowed, nil
+}
+
+func (p *Postgres) Sweep(ctx context.Context, before time.Time) error {
+	_, err := p.queries.DeleteIdleRateLimitBuckets(ctx, before)
+	return err
+}
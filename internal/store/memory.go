@@ -0,0 +1,543 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+)
+
+// Memory keeps everything in maps, for demos and handler tests. It behaves
+// like the Postgres queries it stands in for, down to returning
+// sql.ErrNoRows, and is safe for concurrent use.
+type Memory struct {
+	mu   sync.RWMutex
+	data *memoryData
+}
+
+func NewMemory() *Memory {
+	return &Memory{data: &memoryData{
+		users:         map[uuid.UUID]database.User{},
+		chirps:        map[uuid.UUID]database.Chirp{},
+		refreshTokens: map[string]database.RefreshToken{},
+		apiKeys:       map[uuid.UUID]database.ApiKey{},
+		loginFailures: map[string]database.LoginFailure{},
+		oauthClients:  map[uuid.UUID]database.OauthClient{},
+		oauthCodes:    map[string]database.OauthCode{},
+		totp:          map[uuid.UUID]database.UserTotp{},
+		recoveryCodes: map[string]database.RecoveryCode{},
+		userTokens:    map[string]database.UserToken{},
+		dataExports:   map[uuid.UUID]database.DataExport{},
+	}}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// Atomic runs fn on a copy of the data and only keeps the copy if fn
+// succeeds. Writers are serialized, so fn never needs to be retried.
+func (m *Memory) Atomic(ctx context.Context, fn func(q Queries) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data := m.data.clone()
+	if err := fn(data); err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+func (m *Memory) CreateChirp(ctx context.Context, arg database.CreateChirpParams) (database.Chirp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.CreateChirp(ctx, arg)
+}
+
+func (m *Memory) DeleteOneChirp(ctx context.Context, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.DeleteOneChirp(ctx, id)
+}
+
+func (m *Memory) GetAllChirps(ctx context.Context) ([]database.Chirp, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetAllChirps(ctx)
+}
+
+func (m *Memory) GetChirpsForUser(ctx context.Context, userID uuid.UUID) ([]database.Chirp, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetChirpsForUser(ctx, userID)
+}
+
+func (m *Memory) GetOneChirp(ctx context.Context, id uuid.UUID) (database.Chirp, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetOneChirp(ctx, id)
+}
+
+func (m *Memory) CancelUserDeletion(ctx context.Context, id uuid.UUID) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.CancelUserDeletion(ctx, id)
+}
+
+func (m *Memory) CreateUser(ctx context.Context, arg database.CreateUserParams) (database.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.CreateUser(ctx, arg)
+}
+
+func (m *Memory) DeleteAllUsers(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.DeleteAllUsers(ctx)
+}
+
+func (m *Memory) GetUser(ctx context.Context, email string) (database.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetUser(ctx, email)
+}
+
+func (m *Memory) GetUserByID(ctx context.Context, id uuid.UUID) (database.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetUserByID(ctx, id)
+}
+
+func (m *Memory) MarkEmailVerified(ctx context.Context, arg database.MarkEmailVerifiedParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.MarkEmailVerified(ctx, arg)
+}
+
+func (m *Memory) PatchUser(ctx context.Context, arg database.PatchUserParams) (database.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.PatchUser(ctx, arg)
+}
+
+func (m *Memory) PurgeDeletedUsers(ctx context.Context, deletionRequestedAt sql.NullTime) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.PurgeDeletedUsers(ctx, deletionRequestedAt)
+}
+
+func (m *Memory) RehashUserPassword(ctx context.Context, arg database.RehashUserPasswordParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.RehashUserPassword(ctx, arg)
+}
+
+func (m *Memory) RequestUserDeletion(ctx context.Context, id uuid.UUID) (database.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.RequestUserDeletion(ctx, id)
+}
+
+func (m *Memory) UpdateUserPassword(ctx context.Context, arg database.UpdateUserPasswordParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.UpdateUserPassword(ctx, arg)
+}
+
+func (m *Memory) CreateRefreshtoken(ctx context.Context, arg database.CreateRefreshtokenParams) (database.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.CreateRefreshtoken(ctx, arg)
+}
+
+func (m *Memory) GetSessionsForUser(ctx context.Context, userID uuid.UUID) ([]database.GetSessionsForUserRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetSessionsForUser(ctx, userID)
+}
+
+func (m *Memory) GetUserFromRefreshToken(ctx context.Context, token string) (database.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetUserFromRefreshToken(ctx, token)
+}
+
+func (m *Memory) RevokeAllRefreshTokensForUser(ctx context.Context, userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.RevokeAllRefreshTokensForUser(ctx, userID)
+}
+
+func (m *Memory) RevokeRefreshToken(ctx context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.RevokeRefreshToken(ctx, token)
+}
+
+// memoryData implements the queries themselves. It does no locking; Memory
+// takes care of that.
+type memoryData struct {
+	users         map[uuid.UUID]database.User
+	chirps        map[uuid.UUID]database.Chirp
+	refreshTokens map[string]database.RefreshToken
+	apiKeys       map[uuid.UUID]database.ApiKey
+	loginFailures map[string]database.LoginFailure
+	oauthClients  map[uuid.UUID]database.OauthClient
+	oauthCodes    map[string]database.OauthCode
+	totp          map[uuid.UUID]database.UserTotp
+	recoveryCodes map[string]database.RecoveryCode
+	userTokens    map[string]database.UserToken
+	dataExports   map[uuid.UUID]database.DataExport
+}
+
+// clone copies the maps but not what they hold, so stored values must be
+// replaced rather than changed in place.
+func (d *memoryData) clone() *memoryData {
+	return &memoryData{
+		users:         maps.Clone(d.users),
+		chirps:        maps.Clone(d.chirps),
+		refreshTokens: maps.Clone(d.refreshTokens),
+		apiKeys:       maps.Clone(d.apiKeys),
+		loginFailures: maps.Clone(d.loginFailures),
+		oauthClients:  maps.Clone(d.oauthClients),
+		oauthCodes:    maps.Clone(d.oauthCodes),
+		totp:          maps.Clone(d.totp),
+		recoveryCodes: maps.Clone(d.recoveryCodes),
+		userTokens:    maps.Clone(d.userTokens),
+		dataExports:   maps.Clone(d.dataExports),
+	}
+}
+
+// Timestamps are stored in UTC like Postgres' TIMESTAMP columns.
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+func sortChirps(chirps []database.Chirp) {
+	slices.SortFunc(chirps, func(a, b database.Chirp) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+}
+
+func (d *memoryData) emailTaken(email string, except uuid.UUID) bool {
+	for _, user := range d.users {
+		if user.Email == email && user.ID != except {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteUser removes the user and, like ON DELETE CASCADE, everything
+// that belongs to them.
+func (d *memoryData) deleteUser(id uuid.UUID) {
+	delete(d.users, id)
+	for chirpID, chirp := range d.chirps {
+		if chirp.UserID == id {
+			delete(d.chirps, chirpID)
+		}
+	}
+	for token, refreshToken := range d.refreshTokens {
+		if refreshToken.UserID == id {
+			delete(d.refreshTokens, token)
+		}
+	}
+	maps.DeleteFunc(d.apiKeys, func(_ uuid.UUID, k database.ApiKey) bool { return k.UserID == id })
+	maps.DeleteFunc(d.oauthClients, func(_ uuid.UUID, c database.OauthClient) bool { return c.UserID == id })
+	// Codes go with their user or with their client
+	maps.DeleteFunc(d.oauthCodes, func(_ string, c database.OauthCode) bool {
+		_, ok := d.oauthClients[c.ClientID]
+		return c.UserID == id || !ok
+	})
+	delete(d.totp, id)
+	maps.DeleteFunc(d.recoveryCodes, func(_ string, c database.RecoveryCode) bool { return c.UserID == id })
+	maps.DeleteFunc(d.userTokens, func(_ string, t database.UserToken) bool { return t.UserID == id })
+	maps.DeleteFunc(d.dataExports, func(_ uuid.UUID, e database.DataExport) bool { return e.UserID == id })
+}
+
+// visible reports whether a chirp's author is not waiting to be deleted.
+func (d *memoryData) visible(chirp database.Chirp) bool {
+	user, ok := d.users[chirp.UserID]
+	return ok && !user.DeletionRequestedAt.Valid
+}
+
+func (d *memoryData) CreateChirp(ctx context.Context, arg database.CreateChirpParams) (database.Chirp, error) {
+	if _, ok := d.users[arg.UserID]; !ok {
+		return database.Chirp{}, fmt.Errorf("user %s does not exist", arg.UserID)
+	}
+
+	t := now()
+	chirp := database.Chirp{
+		ID:        uuid.New(),
+		CreatedAt: t,
+		UpdatedAt: t,
+		Body:      arg.Body,
+		UserID:    arg.UserID,
+	}
+	d.chirps[chirp.ID] = chirp
+	return chirp, nil
+}
+
+func (d *memoryData) DeleteOneChirp(ctx context.Context, id uuid.UUID) error {
+	delete(d.chirps, id)
+	return nil
+}
+
+func (d *memoryData) GetAllChirps(ctx context.Context) ([]database.Chirp, error) {
+	var chirps []database.Chirp
+	for _, chirp := range d.chirps {
+		if d.visible(chirp) {
+			chirps = append(chirps, chirp)
+		}
+	}
+	sortChirps(chirps)
+	return chirps, nil
+}
+
+func (d *memoryData) GetChirpsForUser(ctx context.Context, userID uuid.UUID) ([]database.Chirp, error) {
+	var chirps []database.Chirp
+	for _, chirp := range d.chirps {
+		if chirp.UserID == userID {
+			chirps = append(chirps, chirp)
+		}
+	}
+	sortChirps(chirps)
+	return chirps, nil
+}
+
+func (d *memoryData) GetOneChirp(ctx context.Context, id uuid.UUID) (database.Chirp, error) {
+	chirp, ok := d.chirps[id]
+	if !ok || !d.visible(chirp) {
+		return database.Chirp{}, sql.ErrNoRows
+	}
+	return chirp, nil
+}
+
+func (d *memoryData) CancelUserDeletion(ctx context.Context, id uuid.UUID) (int64, error) {
+	user, ok := d.users[id]
+	if !ok || !user.DeletionRequestedAt.Valid {
+		return 0, nil
+	}
+
+	user.DeletionRequestedAt = sql.NullTime{}
+	user.UpdatedAt = now()
+	d.users[id] = user
+	return 1, nil
+}
+
+func (d *memoryData) CreateUser(ctx context.Context, arg database.CreateUserParams) (database.User, error) {
+	if d.emailTaken(arg.Email, uuid.Nil) {
+		return database.User{}, ErrUniqueViolation
+	}
+
+	t := now()
+	user := database.User{
+		ID:             uuid.New(),
+		CreatedAt:      t,
+		UpdatedAt:      t,
+		Email:          arg.Email,
+		HashedPassword: arg.HashedPassword,
+	}
+	d.users[user.ID] = user
+	return user, nil
+}
+
+func (d *memoryData) DeleteAllUsers(ctx context.Context) error {
+	// Login failures are keyed by email and IP, not users, so they stay
+	clear(d.users)
+	clear(d.chirps)
+	clear(d.refreshTokens)
+	clear(d.apiKeys)
+	clear(d.oauthClients)
+	clear(d.oauthCodes)
+	clear(d.totp)
+	clear(d.recoveryCodes)
+	clear(d.userTokens)
+	clear(d.dataExports)
+	return nil
+}
+
+func (d *memoryData) GetUser(ctx context.Context, email string) (database.User, error) {
+	for _, user := range d.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return database.User{}, sql.ErrNoRows
+}
+
+func (d *memoryData) GetUserByID(ctx context.Context, id uuid.UUID) (database.User, error) {
+	user, ok := d.users[id]
+	if !ok {
+		return database.User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+func (d *memoryData) MarkEmailVerified(ctx context.Context, arg database.MarkEmailVerifiedParams) (int64, error) {
+	user, ok := d.users[arg.ID]
+	if !ok || user.Email != arg.Email {
+		return 0, nil
+	}
+
+	t := now()
+	user.EmailVerifiedAt = sql.NullTime{Time: t, Valid: true}
+	user.UpdatedAt = t
+	d.users[arg.ID] = user
+	return 1, nil
+}
+
+func (d *memoryData) PatchUser(ctx context.Context, arg database.PatchUserParams) (database.User, error) {
+	user, ok := d.users[arg.ID]
+	if !ok {
+		return database.User{}, sql.ErrNoRows
+	}
+
+	if arg.Email.Valid && arg.Email.String != user.Email {
+		if d.emailTaken(arg.Email.String, user.ID) {
+			return database.User{}, ErrUniqueViolation
+		}
+		user.Email = arg.Email.String
+		user.EmailVerifiedAt = sql.NullTime{}
+	}
+	if arg.HashedPassword.Valid {
+		user.HashedPassword = arg.HashedPassword.String
+	}
+	user.UpdatedAt = now()
+
+	d.users[arg.ID] = user
+	return user, nil
+}
+
+func (d *memoryData) PurgeDeletedUsers(ctx context.Context, deletionRequestedAt sql.NullTime) (int64, error) {
+	if !deletionRequestedAt.Valid {
+		return 0, nil
+	}
+
+	var purged int64
+	for id, user := range d.users {
+		if user.DeletionRequestedAt.Valid && user.DeletionRequestedAt.Time.Before(deletionRequestedAt.Time) {
+			d.deleteUser(id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (d *memoryData) RehashUserPassword(ctx context.Context, arg database.RehashUserPasswordParams) error {
+	user, ok := d.users[arg.ID]
+	if !ok || user.HashedPassword != arg.OldHash {
+		return nil
+	}
+
+	user.HashedPassword = arg.NewHash
+	d.users[arg.ID] = user
+	return nil
+}
+
+func (d *memoryData) RequestUserDeletion(ctx context.Context, id uuid.UUID) (database.User, error) {
+	user, ok := d.users[id]
+	if !ok || user.DeletionRequestedAt.Valid {
+		return database.User{}, sql.ErrNoRows
+	}
+
+	t := now()
+	user.DeletionRequestedAt = sql.NullTime{Time: t, Valid: true}
+	user.UpdatedAt = t
+	d.users[id] = user
+	return user, nil
+}
+
+func (d *memoryData) UpdateUserPassword(ctx context.Context, arg database.UpdateUserPasswordParams) error {
+	user, ok := d.users[arg.ID]
+	if !ok {
+		return nil
+	}
+
+	user.HashedPassword = arg.HashedPassword
+	user.UpdatedAt = now()
+	d.users[arg.ID] = user
+	return nil
+}
+
+func (d *memoryData) CreateRefreshtoken(ctx context.Context, arg database.CreateRefreshtokenParams) (database.RefreshToken, error) {
+	if _, ok := d.users[arg.UserID]; !ok {
+		return database.RefreshToken{}, fmt.Errorf("user %s does not exist", arg.UserID)
+	}
+	if _, ok := d.refreshTokens[arg.Token]; ok {
+		return database.RefreshToken{}, ErrUniqueViolation
+	}
+
+	t := now()
+	refreshToken := database.RefreshToken{
+		Token:     arg.Token,
+		CreatedAt: t,
+		UpdatedAt: t,
+		UserID:    arg.UserID,
+		ExpiresAt: arg.ExpiresAt,
+	}
+	d.refreshTokens[arg.Token] = refreshToken
+	return refreshToken, nil
+}
+
+func (d *memoryData) GetSessionsForUser(ctx context.Context, userID uuid.UUID) ([]database.GetSessionsForUserRow, error) {
+	var tokens []database.RefreshToken
+	for _, refreshToken := range d.refreshTokens {
+		if refreshToken.UserID == userID {
+			tokens = append(tokens, refreshToken)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b database.RefreshToken) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	var sessions []database.GetSessionsForUserRow
+	for _, refreshToken := range tokens {
+		sessions = append(sessions, database.GetSessionsForUserRow{
+			CreatedAt: refreshToken.CreatedAt,
+			ExpiresAt: refreshToken.ExpiresAt,
+			RevokedAt: refreshToken.RevokedAt,
+		})
+	}
+	return sessions, nil
+}
+
+func (d *memoryData) GetUserFromRefreshToken(ctx context.Context, token string) (database.User, error) {
+	refreshToken, ok := d.refreshTokens[token]
+	if !ok || refreshToken.RevokedAt.Valid || !refreshToken.ExpiresAt.After(time.Now()) {
+		return database.User{}, sql.ErrNoRows
+	}
+	return d.GetUserByID(ctx, refreshToken.UserID)
+}
+
+func (d *memoryData) RevokeAllRefreshTokensForUser(ctx context.Context, userID uuid.UUID) error {
+	t := now()
+	for token, refreshToken := range d.refreshTokens {
+		if refreshToken.UserID == userID && !refreshToken.RevokedAt.Valid {
+			refreshToken.RevokedAt = sql.NullTime{Time: t, Valid: true}
+			refreshToken.UpdatedAt = t
+			d.refreshTokens[token] = refreshToken
+		}
+	}
+	return nil
+}
+
+func (d *memoryData) RevokeRefreshToken(ctx context.Context, token string) error {
+	refreshToken, ok := d.refreshTokens[token]
+	if !ok {
+		return nil
+	}
+
+	t := now()
+	refreshToken.RevokedAt = sql.NullTime{Time: t, Valid: true}
+	refreshToken.UpdatedAt = t
+	d.refreshTokens[token] = refreshToken
+	return nil
+}
@@ -0,0 +1,678 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+)
+
+// The in-memory versions of the queries in api_keys.sql, login_failures.sql,
+// oauth.sql, totp.sql, user_tokens.sql, data_exports.sql and import.sql.
+
+func (m *Memory) CreateAPIKey(ctx context.Context, arg database.CreateAPIKeyParams) (database.ApiKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.CreateAPIKey(ctx, arg)
+}
+
+func (m *Memory) DeleteAPIKey(ctx context.Context, arg database.DeleteAPIKeyParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.DeleteAPIKey(ctx, arg)
+}
+
+func (m *Memory) GetAPIKeyByHash(ctx context.Context, keyHash string) (database.ApiKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetAPIKeyByHash(ctx, keyHash)
+}
+
+func (m *Memory) GetAPIKeysForUser(ctx context.Context, userID uuid.UUID) ([]database.ApiKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetAPIKeysForUser(ctx, userID)
+}
+
+func (m *Memory) TouchAPIKey(ctx context.Context, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.TouchAPIKey(ctx, id)
+}
+
+func (m *Memory) ClearLoginFailures(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.ClearLoginFailures(ctx, key)
+}
+
+func (m *Memory) GetLockedLogins(ctx context.Context, lockedUntil sql.NullTime) ([]database.LoginFailure, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetLockedLogins(ctx, lockedUntil)
+}
+
+func (m *Memory) GetLoginFailure(ctx context.Context, key string) (database.LoginFailure, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetLoginFailure(ctx, key)
+}
+
+func (m *Memory) LockLogin(ctx context.Context, arg database.LockLoginParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.LockLogin(ctx, arg)
+}
+
+func (m *Memory) RecordLoginFailure(ctx context.Context, arg database.RecordLoginFailureParams) (database.LoginFailure, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.RecordLoginFailure(ctx, arg)
+}
+
+func (m *Memory) ConsumeOAuthCode(ctx context.Context, codeHash string) (database.OauthCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.ConsumeOAuthCode(ctx, codeHash)
+}
+
+func (m *Memory) CreateOAuthClient(ctx context.Context, arg database.CreateOAuthClientParams) (database.OauthClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.CreateOAuthClient(ctx, arg)
+}
+
+func (m *Memory) CreateOAuthCode(ctx context.Context, arg database.CreateOAuthCodeParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.CreateOAuthCode(ctx, arg)
+}
+
+func (m *Memory) GetOAuthClient(ctx context.Context, id uuid.UUID) (database.OauthClient, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetOAuthClient(ctx, id)
+}
+
+func (m *Memory) CreateRecoveryCode(ctx context.Context, arg database.CreateRecoveryCodeParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.CreateRecoveryCode(ctx, arg)
+}
+
+func (m *Memory) DeleteRecoveryCodes(ctx context.Context, userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.DeleteRecoveryCodes(ctx, userID)
+}
+
+func (m *Memory) DeleteTOTP(ctx context.Context, userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.DeleteTOTP(ctx, userID)
+}
+
+func (m *Memory) EnableTOTP(ctx context.Context, arg database.EnableTOTPParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.EnableTOTP(ctx, arg)
+}
+
+func (m *Memory) GetTOTPForUser(ctx context.Context, userID uuid.UUID) (database.UserTotp, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetTOTPForUser(ctx, userID)
+}
+
+func (m *Memory) StartTOTPEnrolment(ctx context.Context, arg database.StartTOTPEnrolmentParams) (database.UserTotp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.StartTOTPEnrolment(ctx, arg)
+}
+
+func (m *Memory) UseRecoveryCode(ctx context.Context, arg database.UseRecoveryCodeParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.UseRecoveryCode(ctx, arg)
+}
+
+func (m *Memory) UseTOTPStep(ctx context.Context, arg database.UseTOTPStepParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.UseTOTPStep(ctx, arg)
+}
+
+func (m *Memory) ConsumeUserToken(ctx context.Context, arg database.ConsumeUserTokenParams) (database.UserToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.ConsumeUserToken(ctx, arg)
+}
+
+func (m *Memory) CreateUserToken(ctx context.Context, arg database.CreateUserTokenParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.CreateUserToken(ctx, arg)
+}
+
+func (m *Memory) GetUserToken(ctx context.Context, arg database.GetUserTokenParams) (database.UserToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetUserToken(ctx, arg)
+}
+
+func (m *Memory) CompleteDataExport(ctx context.Context, arg database.CompleteDataExportParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.CompleteDataExport(ctx, arg)
+}
+
+func (m *Memory) CreateDataExport(ctx context.Context, userID uuid.UUID) (database.DataExport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.CreateDataExport(ctx, userID)
+}
+
+func (m *Memory) DeleteDataExportsForUser(ctx context.Context, userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.DeleteDataExportsForUser(ctx, userID)
+}
+
+func (m *Memory) DeleteExpiredDataExports(ctx context.Context, expiresAt sql.NullTime) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.DeleteExpiredDataExports(ctx, expiresAt)
+}
+
+func (m *Memory) FailDataExport(ctx context.Context, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.FailDataExport(ctx, id)
+}
+
+func (m *Memory) FailStaleDataExports(ctx context.Context, createdAt time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.FailStaleDataExports(ctx, createdAt)
+}
+
+func (m *Memory) GetDataExport(ctx context.Context, arg database.GetDataExportParams) (database.DataExport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.GetDataExport(ctx, arg)
+}
+
+func (m *Memory) ImportChirp(ctx context.Context, arg database.ImportChirpParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.ImportChirp(ctx, arg)
+}
+
+func (m *Memory) ImportUser(ctx context.Context, arg database.ImportUserParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.ImportUser(ctx, arg)
+}
+
+func (d *memoryData) userExists(id uuid.UUID) error {
+	if _, ok := d.users[id]; !ok {
+		return fmt.Errorf("user %s does not exist", id)
+	}
+	return nil
+}
+
+func (d *memoryData) CreateAPIKey(ctx context.Context, arg database.CreateAPIKeyParams) (database.ApiKey, error) {
+	if err := d.userExists(arg.UserID); err != nil {
+		return database.ApiKey{}, err
+	}
+	for _, apiKey := range d.apiKeys {
+		if apiKey.KeyHash == arg.KeyHash {
+			return database.ApiKey{}, ErrUniqueViolation
+		}
+	}
+
+	t := now()
+	apiKey := database.ApiKey{
+		ID:        uuid.New(),
+		CreatedAt: t,
+		UpdatedAt: t,
+		UserID:    arg.UserID,
+		Name:      arg.Name,
+		Prefix:    arg.Prefix,
+		KeyHash:   arg.KeyHash,
+		Scopes:    arg.Scopes,
+		ExpiresAt: arg.ExpiresAt,
+	}
+	d.apiKeys[apiKey.ID] = apiKey
+	return apiKey, nil
+}
+
+func (d *memoryData) DeleteAPIKey(ctx context.Context, arg database.DeleteAPIKeyParams) (int64, error) {
+	apiKey, ok := d.apiKeys[arg.ID]
+	if !ok || apiKey.UserID != arg.UserID {
+		return 0, nil
+	}
+	delete(d.apiKeys, arg.ID)
+	return 1, nil
+}
+
+func (d *memoryData) GetAPIKeyByHash(ctx context.Context, keyHash string) (database.ApiKey, error) {
+	for _, apiKey := range d.apiKeys {
+		if apiKey.KeyHash != keyHash {
+			continue
+		}
+		if user, ok := d.users[apiKey.UserID]; ok && !user.DeletionRequestedAt.Valid {
+			return apiKey, nil
+		}
+	}
+	return database.ApiKey{}, sql.ErrNoRows
+}
+
+func (d *memoryData) GetAPIKeysForUser(ctx context.Context, userID uuid.UUID) ([]database.ApiKey, error) {
+	var apiKeys []database.ApiKey
+	for _, apiKey := range d.apiKeys {
+		if apiKey.UserID == userID {
+			apiKeys = append(apiKeys, apiKey)
+		}
+	}
+	slices.SortFunc(apiKeys, func(a, b database.ApiKey) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return apiKeys, nil
+}
+
+func (d *memoryData) TouchAPIKey(ctx context.Context, id uuid.UUID) error {
+	apiKey, ok := d.apiKeys[id]
+	if !ok {
+		return nil
+	}
+
+	apiKey.LastUsedAt = sql.NullTime{Time: now(), Valid: true}
+	d.apiKeys[id] = apiKey
+	return nil
+}
+
+func (d *memoryData) ClearLoginFailures(ctx context.Context, key string) error {
+	delete(d.loginFailures, key)
+	return nil
+}
+
+func (d *memoryData) GetLockedLogins(ctx context.Context, lockedUntil sql.NullTime) ([]database.LoginFailure, error) {
+	if !lockedUntil.Valid {
+		return nil, nil
+	}
+
+	var failures []database.LoginFailure
+	for _, failure := range d.loginFailures {
+		if failure.LockedUntil.Valid && failure.LockedUntil.Time.After(lockedUntil.Time) {
+			failures = append(failures, failure)
+		}
+	}
+	slices.SortFunc(failures, func(a, b database.LoginFailure) int {
+		return b.LockedUntil.Time.Compare(a.LockedUntil.Time)
+	})
+	return failures, nil
+}
+
+func (d *memoryData) GetLoginFailure(ctx context.Context, key string) (database.LoginFailure, error) {
+	failure, ok := d.loginFailures[key]
+	if !ok {
+		return database.LoginFailure{}, sql.ErrNoRows
+	}
+	return failure, nil
+}
+
+func (d *memoryData) LockLogin(ctx context.Context, arg database.LockLoginParams) error {
+	failure, ok := d.loginFailures[arg.Key]
+	if !ok {
+		return nil
+	}
+
+	failure.LockedUntil = arg.LockedUntil
+	d.loginFailures[arg.Key] = failure
+	return nil
+}
+
+func (d *memoryData) RecordLoginFailure(ctx context.Context, arg database.RecordLoginFailureParams) (database.LoginFailure, error) {
+	failure, ok := d.loginFailures[arg.Key]
+	switch {
+	case !ok:
+		failure = database.LoginFailure{Key: arg.Key, Failures: 1}
+	case failure.LastFailedAt.Before(arg.WindowStart):
+		failure.Failures = 1
+	default:
+		failure.Failures++
+	}
+
+	failure.LastFailedAt = arg.FailedAt
+	d.loginFailures[arg.Key] = failure
+	return failure, nil
+}
+
+func (d *memoryData) ConsumeOAuthCode(ctx context.Context, codeHash string) (database.OauthCode, error) {
+	code, ok := d.oauthCodes[codeHash]
+	if !ok || code.UsedAt.Valid || !code.ExpiresAt.After(time.Now()) {
+		return database.OauthCode{}, sql.ErrNoRows
+	}
+
+	code.UsedAt = sql.NullTime{Time: now(), Valid: true}
+	d.oauthCodes[codeHash] = code
+	return code, nil
+}
+
+func (d *memoryData) CreateOAuthClient(ctx context.Context, arg database.CreateOAuthClientParams) (database.OauthClient, error) {
+	if err := d.userExists(arg.UserID); err != nil {
+		return database.OauthClient{}, err
+	}
+
+	t := now()
+	client := database.OauthClient{
+		ID:           uuid.New(),
+		CreatedAt:    t,
+		UpdatedAt:    t,
+		UserID:       arg.UserID,
+		Name:         arg.Name,
+		SecretHash:   arg.SecretHash,
+		RedirectUris: arg.RedirectUris,
+	}
+	d.oauthClients[client.ID] = client
+	return client, nil
+}
+
+func (d *memoryData) CreateOAuthCode(ctx context.Context, arg database.CreateOAuthCodeParams) error {
+	if err := d.userExists(arg.UserID); err != nil {
+		return err
+	}
+	if _, ok := d.oauthClients[arg.ClientID]; !ok {
+		return fmt.Errorf("oauth client %s does not exist", arg.ClientID)
+	}
+	if _, ok := d.oauthCodes[arg.CodeHash]; ok {
+		return ErrUniqueViolation
+	}
+
+	d.oauthCodes[arg.CodeHash] = database.OauthCode{
+		CodeHash:      arg.CodeHash,
+		CreatedAt:     now(),
+		ClientID:      arg.ClientID,
+		UserID:        arg.UserID,
+		RedirectUri:   arg.RedirectUri,
+		Scopes:        arg.Scopes,
+		CodeChallenge: arg.CodeChallenge,
+		ExpiresAt:     arg.ExpiresAt,
+	}
+	return nil
+}
+
+func (d *memoryData) GetOAuthClient(ctx context.Context, id uuid.UUID) (database.OauthClient, error) {
+	client, ok := d.oauthClients[id]
+	if !ok {
+		return database.OauthClient{}, sql.ErrNoRows
+	}
+	return client, nil
+}
+
+func (d *memoryData) CreateRecoveryCode(ctx context.Context, arg database.CreateRecoveryCodeParams) error {
+	if err := d.userExists(arg.UserID); err != nil {
+		return err
+	}
+	if _, ok := d.recoveryCodes[arg.CodeHash]; ok {
+		return ErrUniqueViolation
+	}
+
+	d.recoveryCodes[arg.CodeHash] = database.RecoveryCode{
+		CodeHash:  arg.CodeHash,
+		CreatedAt: now(),
+		UserID:    arg.UserID,
+	}
+	return nil
+}
+
+func (d *memoryData) DeleteRecoveryCodes(ctx context.Context, userID uuid.UUID) error {
+	maps.DeleteFunc(d.recoveryCodes, func(_ string, c database.RecoveryCode) bool { return c.UserID == userID })
+	return nil
+}
+
+func (d *memoryData) DeleteTOTP(ctx context.Context, userID uuid.UUID) error {
+	delete(d.totp, userID)
+	return nil
+}
+
+func (d *memoryData) EnableTOTP(ctx context.Context, arg database.EnableTOTPParams) error {
+	totp, ok := d.totp[arg.UserID]
+	if !ok {
+		return nil
+	}
+
+	totp.Enabled = true
+	totp.LastStep = arg.LastStep
+	totp.UpdatedAt = now()
+	d.totp[arg.UserID] = totp
+	return nil
+}
+
+func (d *memoryData) GetTOTPForUser(ctx context.Context, userID uuid.UUID) (database.UserTotp, error) {
+	totp, ok := d.totp[userID]
+	if !ok {
+		return database.UserTotp{}, sql.ErrNoRows
+	}
+	return totp, nil
+}
+
+// StartTOTPEnrolment replaces an unconfirmed secret but, like the upsert it
+// stands in for, returns sql.ErrNoRows rather than touch an enabled one.
+func (d *memoryData) StartTOTPEnrolment(ctx context.Context, arg database.StartTOTPEnrolmentParams) (database.UserTotp, error) {
+	if err := d.userExists(arg.UserID); err != nil {
+		return database.UserTotp{}, err
+	}
+
+	t := now()
+	totp, ok := d.totp[arg.UserID]
+	switch {
+	case !ok:
+		totp = database.UserTotp{UserID: arg.UserID, CreatedAt: t}
+	case totp.Enabled:
+		return database.UserTotp{}, sql.ErrNoRows
+	}
+
+	totp.Secret = arg.Secret
+	totp.LastStep = 0
+	totp.UpdatedAt = t
+	d.totp[arg.UserID] = totp
+	return totp, nil
+}
+
+func (d *memoryData) UseRecoveryCode(ctx context.Context, arg database.UseRecoveryCodeParams) (int64, error) {
+	code, ok := d.recoveryCodes[arg.CodeHash]
+	if !ok || code.UserID != arg.UserID || code.UsedAt.Valid {
+		return 0, nil
+	}
+
+	code.UsedAt = sql.NullTime{Time: now(), Valid: true}
+	d.recoveryCodes[arg.CodeHash] = code
+	return 1, nil
+}
+
+func (d *memoryData) UseTOTPStep(ctx context.Context, arg database.UseTOTPStepParams) (int64, error) {
+	totp, ok := d.totp[arg.UserID]
+	if !ok || totp.LastStep >= arg.LastStep {
+		return 0, nil
+	}
+
+	totp.LastStep = arg.LastStep
+	totp.UpdatedAt = now()
+	d.totp[arg.UserID] = totp
+	return 1, nil
+}
+
+// usableUserToken returns the token if it exists, is for purpose, and has
+// been neither used nor left to expire.
+func (d *memoryData) usableUserToken(tokenHash, purpose string) (database.UserToken, bool) {
+	token, ok := d.userTokens[tokenHash]
+	if !ok || token.Purpose != purpose || token.UsedAt.Valid || !token.ExpiresAt.After(time.Now()) {
+		return database.UserToken{}, false
+	}
+	return token, true
+}
+
+func (d *memoryData) ConsumeUserToken(ctx context.Context, arg database.ConsumeUserTokenParams) (database.UserToken, error) {
+	token, ok := d.usableUserToken(arg.TokenHash, arg.Purpose)
+	if !ok {
+		return database.UserToken{}, sql.ErrNoRows
+	}
+
+	token.UsedAt = sql.NullTime{Time: now(), Valid: true}
+	d.userTokens[arg.TokenHash] = token
+	return token, nil
+}
+
+func (d *memoryData) CreateUserToken(ctx context.Context, arg database.CreateUserTokenParams) error {
+	if err := d.userExists(arg.UserID); err != nil {
+		return err
+	}
+	if _, ok := d.userTokens[arg.TokenHash]; ok {
+		return ErrUniqueViolation
+	}
+
+	d.userTokens[arg.TokenHash] = database.UserToken{
+		TokenHash: arg.TokenHash,
+		CreatedAt: now(),
+		UserID:    arg.UserID,
+		Purpose:   arg.Purpose,
+		Email:     arg.Email,
+		ExpiresAt: arg.ExpiresAt,
+	}
+	return nil
+}
+
+func (d *memoryData) GetUserToken(ctx context.Context, arg database.GetUserTokenParams) (database.UserToken, error) {
+	token, ok := d.usableUserToken(arg.TokenHash, arg.Purpose)
+	if !ok {
+		return database.UserToken{}, sql.ErrNoRows
+	}
+	return token, nil
+}
+
+func (d *memoryData) CompleteDataExport(ctx context.Context, arg database.CompleteDataExportParams) error {
+	export, ok := d.dataExports[arg.ID]
+	if !ok {
+		return nil
+	}
+
+	t := now()
+	export.Status = "ready"
+	export.Archive = arg.Archive
+	export.CompletedAt = sql.NullTime{Time: t, Valid: true}
+	export.ExpiresAt = arg.ExpiresAt
+	export.UpdatedAt = t
+	d.dataExports[arg.ID] = export
+	return nil
+}
+
+func (d *memoryData) CreateDataExport(ctx context.Context, userID uuid.UUID) (database.DataExport, error) {
+	if err := d.userExists(userID); err != nil {
+		return database.DataExport{}, err
+	}
+
+	t := now()
+	export := database.DataExport{
+		ID:        uuid.New(),
+		CreatedAt: t,
+		UpdatedAt: t,
+		UserID:    userID,
+		Status:    "pending",
+	}
+	d.dataExports[export.ID] = export
+	return export, nil
+}
+
+func (d *memoryData) DeleteDataExportsForUser(ctx context.Context, userID uuid.UUID) error {
+	maps.DeleteFunc(d.dataExports, func(_ uuid.UUID, e database.DataExport) bool { return e.UserID == userID })
+	return nil
+}
+
+func (d *memoryData) DeleteExpiredDataExports(ctx context.Context, expiresAt sql.NullTime) (int64, error) {
+	if !expiresAt.Valid {
+		return 0, nil
+	}
+
+	var deleted int64
+	for id, export := range d.dataExports {
+		if export.ExpiresAt.Valid && export.ExpiresAt.Time.Before(expiresAt.Time) {
+			delete(d.dataExports, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (d *memoryData) FailDataExport(ctx context.Context, id uuid.UUID) error {
+	export, ok := d.dataExports[id]
+	if !ok {
+		return nil
+	}
+
+	export.Status = "failed"
+	export.UpdatedAt = now()
+	d.dataExports[id] = export
+	return nil
+}
+
+func (d *memoryData) FailStaleDataExports(ctx context.Context, createdAt time.Time) (int64, error) {
+	t := now()
+	var failed int64
+	for id, export := range d.dataExports {
+		if export.Status == "pending" && export.CreatedAt.Before(createdAt) {
+			export.Status = "failed"
+			export.UpdatedAt = t
+			d.dataExports[id] = export
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+func (d *memoryData) GetDataExport(ctx context.Context, arg database.GetDataExportParams) (database.DataExport, error) {
+	export, ok := d.dataExports[arg.ID]
+	if !ok || export.UserID != arg.UserID {
+		return database.DataExport{}, sql.ErrNoRows
+	}
+	return export, nil
+}
+
+func (d *memoryData) ImportChirp(ctx context.Context, arg database.ImportChirpParams) (int64, error) {
+	if _, ok := d.chirps[arg.ID]; ok {
+		return 0, nil
+	}
+	if err := d.userExists(arg.UserID); err != nil {
+		return 0, err
+	}
+
+	d.chirps[arg.ID] = database.Chirp{
+		ID:        arg.ID,
+		CreatedAt: arg.CreatedAt,
+		UpdatedAt: arg.CreatedAt,
+		Body:      arg.Body,
+		UserID:    arg.UserID,
+	}
+	return 1, nil
+}
+
+func (d *memoryData) ImportUser(ctx context.Context, arg database.ImportUserParams) (int64, error) {
+	if _, ok := d.users[arg.ID]; ok || d.emailTaken(arg.Email, uuid.Nil) {
+		return 0, nil
+	}
+
+	d.users[arg.ID] = database.User{
+		ID:             arg.ID,
+		CreatedAt:      arg.CreatedAt,
+		UpdatedAt:      arg.CreatedAt,
+		Email:          arg.Email,
+		HashedPassword: arg.HashedPassword,
+	}
+	return 1, nil
+}
@@ -0,0 +1,382 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+)
+
+func TestMemoryUsers(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("create and look up", func(t *testing.T) {
+		m := NewMemory()
+		user, err := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com", HashedPassword: "hash"})
+		if err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+
+		byEmail, err := m.GetUser(ctx, "walt@example.com")
+		if err != nil {
+			t.Fatalf("Error getting user by email: %v", err)
+		}
+		byID, err := m.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("Error getting user by ID: %v", err)
+		}
+		if byEmail != user || byID != user {
+			t.Errorf("Got %+v and %+v, want %+v", byEmail, byID, user)
+		}
+	})
+
+	t.Run("missing users are sql.ErrNoRows", func(t *testing.T) {
+		m := NewMemory()
+		if _, err := m.GetUser(ctx, "nobody@example.com"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Got %v, want sql.ErrNoRows", err)
+		}
+		if _, err := m.GetUserByID(ctx, uuid.New()); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Got %v, want sql.ErrNoRows", err)
+		}
+	})
+
+	t.Run("emails are unique", func(t *testing.T) {
+		m := NewMemory()
+		if _, err := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"}); err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+		other, err := m.CreateUser(ctx, database.CreateUserParams{Email: "jesse@example.com"})
+		if err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+
+		_, err = m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"})
+		if !IsUniqueViolation(err) {
+			t.Errorf("Creating a duplicate: got %v, want a unique violation", err)
+		}
+		_, err = m.PatchUser(ctx, database.PatchUserParams{
+			ID:    other.ID,
+			Email: sql.NullString{String: "walt@example.com", Valid: true},
+		})
+		if !IsUniqueViolation(err) {
+			t.Errorf("Patching to a taken email: got %v, want a unique violation", err)
+		}
+	})
+
+	t.Run("changing email clears verification", func(t *testing.T) {
+		m := NewMemory()
+		user, _ := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"})
+		if n, err := m.MarkEmailVerified(ctx, database.MarkEmailVerifiedParams{ID: user.ID, Email: user.Email}); err != nil || n != 1 {
+			t.Fatalf("Marking verified: got %d, %v", n, err)
+		}
+
+		patched, err := m.PatchUser(ctx, database.PatchUserParams{
+			ID:    user.ID,
+			Email: sql.NullString{String: "heisenberg@example.com", Valid: true},
+		})
+		if err != nil {
+			t.Fatalf("Error patching user: %v", err)
+		}
+		if patched.EmailVerifiedAt.Valid {
+			t.Error("Expected the new email to be unverified")
+		}
+	})
+
+	t.Run("deletion and restore", func(t *testing.T) {
+		m := NewMemory()
+		user, _ := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"})
+
+		if _, err := m.RequestUserDeletion(ctx, user.ID); err != nil {
+			t.Fatalf("Error requesting deletion: %v", err)
+		}
+		if _, err := m.RequestUserDeletion(ctx, user.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Requesting deletion twice: got %v, want sql.ErrNoRows", err)
+		}
+		if n, _ := m.CancelUserDeletion(ctx, user.ID); n != 1 {
+			t.Errorf("Got %d restored, want 1", n)
+		}
+		if n, _ := m.CancelUserDeletion(ctx, user.ID); n != 0 {
+			t.Errorf("Restoring twice: got %d restored, want 0", n)
+		}
+	})
+
+	t.Run("purge takes everything the user owns", func(t *testing.T) {
+		m := NewMemory()
+		user, _ := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"})
+		chirp, _ := m.CreateChirp(ctx, database.CreateChirpParams{Body: "say my name", UserID: user.ID})
+		m.CreateRefreshtoken(ctx, database.CreateRefreshtokenParams{Token: "token", UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)})
+		m.RequestUserDeletion(ctx, user.ID)
+
+		cutoff := sql.NullTime{Time: time.Now().Add(time.Minute), Valid: true}
+		if n, err := m.PurgeDeletedUsers(ctx, cutoff); err != nil || n != 1 {
+			t.Fatalf("Purging: got %d, %v", n, err)
+		}
+		if _, err := m.GetUserByID(ctx, user.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Got %v for the purged user, want sql.ErrNoRows", err)
+		}
+		if _, ok := m.data.chirps[chirp.ID]; ok {
+			t.Error("Expected the user's chirps to be purged")
+		}
+		if _, ok := m.data.refreshTokens["token"]; ok {
+			t.Error("Expected the user's refresh tokens to be purged")
+		}
+	})
+}
+
+func TestMemoryChirps(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	walt, _ := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"})
+	jesse, _ := m.CreateUser(ctx, database.CreateUserParams{Email: "jesse@example.com"})
+
+	var ids []uuid.UUID
+	for _, c := range []database.CreateChirpParams{
+		{Body: "first", UserID: walt.ID},
+		{Body: "second", UserID: jesse.ID},
+		{Body: "third", UserID: walt.ID},
+	} {
+		chirp, err := m.CreateChirp(ctx, c)
+		if err != nil {
+			t.Fatalf("Error creating chirp: %v", err)
+		}
+		ids = append(ids, chirp.ID)
+		// Chirps are ordered by creation time
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Run("unknown author", func(t *testing.T) {
+		if _, err := m.CreateChirp(ctx, database.CreateChirpParams{Body: "who?", UserID: uuid.New()}); err == nil {
+			t.Error("Expected an error for a chirp by an unknown user")
+		}
+	})
+
+	t.Run("listed oldest first", func(t *testing.T) {
+		chirps, err := m.GetAllChirps(ctx)
+		if err != nil {
+			t.Fatalf("Error listing chirps: %v", err)
+		}
+		if len(chirps) != 3 {
+			t.Fatalf("Got %d chirps, want 3", len(chirps))
+		}
+		for i, chirp := range chirps {
+			if chirp.ID != ids[i] {
+				t.Errorf("Chirp %d is %q, want %s", i, chirp.Body, ids[i])
+			}
+		}
+
+		mine, _ := m.GetChirpsForUser(ctx, walt.ID)
+		if len(mine) != 2 || mine[0].Body != "first" || mine[1].Body != "third" {
+			t.Errorf("Got %+v for walt, want first and third", mine)
+		}
+	})
+
+	t.Run("authors pending deletion are hidden", func(t *testing.T) {
+		m.RequestUserDeletion(ctx, jesse.ID)
+		defer m.CancelUserDeletion(ctx, jesse.ID)
+
+		chirps, _ := m.GetAllChirps(ctx)
+		if len(chirps) != 2 {
+			t.Errorf("Got %d chirps, want 2", len(chirps))
+		}
+		if _, err := m.GetOneChirp(ctx, ids[1]); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Got %v for a hidden chirp, want sql.ErrNoRows", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := m.DeleteOneChirp(ctx, ids[0]); err != nil {
+			t.Fatalf("Error deleting chirp: %v", err)
+		}
+		if _, err := m.GetOneChirp(ctx, ids[0]); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Got %v for a deleted chirp, want sql.ErrNoRows", err)
+		}
+	})
+}
+
+func TestMemoryRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	user, _ := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"})
+	expires := time.Now().Add(time.Hour)
+
+	for _, token := range []string{"one", "two"} {
+		if _, err := m.CreateRefreshtoken(ctx, database.CreateRefreshtokenParams{Token: token, UserID: user.ID, ExpiresAt: expires}); err != nil {
+			t.Fatalf("Error creating refresh token: %v", err)
+		}
+	}
+	expired := database.CreateRefreshtokenParams{Token: "old", UserID: user.ID, ExpiresAt: time.Now().Add(-time.Minute)}
+	if _, err := m.CreateRefreshtoken(ctx, expired); err != nil {
+		t.Fatalf("Error creating refresh token: %v", err)
+	}
+
+	if got, err := m.GetUserFromRefreshToken(ctx, "one"); err != nil || got.ID != user.ID {
+		t.Errorf("Got %v, %v for a valid token, want the user", got.ID, err)
+	}
+	if _, err := m.GetUserFromRefreshToken(ctx, "old"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Got %v for an expired token, want sql.ErrNoRows", err)
+	}
+
+	m.RevokeRefreshToken(ctx, "one")
+	if _, err := m.GetUserFromRefreshToken(ctx, "one"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Got %v for a revoked token, want sql.ErrNoRows", err)
+	}
+	if _, err := m.GetUserFromRefreshToken(ctx, "two"); err != nil {
+		t.Errorf("Revoking one token revoked another: %v", err)
+	}
+
+	m.RevokeAllRefreshTokensForUser(ctx, user.ID)
+	if _, err := m.GetUserFromRefreshToken(ctx, "two"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Got %v after revoking every token, want sql.ErrNoRows", err)
+	}
+
+	sessions, _ := m.GetSessionsForUser(ctx, user.ID)
+	if len(sessions) != 3 {
+		t.Errorf("Got %d sessions, want 3", len(sessions))
+	}
+}
+
+func TestMemoryAtomic(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	user, _ := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"})
+
+	t.Run("failure discards every write", func(t *testing.T) {
+		errBoom := errors.New("boom")
+		err := m.Atomic(ctx, func(q Queries) error {
+			if _, err := q.CreateChirp(ctx, database.CreateChirpParams{Body: "lost", UserID: user.ID}); err != nil {
+				return err
+			}
+			if _, err := q.CreateUser(ctx, database.CreateUserParams{Email: "jesse@example.com"}); err != nil {
+				return err
+			}
+			return errBoom
+		})
+		if !errors.Is(err, errBoom) {
+			t.Fatalf("Got %v, want the error from fn", err)
+		}
+
+		if chirps, _ := m.GetAllChirps(ctx); len(chirps) != 0 {
+			t.Errorf("Got %d chirps, want none", len(chirps))
+		}
+		if _, err := m.GetUser(ctx, "jesse@example.com"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Got %v, want the user not to exist", err)
+		}
+	})
+
+	t.Run("success keeps every write", func(t *testing.T) {
+		err := m.Atomic(ctx, func(q Queries) error {
+			_, err := q.CreateChirp(ctx, database.CreateChirpParams{Body: "kept", UserID: user.ID})
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Error in Atomic: %v", err)
+		}
+		if chirps, _ := m.GetAllChirps(ctx); len(chirps) != 1 {
+			t.Errorf("Got %d chirps, want 1", len(chirps))
+		}
+	})
+}
+
+func TestMemoryAccounts(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("login failures reset after the window", func(t *testing.T) {
+		m := NewMemory()
+		start := time.Now()
+		record := func(at time.Time) int32 {
+			failure, err := m.RecordLoginFailure(ctx, database.RecordLoginFailureParams{
+				Key:         "ip:203.0.113.7",
+				FailedAt:    at,
+				WindowStart: at.Add(-time.Hour),
+			})
+			if err != nil {
+				t.Fatalf("Error recording failure: %v", err)
+			}
+			return failure.Failures
+		}
+
+		record(start)
+		if n := record(start.Add(time.Minute)); n != 2 {
+			t.Errorf("Got %d failures, want 2", n)
+		}
+		if n := record(start.Add(3 * time.Hour)); n != 1 {
+			t.Errorf("Got %d failures after the window, want 1", n)
+		}
+	})
+
+	t.Run("enabled TOTP can't be replaced", func(t *testing.T) {
+		m := NewMemory()
+		user, _ := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"})
+		m.StartTOTPEnrolment(ctx, database.StartTOTPEnrolmentParams{UserID: user.ID, Secret: "first"})
+		m.EnableTOTP(ctx, database.EnableTOTPParams{UserID: user.ID, LastStep: 10})
+
+		_, err := m.StartTOTPEnrolment(ctx, database.StartTOTPEnrolmentParams{UserID: user.ID, Secret: "second"})
+		if !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Got %v, want sql.ErrNoRows", err)
+		}
+		if n, _ := m.UseTOTPStep(ctx, database.UseTOTPStepParams{UserID: user.ID, LastStep: 10}); n != 0 {
+			t.Error("Expected a used step to be refused")
+		}
+		if n, _ := m.UseTOTPStep(ctx, database.UseTOTPStepParams{UserID: user.ID, LastStep: 11}); n != 1 {
+			t.Error("Expected a later step to be accepted")
+		}
+	})
+
+	t.Run("user tokens are single use", func(t *testing.T) {
+		m := NewMemory()
+		user, _ := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"})
+		m.CreateUserToken(ctx, database.CreateUserTokenParams{
+			TokenHash: "hash",
+			UserID:    user.ID,
+			Purpose:   "verify_email",
+			Email:     user.Email,
+			ExpiresAt: time.Now().Add(time.Hour),
+		})
+
+		if _, err := m.GetUserToken(ctx, database.GetUserTokenParams{TokenHash: "hash", Purpose: "reset_password"}); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Got %v for the wrong purpose, want sql.ErrNoRows", err)
+		}
+		consume := database.ConsumeUserTokenParams{TokenHash: "hash", Purpose: "verify_email"}
+		if _, err := m.ConsumeUserToken(ctx, consume); err != nil {
+			t.Fatalf("Error consuming token: %v", err)
+		}
+		if _, err := m.ConsumeUserToken(ctx, consume); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Got %v consuming twice, want sql.ErrNoRows", err)
+		}
+	})
+
+	t.Run("keys of users pending deletion don't work", func(t *testing.T) {
+		m := NewMemory()
+		user, _ := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"})
+		m.CreateAPIKey(ctx, database.CreateAPIKeyParams{UserID: user.ID, Name: "bot", KeyHash: "hash"})
+
+		if _, err := m.GetAPIKeyByHash(ctx, "hash"); err != nil {
+			t.Fatalf("Error getting key: %v", err)
+		}
+		m.RequestUserDeletion(ctx, user.ID)
+		if _, err := m.GetAPIKeyByHash(ctx, "hash"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Got %v, want sql.ErrNoRows", err)
+		}
+	})
+
+	t.Run("purge takes the user's account data", func(t *testing.T) {
+		m := NewMemory()
+		user, _ := m.CreateUser(ctx, database.CreateUserParams{Email: "walt@example.com"})
+		client, _ := m.CreateOAuthClient(ctx, database.CreateOAuthClientParams{UserID: user.ID, Name: "app"})
+		m.CreateOAuthCode(ctx, database.CreateOAuthCodeParams{CodeHash: "code", ClientID: client.ID, UserID: user.ID, ExpiresAt: time.Now().Add(time.Minute)})
+		m.CreateAPIKey(ctx, database.CreateAPIKeyParams{UserID: user.ID, Name: "bot", KeyHash: "hash"})
+		m.CreateRecoveryCode(ctx, database.CreateRecoveryCodeParams{CodeHash: "recovery", UserID: user.ID})
+		m.CreateDataExport(ctx, user.ID)
+		m.RequestUserDeletion(ctx, user.ID)
+
+		m.PurgeDeletedUsers(ctx, sql.NullTime{Time: time.Now().Add(time.Minute), Valid: true})
+		d := m.data
+		if n := len(d.oauthClients) + len(d.oauthCodes) + len(d.apiKeys) + len(d.recoveryCodes) + len(d.dataExports); n != 0 {
+			t.Errorf("Got %d rows left behind, want none", n)
+		}
+	})
+}
@@ -0,0 +1,395 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/tracing"
+)
+
+// SQLite stores everything in a single file, for deployments too small to
+// be worth running Postgres. Its schema lives in sql/sqlite/schema and
+// mirrors sql/schema.
+//
+// SQLite has no UUID or timestamp types, so IDs are generated here and
+// stored as text, and timestamps are written as UTC text in one fixed
+// format so that comparing them as strings compares them as times.
+type SQLite struct {
+	*sqliteQueries
+	db *sql.DB
+}
+
+// OpenSQLite opens the database named by a sqlite: URL, such as
+// sqlite:chirpy.db or sqlite:///var/lib/chirpy/chirpy.db, with the settings
+// SQLite needs.
+func OpenSQLite(dbURL string) (*sql.DB, error) {
+	path, ok := strings.CutPrefix(dbURL, "sqlite:")
+	if !ok {
+		return nil, fmt.Errorf("not a sqlite: URL")
+	}
+	path = strings.TrimPrefix(path, "//")
+	path, rawQuery, _ := strings.Cut(path, "?")
+	if path == "" {
+		return nil, fmt.Errorf("sqlite: URL has no file path")
+	}
+
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse sqlite: URL: %w", err)
+	}
+	// ON DELETE CASCADE is off unless foreign keys are switched on for
+	// every connection
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Set("_time_format", "sqlite")
+	// Take the write lock up front, so two transactions that both read and
+	// then write can't deadlock
+	params.Set("_txlock", "immediate")
+
+	return sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+}
+
+func NewSQLite(db *sql.DB) *SQLite {
+	return &SQLite{sqliteQueries: &sqliteQueries{db: tracing.WrapDB(db, "sqlite")}, db: db}
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLite) Atomic(ctx context.Context, fn func(q Queries) error) error {
+	return retry(ctx, func() error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := fn(&sqliteQueries{db: tracing.WrapDB(tx, "sqlite")}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// sqliteQueries runs the SQLite versions of the queries in chirps.sql,
+// users.sql and refresh_token.sql, on the database or a transaction. The
+// rest are in sqlite_accounts.go.
+type sqliteQueries struct {
+	db database.DBTX
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+const sqliteUserColumns = `users.id, users.created_at, users.updated_at, users.email, users.hashed_password, users.email_verified_at, users.deletion_requested_at`
+
+func scanUser(row rowScanner) (database.User, error) {
+	var i database.User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.EmailVerifiedAt,
+		&i.DeletionRequestedAt,
+	)
+	return i, err
+}
+
+const sqliteChirpColumns = `chirps.id, chirps.created_at, chirps.updated_at, chirps.body, chirps.user_id`
+
+func scanChirp(row rowScanner) (database.Chirp, error) {
+	var i database.Chirp
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Body,
+		&i.UserID,
+	)
+	return i, err
+}
+
+func (q *sqliteQueries) queryChirps(ctx context.Context, query string, args ...any) ([]database.Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []database.Chirp
+	for rows.Next() {
+		i, err := scanChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (q *sqliteQueries) execRows(ctx context.Context, query string, args ...any) (int64, error) {
+	result, err := q.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const sqliteCreateChirp = `
+INSERT INTO chirps (id, created_at, updated_at, body, user_id)
+VALUES (?1, ?2, ?2, ?3, ?4)
+RETURNING ` + sqliteChirpColumns
+
+func (q *sqliteQueries) CreateChirp(ctx context.Context, arg database.CreateChirpParams) (database.Chirp, error) {
+	row := q.db.QueryRowContext(ctx, sqliteCreateChirp, uuid.New(), now(), arg.Body, arg.UserID)
+	return scanChirp(row)
+}
+
+const sqliteDeleteOneChirp = `
+DELETE FROM chirps
+WHERE id = ?1`
+
+func (q *sqliteQueries) DeleteOneChirp(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, sqliteDeleteOneChirp, id)
+	return err
+}
+
+const sqliteGetAllChirps = `
+SELECT ` + sqliteChirpColumns + ` FROM chirps
+JOIN users ON users.id = chirps.user_id
+WHERE users.deletion_requested_at IS NULL
+ORDER BY chirps.created_at ASC`
+
+func (q *sqliteQueries) GetAllChirps(ctx context.Context) ([]database.Chirp, error) {
+	return q.queryChirps(ctx, sqliteGetAllChirps)
+}
+
+const sqliteGetChirpsForUser = `
+SELECT ` + sqliteChirpColumns + ` FROM chirps
+WHERE user_id = ?1
+ORDER BY created_at ASC`
+
+func (q *sqliteQueries) GetChirpsForUser(ctx context.Context, userID uuid.UUID) ([]database.Chirp, error) {
+	return q.queryChirps(ctx, sqliteGetChirpsForUser, userID)
+}
+
+const sqliteGetOneChirp = `
+SELECT ` + sqliteChirpColumns + ` FROM chirps
+JOIN users ON users.id = chirps.user_id
+WHERE chirps.id = ?1
+AND users.deletion_requested_at IS NULL`
+
+func (q *sqliteQueries) GetOneChirp(ctx context.Context, id uuid.UUID) (database.Chirp, error) {
+	return scanChirp(q.db.QueryRowContext(ctx, sqliteGetOneChirp, id))
+}
+
+const sqliteCancelUserDeletion = `
+UPDATE users
+SET deletion_requested_at = NULL,
+    updated_at = ?2
+WHERE id = ?1
+AND deletion_requested_at IS NOT NULL`
+
+func (q *sqliteQueries) CancelUserDeletion(ctx context.Context, id uuid.UUID) (int64, error) {
+	return q.execRows(ctx, sqliteCancelUserDeletion, id, now())
+}
+
+const sqliteCreateUser = `
+INSERT INTO users (id, created_at, updated_at, email, hashed_password)
+VALUES (?1, ?2, ?2, ?3, ?4)
+RETURNING ` + sqliteUserColumns
+
+func (q *sqliteQueries) CreateUser(ctx context.Context, arg database.CreateUserParams) (database.User, error) {
+	row := q.db.QueryRowContext(ctx, sqliteCreateUser, uuid.New(), now(), arg.Email, arg.HashedPassword)
+	return scanUser(row)
+}
+
+const sqliteDeleteAllUsers = `
+DELETE FROM users`
+
+func (q *sqliteQueries) DeleteAllUsers(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, sqliteDeleteAllUsers)
+	return err
+}
+
+const sqliteGetUser = `
+SELECT ` + sqliteUserColumns + ` FROM users
+WHERE email = ?1`
+
+func (q *sqliteQueries) GetUser(ctx context.Context, email string) (database.User, error) {
+	return scanUser(q.db.QueryRowContext(ctx, sqliteGetUser, email))
+}
+
+const sqliteGetUserByID = `
+SELECT ` + sqliteUserColumns + ` FROM users
+WHERE id = ?1`
+
+func (q *sqliteQueries) GetUserByID(ctx context.Context, id uuid.UUID) (database.User, error) {
+	return scanUser(q.db.QueryRowContext(ctx, sqliteGetUserByID, id))
+}
+
+const sqliteMarkEmailVerified = `
+UPDATE users
+SET email_verified_at = ?3,
+    updated_at = ?3
+WHERE id = ?1
+AND email = ?2`
+
+func (q *sqliteQueries) MarkEmailVerified(ctx context.Context, arg database.MarkEmailVerifiedParams) (int64, error) {
+	return q.execRows(ctx, sqliteMarkEmailVerified, arg.ID, arg.Email, now())
+}
+
+const sqlitePatchUser = `
+UPDATE users
+SET email = COALESCE(?1, email),
+    hashed_password = COALESCE(?2, hashed_password),
+    email_verified_at = CASE
+        WHEN ?1 IS NULL OR ?1 = email THEN email_verified_at
+        ELSE NULL
+    END,
+    updated_at = ?4
+WHERE id = ?3
+RETURNING ` + sqliteUserColumns
+
+func (q *sqliteQueries) PatchUser(ctx context.Context, arg database.PatchUserParams) (database.User, error) {
+	row := q.db.QueryRowContext(ctx, sqlitePatchUser, arg.Email, arg.HashedPassword, arg.ID, now())
+	return scanUser(row)
+}
+
+const sqlitePurgeDeletedUsers = `
+DELETE FROM users
+WHERE deletion_requested_at < ?1`
+
+func (q *sqliteQueries) PurgeDeletedUsers(ctx context.Context, deletionRequestedAt sql.NullTime) (int64, error) {
+	return q.execRows(ctx, sqlitePurgeDeletedUsers, nullUTC(deletionRequestedAt))
+}
+
+const sqliteRehashUserPassword = `
+UPDATE users
+SET hashed_password = ?1
+WHERE id = ?2
+AND hashed_password = ?3`
+
+func (q *sqliteQueries) RehashUserPassword(ctx context.Context, arg database.RehashUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, sqliteRehashUserPassword, arg.NewHash, arg.ID, arg.OldHash)
+	return err
+}
+
+const sqliteRequestUserDeletion = `
+UPDATE users
+SET deletion_requested_at = ?2,
+    updated_at = ?2
+WHERE id = ?1
+AND deletion_requested_at IS NULL
+RETURNING ` + sqliteUserColumns
+
+func (q *sqliteQueries) RequestUserDeletion(ctx context.Context, id uuid.UUID) (database.User, error) {
+	return scanUser(q.db.QueryRowContext(ctx, sqliteRequestUserDeletion, id, now()))
+}
+
+const sqliteUpdateUserPassword = `
+UPDATE users
+SET hashed_password = ?2,
+    updated_at = ?3
+WHERE id = ?1`
+
+func (q *sqliteQueries) UpdateUserPassword(ctx context.Context, arg database.UpdateUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, sqliteUpdateUserPassword, arg.ID, arg.HashedPassword, now())
+	return err
+}
+
+const sqliteCreateRefreshtoken = `
+INSERT INTO refresh_tokens (token, user_id, expires_at, created_at, updated_at, revoked_at)
+VALUES (?1, ?2, ?3, ?4, ?4, NULL)
+RETURNING token, created_at, updated_at, user_id, expires_at, revoked_at`
+
+func (q *sqliteQueries) CreateRefreshtoken(ctx context.Context, arg database.CreateRefreshtokenParams) (database.RefreshToken, error) {
+	row := q.db.QueryRowContext(ctx, sqliteCreateRefreshtoken, arg.Token, arg.UserID, arg.ExpiresAt.UTC(), now())
+	var i database.RefreshToken
+	err := row.Scan(
+		&i.Token,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.UserID,
+		&i.ExpiresAt,
+		&i.RevokedAt,
+	)
+	return i, err
+}
+
+const sqliteGetSessionsForUser = `
+SELECT created_at, expires_at, revoked_at FROM refresh_tokens
+WHERE user_id = ?1
+ORDER BY created_at ASC`
+
+func (q *sqliteQueries) GetSessionsForUser(ctx context.Context, userID uuid.UUID) ([]database.GetSessionsForUserRow, error) {
+	rows, err := q.db.QueryContext(ctx, sqliteGetSessionsForUser, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []database.GetSessionsForUserRow
+	for rows.Next() {
+		var i database.GetSessionsForUserRow
+		if err := rows.Scan(&i.CreatedAt, &i.ExpiresAt, &i.RevokedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const sqliteGetUserFromRefreshToken = `
+SELECT ` + sqliteUserColumns + ` FROM users
+JOIN refresh_tokens ON users.id = refresh_tokens.user_id
+WHERE refresh_tokens.token = ?1
+AND refresh_tokens.expires_at > ?2
+AND refresh_tokens.revoked_at IS NULL`
+
+func (q *sqliteQueries) GetUserFromRefreshToken(ctx context.Context, token string) (database.User, error) {
+	return scanUser(q.db.QueryRowContext(ctx, sqliteGetUserFromRefreshToken, token, now()))
+}
+
+const sqliteRevokeRefreshToken = `
+UPDATE refresh_tokens
+SET revoked_at = ?2,
+    updated_at = ?2
+WHERE token = ?1`
+
+func (q *sqliteQueries) RevokeRefreshToken(ctx context.Context, token string) error {
+	_, err := q.db.ExecContext(ctx, sqliteRevokeRefreshToken, token, now())
+	return err
+}
+
+const sqliteRevokeAllRefreshTokensForUser = `
+UPDATE refresh_tokens
+SET revoked_at = ?2,
+    updated_at = ?2
+WHERE user_id = ?1
+AND revoked_at IS NULL`
+
+func (q *sqliteQueries) RevokeAllRefreshTokensForUser(ctx context.Context, userID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, sqliteRevokeAllRefreshTokensForUser, userID, now())
+	return err
+}
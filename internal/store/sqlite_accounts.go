@@ -0,0 +1,532 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+)
+
+// The SQLite versions of the queries in api_keys.sql, login_failures.sql,
+// oauth.sql, totp.sql, user_tokens.sql, data_exports.sql and import.sql.
+
+// queryRows runs a query that returns many rows and scans each with scan.
+func queryRows[T any](ctx context.Context, db database.DBTX, scan func(rowScanner) (T, error), query string, args ...any) ([]T, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []T
+	for rows.Next() {
+		i, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// nullUTC converts t to UTC, so it compares correctly with the stored text.
+func nullUTC(t sql.NullTime) sql.NullTime {
+	if t.Valid {
+		t.Time = t.Time.UTC()
+	}
+	return t
+}
+
+const sqliteAPIKeyColumns = `api_keys.id, api_keys.created_at, api_keys.updated_at, api_keys.user_id, api_keys.name, api_keys.prefix, api_keys.key_hash, api_keys.scopes, api_keys.expires_at, api_keys.last_used_at`
+
+func scanAPIKey(row rowScanner) (database.ApiKey, error) {
+	var i database.ApiKey
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.UserID,
+		&i.Name,
+		&i.Prefix,
+		&i.KeyHash,
+		&i.Scopes,
+		&i.ExpiresAt,
+		&i.LastUsedAt,
+	)
+	return i, err
+}
+
+const sqliteCreateAPIKey = `
+INSERT INTO api_keys (id, created_at, updated_at, user_id, name, prefix, key_hash, scopes, expires_at)
+VALUES (?1, ?2, ?2, ?3, ?4, ?5, ?6, ?7, ?8)
+RETURNING ` + sqliteAPIKeyColumns
+
+func (q *sqliteQueries) CreateAPIKey(ctx context.Context, arg database.CreateAPIKeyParams) (database.ApiKey, error) {
+	row := q.db.QueryRowContext(ctx, sqliteCreateAPIKey,
+		uuid.New(),
+		now(),
+		arg.UserID,
+		arg.Name,
+		arg.Prefix,
+		arg.KeyHash,
+		arg.Scopes,
+		nullUTC(arg.ExpiresAt),
+	)
+	return scanAPIKey(row)
+}
+
+const sqliteDeleteAPIKey = `
+DELETE FROM api_keys
+WHERE id = ?1 AND user_id = ?2`
+
+func (q *sqliteQueries) DeleteAPIKey(ctx context.Context, arg database.DeleteAPIKeyParams) (int64, error) {
+	return q.execRows(ctx, sqliteDeleteAPIKey, arg.ID, arg.UserID)
+}
+
+const sqliteGetAPIKeyByHash = `
+SELECT ` + sqliteAPIKeyColumns + ` FROM api_keys
+JOIN users ON users.id = api_keys.user_id
+WHERE api_keys.key_hash = ?1
+AND users.deletion_requested_at IS NULL`
+
+func (q *sqliteQueries) GetAPIKeyByHash(ctx context.Context, keyHash string) (database.ApiKey, error) {
+	return scanAPIKey(q.db.QueryRowContext(ctx, sqliteGetAPIKeyByHash, keyHash))
+}
+
+const sqliteGetAPIKeysForUser = `
+SELECT ` + sqliteAPIKeyColumns + ` FROM api_keys
+WHERE user_id = ?1
+ORDER BY created_at ASC`
+
+func (q *sqliteQueries) GetAPIKeysForUser(ctx context.Context, userID uuid.UUID) ([]database.ApiKey, error) {
+	return queryRows(ctx, q.db, scanAPIKey, sqliteGetAPIKeysForUser, userID)
+}
+
+const sqliteTouchAPIKey = `
+UPDATE api_keys
+SET last_used_at = ?2
+WHERE id = ?1`
+
+func (q *sqliteQueries) TouchAPIKey(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, sqliteTouchAPIKey, id, now())
+	return err
+}
+
+const sqliteLoginFailureColumns = `key, failures, last_failed_at, locked_until`
+
+func scanLoginFailure(row rowScanner) (database.LoginFailure, error) {
+	var i database.LoginFailure
+	err := row.Scan(
+		&i.Key,
+		&i.Failures,
+		&i.LastFailedAt,
+		&i.LockedUntil,
+	)
+	return i, err
+}
+
+const sqliteClearLoginFailures = `
+DELETE FROM login_failures
+WHERE key = ?1`
+
+func (q *sqliteQueries) ClearLoginFailures(ctx context.Context, key string) error {
+	_, err := q.db.ExecContext(ctx, sqliteClearLoginFailures, key)
+	return err
+}
+
+const sqliteGetLockedLogins = `
+SELECT ` + sqliteLoginFailureColumns + ` FROM login_failures
+WHERE locked_until > ?1
+ORDER BY locked_until DESC`
+
+func (q *sqliteQueries) GetLockedLogins(ctx context.Context, lockedUntil sql.NullTime) ([]database.LoginFailure, error) {
+	return queryRows(ctx, q.db, scanLoginFailure, sqliteGetLockedLogins, nullUTC(lockedUntil))
+}
+
+const sqliteGetLoginFailure = `
+SELECT ` + sqliteLoginFailureColumns + ` FROM login_failures
+WHERE key = ?1`
+
+func (q *sqliteQueries) GetLoginFailure(ctx context.Context, key string) (database.LoginFailure, error) {
+	return scanLoginFailure(q.db.QueryRowContext(ctx, sqliteGetLoginFailure, key))
+}
+
+const sqliteLockLogin = `
+UPDATE login_failures
+SET locked_until = ?2
+WHERE key = ?1`
+
+func (q *sqliteQueries) LockLogin(ctx context.Context, arg database.LockLoginParams) error {
+	_, err := q.db.ExecContext(ctx, sqliteLockLogin, arg.Key, nullUTC(arg.LockedUntil))
+	return err
+}
+
+const sqliteRecordLoginFailure = `
+INSERT INTO login_failures (key, failures, last_failed_at, locked_until)
+VALUES (?1, 1, ?2, NULL)
+ON CONFLICT (key) DO UPDATE
+SET failures = CASE
+        WHEN login_failures.last_failed_at < ?3 THEN 1
+        ELSE login_failures.failures + 1
+    END,
+    last_failed_at = ?2
+RETURNING ` + sqliteLoginFailureColumns
+
+func (q *sqliteQueries) RecordLoginFailure(ctx context.Context, arg database.RecordLoginFailureParams) (database.LoginFailure, error) {
+	row := q.db.QueryRowContext(ctx, sqliteRecordLoginFailure, arg.Key, arg.FailedAt.UTC(), arg.WindowStart.UTC())
+	return scanLoginFailure(row)
+}
+
+const sqliteOAuthCodeColumns = `code_hash, created_at, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at, used_at`
+
+const sqliteConsumeOAuthCode = `
+UPDATE oauth_codes
+SET used_at = ?2
+WHERE code_hash = ?1
+AND used_at IS NULL
+AND expires_at > ?2
+RETURNING ` + sqliteOAuthCodeColumns
+
+func (q *sqliteQueries) ConsumeOAuthCode(ctx context.Context, codeHash string) (database.OauthCode, error) {
+	row := q.db.QueryRowContext(ctx, sqliteConsumeOAuthCode, codeHash, now())
+	var i database.OauthCode
+	err := row.Scan(
+		&i.CodeHash,
+		&i.CreatedAt,
+		&i.ClientID,
+		&i.UserID,
+		&i.RedirectUri,
+		&i.Scopes,
+		&i.CodeChallenge,
+		&i.ExpiresAt,
+		&i.UsedAt,
+	)
+	return i, err
+}
+
+const sqliteOAuthClientColumns = `id, created_at, updated_at, user_id, name, secret_hash, redirect_uris`
+
+func scanOAuthClient(row rowScanner) (database.OauthClient, error) {
+	var i database.OauthClient
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.UserID,
+		&i.Name,
+		&i.SecretHash,
+		&i.RedirectUris,
+	)
+	return i, err
+}
+
+const sqliteCreateOAuthClient = `
+INSERT INTO oauth_clients (id, created_at, updated_at, user_id, name, secret_hash, redirect_uris)
+VALUES (?1, ?2, ?2, ?3, ?4, ?5, ?6)
+RETURNING ` + sqliteOAuthClientColumns
+
+func (q *sqliteQueries) CreateOAuthClient(ctx context.Context, arg database.CreateOAuthClientParams) (database.OauthClient, error) {
+	row := q.db.QueryRowContext(ctx, sqliteCreateOAuthClient,
+		uuid.New(),
+		now(),
+		arg.UserID,
+		arg.Name,
+		arg.SecretHash,
+		arg.RedirectUris,
+	)
+	return scanOAuthClient(row)
+}
+
+const sqliteCreateOAuthCode = `
+INSERT INTO oauth_codes (code_hash, created_at, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at, used_at)
+VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, NULL)`
+
+func (q *sqliteQueries) CreateOAuthCode(ctx context.Context, arg database.CreateOAuthCodeParams) error {
+	_, err := q.db.ExecContext(ctx, sqliteCreateOAuthCode,
+		arg.CodeHash,
+		now(),
+		arg.ClientID,
+		arg.UserID,
+		arg.RedirectUri,
+		arg.Scopes,
+		arg.CodeChallenge,
+		arg.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+const sqliteGetOAuthClient = `
+SELECT ` + sqliteOAuthClientColumns + ` FROM oauth_clients
+WHERE id = ?1`
+
+func (q *sqliteQueries) GetOAuthClient(ctx context.Context, id uuid.UUID) (database.OauthClient, error) {
+	return scanOAuthClient(q.db.QueryRowContext(ctx, sqliteGetOAuthClient, id))
+}
+
+const sqliteTOTPColumns = `user_id, created_at, updated_at, secret, enabled, last_step`
+
+func scanTOTP(row rowScanner) (database.UserTotp, error) {
+	var i database.UserTotp
+	err := row.Scan(
+		&i.UserID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Secret,
+		&i.Enabled,
+		&i.LastStep,
+	)
+	return i, err
+}
+
+const sqliteCreateRecoveryCode = `
+INSERT INTO recovery_codes (code_hash, created_at, user_id, used_at)
+VALUES (?1, ?2, ?3, NULL)`
+
+func (q *sqliteQueries) CreateRecoveryCode(ctx context.Context, arg database.CreateRecoveryCodeParams) error {
+	_, err := q.db.ExecContext(ctx, sqliteCreateRecoveryCode, arg.CodeHash, now(), arg.UserID)
+	return err
+}
+
+const sqliteDeleteRecoveryCodes = `
+DELETE FROM recovery_codes
+WHERE user_id = ?1`
+
+func (q *sqliteQueries) DeleteRecoveryCodes(ctx context.Context, userID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, sqliteDeleteRecoveryCodes, userID)
+	return err
+}
+
+const sqliteDeleteTOTP = `
+DELETE FROM user_totp
+WHERE user_id = ?1`
+
+func (q *sqliteQueries) DeleteTOTP(ctx context.Context, userID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, sqliteDeleteTOTP, userID)
+	return err
+}
+
+const sqliteEnableTOTP = `
+UPDATE user_totp
+SET enabled = TRUE,
+    last_step = ?2,
+    updated_at = ?3
+WHERE user_id = ?1`
+
+func (q *sqliteQueries) EnableTOTP(ctx context.Context, arg database.EnableTOTPParams) error {
+	_, err := q.db.ExecContext(ctx, sqliteEnableTOTP, arg.UserID, arg.LastStep, now())
+	return err
+}
+
+const sqliteGetTOTPForUser = `
+SELECT ` + sqliteTOTPColumns + ` FROM user_totp
+WHERE user_id = ?1`
+
+func (q *sqliteQueries) GetTOTPForUser(ctx context.Context, userID uuid.UUID) (database.UserTotp, error) {
+	return scanTOTP(q.db.QueryRowContext(ctx, sqliteGetTOTPForUser, userID))
+}
+
+const sqliteStartTOTPEnrolment = `
+INSERT INTO user_totp (user_id, created_at, updated_at, secret, enabled, last_step)
+VALUES (?1, ?3, ?3, ?2, FALSE, 0)
+ON CONFLICT (user_id) DO UPDATE
+SET secret = excluded.secret,
+    updated_at = ?3,
+    last_step = 0
+WHERE user_totp.enabled = FALSE
+RETURNING ` + sqliteTOTPColumns
+
+func (q *sqliteQueries) StartTOTPEnrolment(ctx context.Context, arg database.StartTOTPEnrolmentParams) (database.UserTotp, error) {
+	row := q.db.QueryRowContext(ctx, sqliteStartTOTPEnrolment, arg.UserID, arg.Secret, now())
+	return scanTOTP(row)
+}
+
+const sqliteUseRecoveryCode = `
+UPDATE recovery_codes
+SET used_at = ?3
+WHERE user_id = ?1
+AND code_hash = ?2
+AND used_at IS NULL`
+
+func (q *sqliteQueries) UseRecoveryCode(ctx context.Context, arg database.UseRecoveryCodeParams) (int64, error) {
+	return q.execRows(ctx, sqliteUseRecoveryCode, arg.UserID, arg.CodeHash, now())
+}
+
+const sqliteUseTOTPStep = `
+UPDATE user_totp
+SET last_step = ?2,
+    updated_at = ?3
+WHERE user_id = ?1
+AND last_step < ?2`
+
+func (q *sqliteQueries) UseTOTPStep(ctx context.Context, arg database.UseTOTPStepParams) (int64, error) {
+	return q.execRows(ctx, sqliteUseTOTPStep, arg.UserID, arg.LastStep, now())
+}
+
+const sqliteUserTokenColumns = `token_hash, created_at, user_id, purpose, email, expires_at, used_at`
+
+func scanUserToken(row rowScanner) (database.UserToken, error) {
+	var i database.UserToken
+	err := row.Scan(
+		&i.TokenHash,
+		&i.CreatedAt,
+		&i.UserID,
+		&i.Purpose,
+		&i.Email,
+		&i.ExpiresAt,
+		&i.UsedAt,
+	)
+	return i, err
+}
+
+const sqliteConsumeUserToken = `
+UPDATE user_tokens
+SET used_at = ?3
+WHERE token_hash = ?1
+AND purpose = ?2
+AND used_at IS NULL
+AND expires_at > ?3
+RETURNING ` + sqliteUserTokenColumns
+
+func (q *sqliteQueries) ConsumeUserToken(ctx context.Context, arg database.ConsumeUserTokenParams) (database.UserToken, error) {
+	return scanUserToken(q.db.QueryRowContext(ctx, sqliteConsumeUserToken, arg.TokenHash, arg.Purpose, now()))
+}
+
+const sqliteCreateUserToken = `
+INSERT INTO user_tokens (token_hash, created_at, user_id, purpose, email, expires_at, used_at)
+VALUES (?1, ?2, ?3, ?4, ?5, ?6, NULL)`
+
+func (q *sqliteQueries) CreateUserToken(ctx context.Context, arg database.CreateUserTokenParams) error {
+	_, err := q.db.ExecContext(ctx, sqliteCreateUserToken,
+		arg.TokenHash,
+		now(),
+		arg.UserID,
+		arg.Purpose,
+		arg.Email,
+		arg.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+const sqliteGetUserToken = `
+SELECT ` + sqliteUserTokenColumns + ` FROM user_tokens
+WHERE token_hash = ?1
+AND purpose = ?2
+AND used_at IS NULL
+AND expires_at > ?3`
+
+func (q *sqliteQueries) GetUserToken(ctx context.Context, arg database.GetUserTokenParams) (database.UserToken, error) {
+	return scanUserToken(q.db.QueryRowContext(ctx, sqliteGetUserToken, arg.TokenHash, arg.Purpose, now()))
+}
+
+const sqliteDataExportColumns = `id, created_at, updated_at, user_id, status, archive, completed_at, expires_at`
+
+func scanDataExport(row rowScanner) (database.DataExport, error) {
+	var i database.DataExport
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.UserID,
+		&i.Status,
+		&i.Archive,
+		&i.CompletedAt,
+		&i.ExpiresAt,
+	)
+	return i, err
+}
+
+const sqliteCompleteDataExport = `
+UPDATE data_exports
+SET status = 'ready',
+    archive = ?2,
+    completed_at = ?4,
+    expires_at = ?3,
+    updated_at = ?4
+WHERE id = ?1`
+
+func (q *sqliteQueries) CompleteDataExport(ctx context.Context, arg database.CompleteDataExportParams) error {
+	_, err := q.db.ExecContext(ctx, sqliteCompleteDataExport, arg.ID, arg.Archive, nullUTC(arg.ExpiresAt), now())
+	return err
+}
+
+const sqliteCreateDataExport = `
+INSERT INTO data_exports (id, created_at, updated_at, user_id, status)
+VALUES (?1, ?2, ?2, ?3, 'pending')
+RETURNING ` + sqliteDataExportColumns
+
+func (q *sqliteQueries) CreateDataExport(ctx context.Context, userID uuid.UUID) (database.DataExport, error) {
+	return scanDataExport(q.db.QueryRowContext(ctx, sqliteCreateDataExport, uuid.New(), now(), userID))
+}
+
+const sqliteDeleteDataExportsForUser = `
+DELETE FROM data_exports
+WHERE user_id = ?1`
+
+func (q *sqliteQueries) DeleteDataExportsForUser(ctx context.Context, userID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, sqliteDeleteDataExportsForUser, userID)
+	return err
+}
+
+const sqliteDeleteExpiredDataExports = `
+DELETE FROM data_exports
+WHERE expires_at < ?1`
+
+func (q *sqliteQueries) DeleteExpiredDataExports(ctx context.Context, expiresAt sql.NullTime) (int64, error) {
+	return q.execRows(ctx, sqliteDeleteExpiredDataExports, nullUTC(expiresAt))
+}
+
+const sqliteFailDataExport = `
+UPDATE data_exports
+SET status = 'failed',
+    updated_at = ?2
+WHERE id = ?1`
+
+func (q *sqliteQueries) FailDataExport(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, sqliteFailDataExport, id, now())
+	return err
+}
+
+const sqliteFailStaleDataExports = `
+UPDATE data_exports
+SET status = 'failed',
+    updated_at = ?2
+WHERE status = 'pending'
+AND created_at < ?1`
+
+func (q *sqliteQueries) FailStaleDataExports(ctx context.Context, createdAt time.Time) (int64, error) {
+	return q.execRows(ctx, sqliteFailStaleDataExports, createdAt.UTC(), now())
+}
+
+const sqliteGetDataExport = `
+SELECT ` + sqliteDataExportColumns + ` FROM data_exports
+WHERE id = ?1
+AND user_id = ?2`
+
+func (q *sqliteQueries) GetDataExport(ctx context.Context, arg database.GetDataExportParams) (database.DataExport, error) {
+	return scanDataExport(q.db.QueryRowContext(ctx, sqliteGetDataExport, arg.ID, arg.UserID))
+}
+
+const sqliteImportChirp = `
+INSERT INTO chirps (id, created_at, updated_at, body, user_id)
+VALUES (?1, ?2, ?2, ?3, ?4)
+ON CONFLICT (id) DO NOTHING`
+
+func (q *sqliteQueries) ImportChirp(ctx context.Context, arg database.ImportChirpParams) (int64, error) {
+	return q.execRows(ctx, sqliteImportChirp, arg.ID, arg.CreatedAt.UTC(), arg.Body, arg.UserID)
+}
+
+const sqliteImportUser = `
+INSERT INTO users (id, created_at, updated_at, email, hashed_password)
+VALUES (?1, ?2, ?2, ?3, ?4)
+ON CONFLICT DO NOTHING`
+
+func (q *sqliteQueries) ImportUser(ctx context.Context, arg database.ImportUserParams) (int64, error) {
+	return q.execRows(ctx, sqliteImportUser, arg.ID, arg.CreatedAt.UTC(), arg.Email, arg.HashedPassword)
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+)
+
+// ChirpStore covers the queries in chirps.sql.
+type ChirpStore interface {
+	CreateChirp(ctx context.Context, arg database.CreateChirpParams) (database.Chirp, error)
+	DeleteOneChirp(ctx context.Context, id uuid.UUID) error
+	GetAllChirps(ctx context.Context) ([]database.Chirp, error)
+	GetChirpsForUser(ctx context.Context, userID uuid.UUID) ([]database.Chirp, error)
+	GetOneChirp(ctx context.Context, id uuid.UUID) (database.Chirp, error)
+}
+
+// UserStore covers the queries in users.sql and refresh_token.sql.
+type UserStore interface {
+	CancelUserDeletion(ctx context.Context, id uuid.UUID) (int64, error)
+	CreateUser(ctx context.Context, arg database.CreateUserParams) (database.User, error)
+	DeleteAllUsers(ctx context.Context) error
+	GetUser(ctx context.Context, email string) (database.User, error)
+	GetUserByID(ctx context.Context, id uuid.UUID) (database.User, error)
+	MarkEmailVerified(ctx context.Context, arg database.MarkEmailVerifiedParams) (int64, error)
+	PatchUser(ctx context.Context, arg database.PatchUserParams) (database.User, error)
+	PurgeDeletedUsers(ctx context.Context, deletionRequestedAt sql.NullTime) (int64, error)
+	RehashUserPassword(ctx context.Context, arg database.RehashUserPasswordParams) error
+	RequestUserDeletion(ctx context.Context, id uuid.UUID) (database.User, error)
+	UpdateUserPassword(ctx context.Context, arg database.UpdateUserPasswordParams) error
+
+	CreateRefreshtoken(ctx context.Context, arg database.CreateRefreshtokenParams) (database.RefreshToken, error)
+	GetSessionsForUser(ctx context.Context, userID uuid.UUID) ([]database.GetSessionsForUserRow, error)
+	GetUserFromRefreshToken(ctx context.Context, token string) (database.User, error)
+	RevokeAllRefreshTokensForUser(ctx context.Context, userID uuid.UUID) error
+	RevokeRefreshToken(ctx context.Context, token string) error
+}
+
+// APIKeyStore covers the queries in api_keys.sql.
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, arg database.CreateAPIKeyParams) (database.ApiKey, error)
+	DeleteAPIKey(ctx context.Context, arg database.DeleteAPIKeyParams) (int64, error)
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (database.ApiKey, error)
+	GetAPIKeysForUser(ctx context.Context, userID uuid.UUID) ([]database.ApiKey, error)
+	TouchAPIKey(ctx context.Context, id uuid.UUID) error
+}
+
+// LoginFailureStore covers the queries in login_failures.sql.
+type LoginFailureStore interface {
+	ClearLoginFailures(ctx context.Context, key string) error
+	GetLockedLogins(ctx context.Context, lockedUntil sql.NullTime) ([]database.LoginFailure, error)
+	GetLoginFailure(ctx context.Context, key string) (database.LoginFailure, error)
+	LockLogin(ctx context.Context, arg database.LockLoginParams) error
+	RecordLoginFailure(ctx context.Context, arg database.RecordLoginFailureParams) (database.LoginFailure, error)
+}
+
+// OAuthStore covers the queries in oauth.sql.
+type OAuthStore interface {
+	ConsumeOAuthCode(ctx context.Context, codeHash string) (database.OauthCode, error)
+	CreateOAuthClient(ctx context.Context, arg database.CreateOAuthClientParams) (database.OauthClient, error)
+	CreateOAuthCode(ctx context.Context, arg database.CreateOAuthCodeParams) error
+	GetOAuthClient(ctx context.Context, id uuid.UUID) (database.OauthClient, error)
+}
+
+// TwoFactorStore covers the queries in totp.sql.
+type TwoFactorStore interface {
+	CreateRecoveryCode(ctx context.Context, arg database.CreateRecoveryCodeParams) error
+	DeleteRecoveryCodes(ctx context.Context, userID uuid.UUID) error
+	DeleteTOTP(ctx context.Context, userID uuid.UUID) error
+	EnableTOTP(ctx context.Context, arg database.EnableTOTPParams) error
+	GetTOTPForUser(ctx context.Context, userID uuid.UUID) (database.UserTotp, error)
+	StartTOTPEnrolment(ctx context.Context, arg database.StartTOTPEnrolmentParams) (database.UserTotp, error)
+	UseRecoveryCode(ctx context.Context, arg database.UseRecoveryCodeParams) (int64, error)
+	UseTOTPStep(ctx context.Context, arg database.UseTOTPStepParams) (int64, error)
+}
+
+// UserTokenStore covers the queries in user_tokens.sql.
+type UserTokenStore interface {
+	ConsumeUserToken(ctx context.Context, arg database.ConsumeUserTokenParams) (database.UserToken, error)
+	CreateUserToken(ctx context.Context, arg database.CreateUserTokenParams) error
+	GetUserToken(ctx context.Context, arg database.GetUserTokenParams) (database.UserToken, error)
+}
+
+// DataExportStore covers the queries in data_exports.sql.
+type DataExportStore interface {
+	CompleteDataExport(ctx context.Context, arg database.CompleteDataExportParams) error
+	CreateDataExport(ctx context.Context, userID uuid.UUID) (database.DataExport, error)
+	DeleteDataExportsForUser(ctx context.Context, userID uuid.UUID) error
+	DeleteExpiredDataExports(ctx context.Context, expiresAt sql.NullTime) (int64, error)
+	FailDataExport(ctx context.Context, id uuid.UUID) error
+	FailStaleDataExports(ctx context.Context, createdAt time.Time) (int64, error)
+	GetDataExport(ctx context.Context, arg database.GetDataExportParams) (database.DataExport, error)
+}
+
+// ImportStore covers the queries in import.sql. Both insert nothing and
+// return 0 when the row is already there.
+type ImportStore interface {
+	ImportChirp(ctx context.Context, arg database.ImportChirpParams) (int64, error)
+	ImportUser(ctx context.Context, arg database.ImportUserParams) (int64, error)
+}
+
+// Queries is everything that can be done inside Storage.Atomic.
+type Queries interface {
+	ChirpStore
+	UserStore
+	APIKeyStore
+	LoginFailureStore
+	OAuthStore
+	TwoFactorStore
+	UserTokenStore
+	DataExportStore
+	ImportStore
+}
+
+// Storage is what the handlers run on. Postgres, SQLite and Memory
+// implement it.
+type Storage interface {
+	Queries
+	// Atomic runs fn so that everything it does through q happens as one
+	// unit. fn may be run more than once and must not have other side
+	// effects.
+	Atomic(ctx context.Context, fn func(q Queries) error) error
+	// Close releases the storage once nothing uses it any more.
+	Close() error
+}
+
+var (
+	_ Queries = (*database.Queries)(nil)
+	_ Storage = (*Postgres)(nil)
+	_ Storage = (*SQLite)(nil)
+	_ Storage = (*Memory)(nil)
+)
@@ -0,0 +1,131 @@
+// Package store holds the storage the handlers run on: Postgres through the
+// sqlc-generated queries, SQLite for small deployments, or an in-memory
+// store for demos and tests.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/tracing"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	maxAttempts = 5
+	baseBackoff = 10 * time.Millisecond
+)
+
+// Postgres is the production storage. Besides Storage it offers every
+// generated query, and transactions over all of them through RunInTx.
+type Postgres struct {
+	*database.Queries
+	db *sql.DB
+}
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{Queries: database.New(tracing.WrapDB(db, "postgresql")), db: db}
+}
+
+// RunInTx calls fn inside a serializable transaction and commits if it
+// returns nil. When Postgres aborts the transaction because it conflicted
+// with another one, the whole transaction is retried, so fn may run more
+// than once and must not have side effects outside q.
+func (s *Postgres) RunInTx(ctx context.Context, fn func(q *database.Queries) error) error {
+	return retry(ctx, func() error {
+		return s.runOnce(ctx, fn)
+	})
+}
+
+func (s *Postgres) Close() error {
+	return s.db.Close()
+}
+
+func (s *Postgres) Atomic(ctx context.Context, fn func(q Queries) error) error {
+	return s.RunInTx(ctx, func(q *database.Queries) error {
+		return fn(q)
+	})
+}
+
+func (s *Postgres) runOnce(ctx context.Context, fn func(q *database.Queries) error) error {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(database.New(tracing.WrapDB(tx, "postgresql"))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retry calls attempt until it succeeds, fails with an error that isn't
+// IsRetryable, or has been tried maxAttempts times.
+func retry(ctx context.Context, attempt func() error) error {
+	var err error
+	for n := 1; n <= maxAttempts; n++ {
+		err = attempt()
+		if !IsRetryable(err) {
+			return err
+		}
+
+		// Back off with jitter so the conflicting transactions don't collide again
+		backoff := baseBackoff << (n - 1)
+		backoff += rand.N(backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+	return err
+}
+
+// ErrUniqueViolation is returned by the in-memory store when a write would
+// break a unique constraint.
+var ErrUniqueViolation = errors.New("unique constraint violated")
+
+// IsUniqueViolation reports whether err means a unique value, such as a
+// user's email, is already taken.
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" // unique_violation
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return true
+		}
+		return false
+	}
+	return errors.Is(err, ErrUniqueViolation)
+}
+
+// IsRetryable reports whether err means the transaction lost a race with
+// another one and can simply be run again.
+func IsRetryable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", // serialization_failure
+			"40P01": // deadlock_detected
+			return true
+		}
+		return false
+	}
+	// SQLite reports a writer that outlasted busy_timeout as SQLITE_BUSY
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code()&0xff == sqlite3.SQLITE_BUSY
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
+)
+
+// Failures older than this no longer count towards a lockout.
+const loginFailureWindow = 24 * time.Hour
+
+// lockoutPolicy lets a few mistakes through for free, then locks for a delay
+// that doubles with every further failure up to maxDelay.
+type lockoutPolicy struct {
+	freeAttempts int32
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+}
+
+var (
+	accountLockout = lockoutPolicy{freeAttempts: 5, baseDelay: 30 * time.Second, maxDelay: time.Hour}
+	// An IP may be a shared NAT, so it gets more room before it is locked
+	ipLockout = lockoutPolicy{freeAttempts: 20, baseDelay: 30 * time.Second, maxDelay: time.Hour}
+)
+
+func (p lockoutPolicy) lockFor(failures int32) time.Duration {
+	if failures < p.freeAttempts {
+		return 0
+	}
+
+	exponent := float64(failures - p.freeAttempts)
+	delay := time.Duration(float64(p.baseDelay) * math.Pow(2, exponent))
+	if delay <= 0 || delay > p.maxDelay {
+		return p.maxDelay
+	}
+	return delay
+}
+
+type LockedLoginResponse struct {
+	Key          string    `json:"key"`
+	Failures     int32     `json:"failures"`
+	LastFailedAt time.Time `json:"last_failed_at"`
+	LockedUntil  time.Time `json:"locked_until"`
+}
+
+type UnlockLoginRequest struct {
+	Email string `json:"email"`
+	IP    string `json:"ip"`
+}
+
+// Accounts are keyed by the email that was typed rather than the user ID,
+// so unknown emails are throttled exactly like real ones.
+func accountLockoutKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipLockoutKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginRetryAfter returns how long the caller must wait before trying to log
+// in again, or zero if they may try now.
+func (apiCfg *apiConfig) loginRetryAfter(ctx context.Context, email, ip string) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range []string{accountLockoutKey(email), ipLockoutKey(ip)} {
+		failure, err := apiCfg.storage.GetLoginFailure(ctx, key)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if failure.LockedUntil.Valid {
+			wait = max(wait, time.Until(failure.LockedUntil.Time))
+		}
+	}
+	return wait, nil
+}
+
+func (apiCfg *apiConfig) recordLoginFailure(ctx context.Context, email, ip string) {
+	now := time.Now()
+	keys := []struct {
+		key    string
+		policy lockoutPolicy
+	}{
+		{accountLockoutKey(email), accountLockout},
+		{ipLockoutKey(ip), ipLockout},
+	}
+
+	for _, k := range keys {
+		// Count and lock together, so concurrent failures can't each see a
+		// count below the threshold
+		err := apiCfg.storage.Atomic(ctx, func(q store.Queries) error {
+			failure, err := q.RecordLoginFailure(ctx, database.RecordLoginFailureParams{
+				Key:         k.key,
+				FailedAt:    now,
+				WindowStart: now.Add(-loginFailureWindow),
+			})
+			if err != nil {
+				return err
+			}
+
+			delay := k.policy.lockFor(failure.Failures)
+			if delay == 0 {
+				return nil
+			}
+
+			return q.LockLogin(ctx, database.LockLoginParams{
+				Key:         k.key,
+				LockedUntil: sql.NullTime{Time: now.Add(delay), Valid: true},
+			})
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error recording login failure", "error", err)
+		}
+	}
+}
+
+// clearLoginFailures only resets the account: a successful login proves the
+// password, not that every other attempt from the same IP was legitimate.
+func (apiCfg *apiConfig) clearLoginFailures(ctx context.Context, email string) {
+	if err := apiCfg.storage.ClearLoginFailures(ctx, accountLockoutKey(email)); err != nil {
+		slog.ErrorContext(ctx, "Error clearing login failures", "error", err)
+	}
+}
+
+func writeTooManyAttempts(rw http.ResponseWriter, r *http.Request, wait time.Duration) {
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	problem.Error(rw, r, problem.TooManyRequests, "Too many failed login attempts, try again later")
+}
+
+func (cfg *apiConfig) GetLockedLogins(rw http.ResponseWriter, r *http.Request) {
+	if !cfg.authorizeAdmin(r) {
+		problem.Error(rw, r, problem.Forbidden, "Admin token required")
+		return
+	}
+
+	locked, err := cfg.storage.GetLockedLogins(r.Context(), sql.NullTime{Time: time.Now(), Valid: true})
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Failed to get locked logins")
+		return
+	}
+
+	response := []LockedLoginResponse{}
+	for _, failure := range locked {
+		response = append(response, LockedLoginResponse{
+			Key:          failure.Key,
+			Failures:     failure.Failures,
+			LastFailedAt: failure.LastFailedAt,
+			LockedUntil:  failure.LockedUntil.Time,
+		})
+	}
+
+	writeJSONResponse(rw, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) UnlockLogin(rw http.ResponseWriter, r *http.Request) {
+	if !cfg.authorizeAdmin(r) {
+		problem.Error(rw, r, problem.Forbidden, "Admin token required")
+		return
+	}
+
+	req := UnlockLoginRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
+		return
+	}
+
+	keys := []string{}
+	if req.Email != "" {
+		keys = append(keys, accountLockoutKey(req.Email))
+	}
+	if req.IP != "" {
+		keys = append(keys, ipLockoutKey(req.IP))
+	}
+	if len(keys) == 0 {
+		problem.Error(rw, r, problem.BadRequest, "Email or IP is required")
+		return
+	}
+
+	for _, key := range keys {
+		if err := cfg.storage.ClearLoginFailures(r.Context(), key); err != nil {
+			problem.Error(rw, r, problem.Internal, "Failed to unlock login")
+			return
+		}
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -1,74 +1,367 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/config"
 	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/health"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/idempotency"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/logging"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/mailer"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/metrics"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/migrate"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/tracing"
 	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
-	fileserverHits atomic.Int32
+	config  *config.Config
+	metrics *metrics.Metrics
+	// health holds the checks /api/readyz runs
+	health *health.Checker
+	// stopping is cancelled when shutdown starts, which background work
+	// and long-running streams watch
+	stopping     context.Context
+	stop         context.CancelFunc
+	shuttingDown atomic.Bool
+	background   sync.WaitGroup
+	rateLimits   *rateLimits
+	// idempotency holds responses to replay for retried requests
+	idempotency idempotency.Store
+	// stopTracing flushes spans not yet exported
+	stopTracing func(context.Context) error
+	// storage holds the API's data, in Postgres, SQLite or memory
+	storage store.Storage
+	// database and postgres are nil unless running on Postgres, which the
+	// postgres rate limit and idempotency stores need
 	database       *database.Queries
+	postgres       *store.Postgres
 	secret         string
+	adminToken     string
+	totpWindow     int
+	hasher         *auth.PasswordHasher
+	passwordPolicy *auth.PasswordPolicy
+	mailer         mailer.Mailer
+	// baseURL is where links in emails point, e.g. https://chirpy.example.com
+	baseURL              string
+	requireVerifiedEmail bool
+	// How long a deleted account can still be restored before it is purged
+	deletionGracePeriod time.Duration
+}
+
+// newPasswordHasher builds the hasher for new passwords. Existing hashes made
+// with other settings keep working and are upgraded on the user's next login.
+func newPasswordHasher(cfg config.PasswordConfig) *auth.PasswordHasher {
+	argon2 := auth.DefaultArgon2Params
+	argon2.Memory = uint32(cfg.Argon2MemoryKiB)
+	argon2.Iterations = uint32(cfg.Argon2Iterations)
+	argon2.Parallelism = uint8(cfg.Argon2Parallelism)
+
+	return &auth.PasswordHasher{
+		Algorithm:  cfg.Hash,
+		Argon2:     argon2,
+		BcryptCost: cfg.BcryptCost,
+	}
+}
+
+func newPasswordPolicy(cfg config.PasswordConfig) (*auth.PasswordPolicy, error) {
+	policy := &auth.PasswordPolicy{
+		MinLength:      cfg.MinLength,
+		MinEntropyBits: cfg.MinEntropy,
+	}
+
+	if cfg.BreachedFile != "" {
+		breached, err := auth.LoadBreachedPasswords(cfg.BreachedFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load breached passwords: %w", err)
+		}
+		policy.Breached = breached
+	}
+
+	return policy, nil
+}
+
+// newMailer picks the MAILER. In prod the log mailer is allowed, so the
+// defaults still start, but nothing it's given ever reaches the user.
+func newMailer(cfg config.MailConfig, platform string) mailer.Mailer {
+	switch cfg.Mailer {
+	case "file":
+		return &mailer.FileMailer{Path: cfg.File, From: cfg.From}
+	case "smtp":
+		return &mailer.SMTPMailer{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.From,
+		}
+	default:
+		if platform == "prod" {
+			slog.Warn("Using the log mailer in prod: verification and password reset emails are not sent")
+		}
+		return mailer.LogMailer{}
+	}
+}
+
+// newAPIConfig sets up everything the handlers need from cfg, which must
+// have been validated.
+func newAPIConfig(cfg *config.Config) (*apiConfig, error) {
+	passwordPolicy, err := newPasswordPolicy(cfg.Password)
+	if err != nil {
+		return nil, fmt.Errorf("invalid password policy: %w", err)
+	}
+
+	stopping, stop := context.WithCancel(context.Background())
+	apiCfg := &apiConfig{
+		config:      cfg,
+		metrics:     metrics.New(),
+		health:      health.New(cfg.ReadinessTimeout),
+		stopping:    stopping,
+		stop:        stop,
+		stopTracing: func(context.Context) error { return nil },
+		secret:      cfg.Secret,
+		adminToken:  cfg.AdminToken,
+		totpWindow:  cfg.TOTPWindow,
+		hasher:      newPasswordHasher(cfg.Password),
+		// Only new passwords are checked; existing ones keep working
+		passwordPolicy: passwordPolicy,
+		mailer:         newMailer(cfg.Mail, cfg.Platform),
+		baseURL:        cfg.BaseURL,
+		// Unverified accounts can still log in, but can't post until verified
+		requireVerifiedEmail: cfg.RequireVerifiedEmail,
+		deletionGracePeriod:  cfg.DeletionGracePeriod,
+	}
+
+	apiCfg.health.Register("shutdown", func(context.Context) error {
+		if apiCfg.shuttingDown.Load() {
+			return errShuttingDown
+		}
+		return nil
+	})
+	if err := apiCfg.openStorage(cfg); err != nil {
+		stop()
+		return nil, fmt.Errorf("couldn't open storage: %w", err)
+	}
+
+	if err := apiCfg.setupRateLimits(cfg.RateLimit); err != nil {
+		stop()
+		return nil, err
+	}
+	apiCfg.setupIdempotency()
+	return apiCfg, nil
+}
+
+// openStorage sets up the STORAGE backend. Unless it is memory, the DB_URL
+// scheme picks between Postgres and SQLite.
+func (apiCfg *apiConfig) openStorage(cfg *config.Config) error {
+	if cfg.Storage == "memory" {
+		slog.Warn("Using in-memory storage: data is lost on restart")
+		apiCfg.storage = store.NewMemory()
+		return nil
+	}
+
+	db, dialect, err := openDatabase(cfg.DBURL)
+	if err != nil {
+		return err
+	}
+	if err := prepareSchema(context.Background(), db, dialect, cfg.AutoMigrate); err != nil {
+		return err
+	}
+	migrator, err := newMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+	apiCfg.health.Register("database", db.PingContext)
+	apiCfg.health.Register("schema", migrator.Check)
+	apiCfg.metrics.RegisterDB(db, dialect.Name)
+
+	switch dialect {
+	case migrate.Postgres:
+		postgres := store.NewPostgres(db)
+		apiCfg.storage = postgres
+		apiCfg.database = postgres.Queries
+		apiCfg.postgres = postgres
+	case migrate.SQLite:
+		apiCfg.storage = store.NewSQLite(db)
+	}
+	return nil
+}
+
+// openDatabase opens DB_URL, whose scheme says whether it is Postgres or
+// SQLite.
+func openDatabase(dbURL string) (*sql.DB, migrate.Dialect, error) {
+	var db *sql.DB
+	var dialect migrate.Dialect
+	var err error
+
+	scheme, _, _ := strings.Cut(dbURL, ":")
+	switch scheme {
+	case "postgres", "postgresql":
+		db, err = sql.Open("postgres", dbURL)
+		dialect = migrate.Postgres
+	case "sqlite":
+		db, err = store.OpenSQLite(dbURL)
+		dialect = migrate.SQLite
+	default:
+		return nil, migrate.Dialect{}, fmt.Errorf("DB_URL must start with postgres:// or sqlite:")
+	}
+	if err != nil {
+		return nil, migrate.Dialect{}, fmt.Errorf("couldn't open database: %w", err)
+	}
+	return db, dialect, nil
 }
 
 func main() {
-	err := godotenv.Load()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			os.Exit(runImportCommand(os.Args[2:]))
+		case "migrate":
+			os.Exit(runMigrateCommand(os.Args[2:]))
+		}
+	}
+
+	flags := flag.NewFlagSet("chirpy", flag.ExitOnError)
+	printConfig := flags.Bool("print-config", false, "print the configuration with secrets redacted, then exit")
+	cfg, err := config.Load(flags, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("invalid configuration:\n%s", err)
+	}
+
+	logger, err := logging.New(os.Stderr, cfg.LogFormat, cfg.LogLevel, cfg.LogPII)
 	if err != nil {
-		log.Fatal("couldn't load env variable")
+		log.Fatal(err)
 	}
+	slog.SetDefault(logger)
 
-	jwtSecret := os.Getenv("SECRET")
-	if jwtSecret == "" {
-		log.Fatal("SECRET environment variable is not set")
+	stopTracing, err := tracing.Setup(context.Background(), cfg.TraceExporter, cfg.OTLPEndpoint, "chirpy", cfg.TraceSampleRatio)
+	if err != nil {
+		fatal("Error setting up tracing", err)
 	}
 
-	dbURL := os.Getenv("DB_URL")
-	db, err := sql.Open("postgres", dbURL)
+	apiCfg, err := newAPIConfig(cfg)
 	if err != nil {
-		log.Fatal("couldnt open database")
+		fatal("Error setting up the server", err)
 	}
+	apiCfg.stopTracing = stopTracing
 
-	dbQueries := database.New(db)
+	apiCfg.goBackground(func() {
+		apiCfg.purgeDeletedAccounts(apiCfg.stopping, deletionPurgeInterval)
+	})
+	apiCfg.goBackground(func() {
+		apiCfg.sweepDataExports(apiCfg.stopping, exportSweepInterval)
+	})
+	apiCfg.goBackground(func() {
+		apiCfg.sweepRateLimits(apiCfg.stopping, rateLimitSweepInterval)
+	})
+	apiCfg.goBackground(func() {
+		apiCfg.sweepIdempotencyKeys(apiCfg.stopping, idempotencySweepInterval)
+	})
 
 	mux := http.NewServeMux()
-	server := &http.Server{
-		Handler: mux,
-		Addr:    ":8080",
-	}
+	apiCfg.registerRoutes(mux)
+	server := apiCfg.newServer(cfg, mux, map[string]int64{
+		"POST /admin/import": int64(cfg.ImportMaxBodyBytes),
+	})
 
-	apiCfg := &apiConfig{
-		database: dbQueries,
-		secret:   jwtSecret,
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- apiCfg.listenAndServe(server, cfg)
+	}()
+
+	select {
+	case err := <-serverErr:
+		fatal("Server error", err)
+	case <-signals.Done():
 	}
 
+	// A second signal kills the process without waiting
+	stopSignals()
+	apiCfg.shutdown(server, cfg.ShutdownDelay, cfg.ShutdownTimeout)
+}
+
+// fatal logs err and exits, for startup errors once logging is set up.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func (apiCfg *apiConfig) registerRoutes(mux *http.ServeMux) {
 	handler := http.StripPrefix("/app", http.FileServer(http.Dir(".")))
 	mux.Handle("/app/", apiCfg.middlewareMetricsInc(handler))
+	mux.Handle("GET /metrics", apiCfg.metrics.Handler())
 	mux.Handle("GET /admin/metrics", http.HandlerFunc(apiCfg.NumOfRequests))
 	mux.Handle("POST /admin/resetmetrics", http.HandlerFunc(apiCfg.ResetRequests))
 	mux.Handle("POST /admin/reset", http.HandlerFunc(apiCfg.ResetUsers))
 	mux.Handle("/assets", http.FileServer(http.Dir("./assets")))
-	mux.Handle("GET /api/healthz", http.HandlerFunc(Readiness))
-	mux.Handle("PUT /api/users", http.HandlerFunc(apiCfg.ChangeEmailAndPassword))
-	mux.Handle("POST /api/users", http.HandlerFunc(apiCfg.AddUser))
+	mux.Handle("GET /api/healthz", http.HandlerFunc(apiCfg.Readiness))
+	mux.Handle("GET /api/livez", http.HandlerFunc(apiCfg.Livez))
+	mux.Handle("GET /api/readyz", http.HandlerFunc(apiCfg.Readyz))
+	// PUT predates PATCH /api/users/me and now goes through the same checks
+	mux.Handle("PUT /api/users", http.HandlerFunc(apiCfg.UpdateMe))
+	mux.Handle("POST /api/users", apiCfg.idempotent(apiCfg.AddUser))
+	mux.Handle("PATCH /api/users/me", http.HandlerFunc(apiCfg.UpdateMe))
+	mux.Handle("DELETE /api/users/me", http.HandlerFunc(apiCfg.DeleteMe))
+	mux.Handle("POST /api/users/restore", http.HandlerFunc(apiCfg.RestoreAccount))
 	mux.Handle("GET /api/chirps", http.HandlerFunc(apiCfg.GetChirps))
 	mux.Handle("GET /api/chirps/{chirpID}", http.HandlerFunc(apiCfg.GetChirp))
 	mux.Handle("DELETE /api/chirps/{chirpID}", http.HandlerFunc(apiCfg.DeleteChirp))
-	mux.Handle("POST /api/chirps", http.HandlerFunc(apiCfg.CreateChirp))
+	mux.Handle("POST /api/chirps", apiCfg.idempotent(apiCfg.CreateChirp))
 	mux.Handle("POST /api/login", http.HandlerFunc(apiCfg.LoginUser))
 	mux.Handle("POST /api/refresh", http.HandlerFunc(apiCfg.RefreshToken))
 	mux.Handle("POST /api/revoke", http.HandlerFunc(apiCfg.RevokeToken))
-	log.Printf("Starting server on %s", server.Addr)
-	err = server.ListenAndServe()
-
-	if err != nil {
-		log.Printf("Server error: %v", err)
-		log.Fatal(err)
-	}
+	mux.Handle("GET /admin/lockouts", http.HandlerFunc(apiCfg.GetLockedLogins))
+	mux.Handle("POST /admin/lockouts/unlock", http.HandlerFunc(apiCfg.UnlockLogin))
+	mux.Handle("POST /admin/import", http.HandlerFunc(apiCfg.ImportData))
+	mux.Handle("POST /api/users/me/export", http.HandlerFunc(apiCfg.StartDataExport))
+	mux.Handle("GET /api/users/me/export/{exportID}", http.HandlerFunc(apiCfg.GetDataExport))
+	mux.Handle("GET /api/users/verify", http.HandlerFunc(apiCfg.VerifyEmail))
+	mux.Handle("POST /api/users/me/verification", http.HandlerFunc(apiCfg.ResendVerification))
+	mux.Handle("POST /api/password/forgot", http.HandlerFunc(apiCfg.ForgotPassword))
+	mux.Handle("POST /api/password/reset", http.HandlerFunc(apiCfg.ResetPassword))
+	mux.Handle("POST /api/login/2fa", http.HandlerFunc(apiCfg.LoginTwoFactor))
+	mux.Handle("POST /api/users/me/2fa", http.HandlerFunc(apiCfg.EnrolTwoFactor))
+	mux.Handle("POST /api/users/me/2fa/confirm", http.HandlerFunc(apiCfg.ConfirmTwoFactor))
+	mux.Handle("DELETE /api/users/me/2fa", http.HandlerFunc(apiCfg.DisableTwoFactor))
+	mux.Handle("POST /api/keys", http.HandlerFunc(apiCfg.CreateAPIKey))
+	mux.Handle("GET /api/keys", http.HandlerFunc(apiCfg.GetAPIKeys))
+	mux.Handle("DELETE /api/keys/{keyID}", http.HandlerFunc(apiCfg.DeleteAPIKey))
+	mux.Handle("POST /api/oauth/clients", http.HandlerFunc(apiCfg.RegisterOAuthClient))
+	mux.Handle("GET /oauth/authorize", http.HandlerFunc(apiCfg.OAuthAuthorize))
+	mux.Handle("POST /oauth/authorize", http.HandlerFunc(apiCfg.OAuthConsent))
+	mux.Handle("POST /oauth/token", http.HandlerFunc(apiCfg.OAuthToken))
 }
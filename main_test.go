@@ -0,0 +1,809 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/config"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/health"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/importer"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+const testPassword = "plum-Kettle-41-violin"
+
+// newTestServer serves the whole API, middleware included, on the memory
+// store. configure may change the settings before they're used.
+func newTestServer(t *testing.T, configure ...func(*config.Config)) http.Handler {
+	t.Helper()
+	_, h := newTestAPI(t, configure...)
+	return h
+}
+
+// newTestAPI is newTestServer for tests that also need the server's state.
+func newTestAPI(t *testing.T, configure ...func(*config.Config)) (*apiConfig, http.Handler) {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Storage = "memory"
+	cfg.Secret = "test-secret"
+	// The cheapest hash keeps the tests quick
+	cfg.Password.Hash = auth.AlgorithmBcrypt
+	cfg.Password.BcryptCost = bcrypt.MinCost
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid test configuration: %v", err)
+	}
+
+	apiCfg, err := newAPIConfig(cfg)
+	if err != nil {
+		t.Fatalf("Error setting up the server: %v", err)
+	}
+	t.Cleanup(func() {
+		apiCfg.stop()
+		apiCfg.background.Wait()
+		apiCfg.storage.Close()
+	})
+
+	mux := http.NewServeMux()
+	apiCfg.registerRoutes(mux)
+	return apiCfg, apiCfg.newServer(cfg, mux, nil).Handler
+}
+
+// onEachBackend runs fn on a server with memory storage and on one with a
+// new SQLite database.
+func onEachBackend(t *testing.T, fn func(t *testing.T, h http.Handler), configure ...func(*config.Config)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, newTestServer(t, configure...))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		fn(t, newTestServer(t, append([]func(*config.Config){useSQLite(t)}, configure...)...))
+	})
+}
+
+// useSQLite switches storage to a new SQLite database.
+func useSQLite(t *testing.T) func(*config.Config) {
+	return func(cfg *config.Config) {
+		cfg.Storage = ""
+		cfg.DBURL = "sqlite:" + filepath.Join(t.TempDir(), "chirpy.db")
+		cfg.AutoMigrate = true
+	}
+}
+
+// request sends body as JSON, with token as the bearer token if it isn't
+// empty.
+func request(t *testing.T, h http.Handler, method, path, token string, body any, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		dat, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Error encoding request: %v", err)
+		}
+		reader = bytes.NewReader(dat)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("Error decoding %q: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+// expectProblem checks rec is a problem with the given status and code.
+func expectProblem(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Fatalf("Got status %d, want %d: %s", rec.Code, status, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != problem.ContentType {
+		t.Errorf("Got Content-Type %q, want %q", ct, problem.ContentType)
+	}
+	if got := decode[problem.Problem](t, rec); got.Code != code {
+		t.Errorf("Got problem code %q, want %q", got.Code, code)
+	}
+}
+
+// signUp creates an account and logs it in.
+func signUp(t *testing.T, h http.Handler, email string) LoginResponse {
+	t.Helper()
+
+	credentials := CreateUserRequest{Email: email, Password: testPassword}
+	if rec := request(t, h, "POST", "/api/users", "", credentials); rec.Code != http.StatusCreated {
+		t.Fatalf("Signing up: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := request(t, h, "POST", "/api/login", "", credentials)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Logging in: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	return decode[LoginResponse](t, rec)
+}
+
+func TestSignupAndLogin(t *testing.T) {
+	h := newTestServer(t)
+	login := signUp(t, h, "walt@example.com")
+
+	t.Run("login returns a token pair", func(t *testing.T) {
+		if login.Email != "walt@example.com" || login.Token == "" || login.RefreshToken == "" {
+			t.Errorf("Got %+v, want the email and both tokens", login)
+		}
+		if _, err := auth.ValidateJWT(login.Token, "test-secret"); err != nil {
+			t.Errorf("Error validating access token: %v", err)
+		}
+	})
+
+	t.Run("email already taken", func(t *testing.T) {
+		rec := request(t, h, "POST", "/api/users", "", CreateUserRequest{Email: "walt@example.com", Password: testPassword})
+		expectProblem(t, rec, http.StatusConflict, problem.EmailTaken.Code)
+	})
+
+	t.Run("weak password", func(t *testing.T) {
+		rec := request(t, h, "POST", "/api/users", "", CreateUserRequest{Email: "jesse@example.com", Password: "abc"})
+		expectProblem(t, rec, http.StatusBadRequest, problem.ValidationFailed.Code)
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/users", bytes.NewBufferString("{"))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		expectProblem(t, rec, http.StatusBadRequest, problem.InvalidJSON.Code)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		rec := request(t, h, "POST", "/api/login", "", CreateUserRequest{Email: "walt@example.com", Password: "not-the-password"})
+		expectProblem(t, rec, http.StatusUnauthorized, problem.InvalidCredentials.Code)
+	})
+
+	t.Run("unknown email", func(t *testing.T) {
+		rec := request(t, h, "POST", "/api/login", "", CreateUserRequest{Email: "nobody@example.com", Password: testPassword})
+		expectProblem(t, rec, http.StatusUnauthorized, problem.InvalidCredentials.Code)
+	})
+
+	t.Run("refresh and revoke", func(t *testing.T) {
+		rec := request(t, h, "POST", "/api/refresh", login.RefreshToken, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Refreshing: got status %d: %s", rec.Code, rec.Body.String())
+		}
+
+		if rec := request(t, h, "POST", "/api/revoke", login.RefreshToken, nil); rec.Code != http.StatusNoContent {
+			t.Fatalf("Revoking: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		rec = request(t, h, "POST", "/api/refresh", login.RefreshToken, nil)
+		expectProblem(t, rec, http.StatusUnauthorized, problem.InvalidToken.Code)
+	})
+}
+
+func TestChirpCRUD(t *testing.T) {
+	h := newTestServer(t)
+	walt := signUp(t, h, "walt@example.com")
+	jesse := signUp(t, h, "jesse@example.com")
+
+	rec := request(t, h, "POST", "/api/chirps", walt.Token, Chirp{Body: "I am the one who knocks"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Creating chirp: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	chirp := decode[Chirp](t, rec)
+	path := "/api/chirps/" + chirp.ID.String()
+
+	t.Run("listed and fetched", func(t *testing.T) {
+		rec := request(t, h, "GET", "/api/chirps", "", nil)
+		chirps := decode[[]Chirp](t, rec)
+		if len(chirps) != 1 || chirps[0].ID != chirp.ID {
+			t.Errorf("Got %+v, want just the new chirp", chirps)
+		}
+
+		rec = request(t, h, "GET", path, "", nil)
+		if got := decode[Chirp](t, rec); got.Body != "I am the one who knocks" {
+			t.Errorf("Got body %q", got.Body)
+		}
+	})
+
+	t.Run("invalid chirps", func(t *testing.T) {
+		cases := []struct {
+			name  string
+			token string
+			body  any
+			want  int
+			code  string
+		}{
+			{"no token", "", Chirp{Body: "hello"}, http.StatusUnauthorized, problem.Unauthorized.Code},
+			{"bad token", "not-a-token", Chirp{Body: "hello"}, http.StatusUnauthorized, problem.InvalidToken.Code},
+			{"empty", walt.Token, Chirp{}, http.StatusBadRequest, problem.ValidationFailed.Code},
+			{"too long", walt.Token, Chirp{Body: string(bytes.Repeat([]byte("a"), 141))}, http.StatusBadRequest, problem.ValidationFailed.Code},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				expectProblem(t, request(t, h, "POST", "/api/chirps", tc.token, tc.body), tc.want, tc.code)
+			})
+		}
+	})
+
+	t.Run("banned words are masked", func(t *testing.T) {
+		rec := request(t, h, "POST", "/api/chirps", walt.Token, Chirp{Body: "what a Kerfuffle"})
+		if got := decode[Chirp](t, rec); got.Body != "what a ****" {
+			t.Errorf("Got body %q, want the banned word masked", got.Body)
+		}
+	})
+
+	t.Run("only the author can delete", func(t *testing.T) {
+		expectProblem(t, request(t, h, "DELETE", path, jesse.Token, nil), http.StatusForbidden, problem.Forbidden.Code)
+
+		if rec := request(t, h, "DELETE", path, walt.Token, nil); rec.Code != http.StatusNoContent {
+			t.Fatalf("Deleting: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		expectProblem(t, request(t, h, "GET", path, "", nil), http.StatusNotFound, problem.NotFound.Code)
+		expectProblem(t, request(t, h, "DELETE", path, walt.Token, nil), http.StatusNotFound, problem.NotFound.Code)
+	})
+}
+
+func TestAccountChanges(t *testing.T) {
+	h := newTestServer(t)
+	walt := signUp(t, h, "walt@example.com")
+	signUp(t, h, "jesse@example.com")
+
+	t.Run("current password is required", func(t *testing.T) {
+		for _, method := range []string{"PUT", "PATCH"} {
+			path := "/api/users/me"
+			if method == "PUT" {
+				path = "/api/users"
+			}
+			rec := request(t, h, method, path, walt.Token, map[string]string{"email": "heisenberg@example.com"})
+			expectProblem(t, rec, http.StatusBadRequest, problem.ValidationFailed.Code)
+
+			rec = request(t, h, method, path, walt.Token, map[string]string{"email": "heisenberg@example.com", "current_password": "wrong"})
+			expectProblem(t, rec, http.StatusUnauthorized, problem.InvalidCredentials.Code)
+		}
+	})
+
+	t.Run("email already taken", func(t *testing.T) {
+		rec := request(t, h, "PATCH", "/api/users/me", walt.Token, map[string]string{"email": "jesse@example.com", "current_password": testPassword})
+		expectProblem(t, rec, http.StatusConflict, problem.EmailTaken.Code)
+	})
+
+	t.Run("password change revokes other sessions", func(t *testing.T) {
+		rec := request(t, h, "PUT", "/api/users", walt.Token, map[string]string{"password": "new-Kettle-42-viola", "current_password": testPassword})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Changing password: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		if got := decode[UpdateUserResponse](t, rec); got.RefreshToken == "" {
+			t.Error("Expected a new refresh token")
+		}
+		expectProblem(t, request(t, h, "POST", "/api/refresh", walt.RefreshToken, nil), http.StatusUnauthorized, problem.InvalidToken.Code)
+	})
+
+	t.Run("pending deletion locks the account", func(t *testing.T) {
+		jesse := decode[LoginResponse](t, request(t, h, "POST", "/api/login", "", CreateUserRequest{Email: "jesse@example.com", Password: testPassword}))
+		rec := request(t, h, "DELETE", "/api/users/me", jesse.Token, DeleteAccountRequest{Password: testPassword})
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("Deleting account: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		rec = request(t, h, "POST", "/api/chirps", jesse.Token, Chirp{Body: "still here"})
+		expectProblem(t, rec, http.StatusForbidden, problem.AccountPendingDeletion.Code)
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+	onEachBackend(t, func(t *testing.T, h http.Handler) {
+		signUp(t, h, "walt@example.com")
+		wrong := CreateUserRequest{Email: "walt@example.com", Password: "not-the-password"}
+		for range accountLockout.freeAttempts {
+			expectProblem(t, request(t, h, "POST", "/api/login", "", wrong), http.StatusUnauthorized, problem.InvalidCredentials.Code)
+		}
+
+		right := CreateUserRequest{Email: "walt@example.com", Password: testPassword}
+		rec := request(t, h, "POST", "/api/login", "", right)
+		expectProblem(t, rec, http.StatusTooManyRequests, problem.TooManyRequests.Code)
+		if rec.Header().Get("Retry-After") == "" {
+			t.Error("Expected a Retry-After header")
+		}
+
+		rec = request(t, h, "GET", "/admin/lockouts", "admin-token", nil)
+		locked := decode[[]LockedLoginResponse](t, rec)
+		if len(locked) != 1 || locked[0].Key != "account:walt@example.com" || locked[0].Failures != accountLockout.freeAttempts {
+			t.Errorf("Got %+v, want walt's account locked", locked)
+		}
+
+		if rec := request(t, h, "POST", "/admin/lockouts/unlock", "admin-token", UnlockLoginRequest{Email: "walt@example.com"}); rec.Code != http.StatusNoContent {
+			t.Fatalf("Unlocking: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		if rec := request(t, h, "POST", "/api/login", "", right); rec.Code != http.StatusOK {
+			t.Errorf("Logging in after unlocking: got status %d: %s", rec.Code, rec.Body.String())
+		}
+	}, func(cfg *config.Config) {
+		cfg.AdminToken = "admin-token"
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	onEachBackend(t, func(t *testing.T, h http.Handler) {
+		walt := signUp(t, h, "walt@example.com")
+		rec := request(t, h, "POST", "/api/keys", walt.Token, CreateAPIKeyRequest{Name: "bot", Scopes: []string{auth.ScopeChirpsWrite}})
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Creating key: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		apiKey := decode[APIKeyResponse](t, rec)
+		header := "ApiKey " + apiKey.Key
+
+		t.Run("key works within its scopes", func(t *testing.T) {
+			rec := request(t, h, "POST", "/api/chirps", "", Chirp{Body: "beep"}, "Authorization", header)
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("Chirping with the key: got status %d: %s", rec.Code, rec.Body.String())
+			}
+			rec = request(t, h, "POST", "/api/keys", "", CreateAPIKeyRequest{Name: "another", Scopes: []string{auth.ScopeAccount}}, "Authorization", header)
+			expectProblem(t, rec, http.StatusForbidden, problem.InsufficientScope.Code)
+		})
+
+		t.Run("use is recorded", func(t *testing.T) {
+			keys := decode[[]APIKeyResponse](t, request(t, h, "GET", "/api/keys", walt.Token, nil))
+			if len(keys) != 1 || keys[0].ID != apiKey.ID || keys[0].LastUsedAt == nil || keys[0].Key != "" {
+				t.Errorf("Got %+v, want the key, used and without its secret", keys)
+			}
+		})
+
+		t.Run("deleted keys stop working", func(t *testing.T) {
+			if rec := request(t, h, "DELETE", "/api/keys/"+apiKey.ID.String(), walt.Token, nil); rec.Code != http.StatusNoContent {
+				t.Fatalf("Deleting key: got status %d: %s", rec.Code, rec.Body.String())
+			}
+			rec := request(t, h, "POST", "/api/chirps", "", Chirp{Body: "beep"}, "Authorization", header)
+			expectProblem(t, rec, http.StatusUnauthorized, problem.InvalidToken.Code)
+		})
+	})
+}
+
+func TestTwoFactor(t *testing.T) {
+	onEachBackend(t, func(t *testing.T, h http.Handler) {
+		walt := signUp(t, h, "walt@example.com")
+		rec := request(t, h, "POST", "/api/users/me/2fa", walt.Token, nil)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Enrolling: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		enrolment := decode[TwoFactorEnrolmentResponse](t, rec)
+
+		code, err := auth.TOTPCode(enrolment.Secret, auth.TOTPStep(time.Now()))
+		if err != nil {
+			t.Fatalf("Error making code: %v", err)
+		}
+		rec = request(t, h, "POST", "/api/users/me/2fa/confirm", walt.Token, SecondFactorRequest{Code: code})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Confirming: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		recoveryCodes := decode[RecoveryCodesResponse](t, rec).RecoveryCodes
+
+		t.Run("enrolling again conflicts", func(t *testing.T) {
+			expectProblem(t, request(t, h, "POST", "/api/users/me/2fa", walt.Token, nil), http.StatusConflict, problem.Conflict.Code)
+		})
+
+		t.Run("login needs the second factor", func(t *testing.T) {
+			rec := request(t, h, "POST", "/api/login", "", CreateUserRequest{Email: "walt@example.com", Password: testPassword})
+			challenge := decode[TwoFactorChallengeResponse](t, rec)
+			if !challenge.TwoFactorRequired || challenge.ChallengeToken == "" {
+				t.Fatalf("Got %+v, want a challenge", challenge)
+			}
+
+			second := SecondFactorRequest{ChallengeToken: challenge.ChallengeToken, RecoveryCode: recoveryCodes[0]}
+			rec = request(t, h, "POST", "/api/login/2fa", "", second)
+			if got := decode[LoginResponse](t, rec); got.Token == "" {
+				t.Errorf("Got %s, want tokens", rec.Body.String())
+			}
+			// Recovery codes only work once
+			rec = request(t, h, "POST", "/api/login/2fa", "", second)
+			expectProblem(t, rec, http.StatusUnauthorized, problem.InvalidCredentials.Code)
+		})
+
+		t.Run("the password alone doesn't reset the lockout", func(t *testing.T) {
+			credentials := CreateUserRequest{Email: "walt@example.com", Password: testPassword}
+			for range accountLockout.freeAttempts {
+				rec := request(t, h, "POST", "/api/login", "", credentials)
+				if rec.Code == http.StatusTooManyRequests {
+					break
+				}
+				challenge := decode[TwoFactorChallengeResponse](t, rec)
+				rec = request(t, h, "POST", "/api/login/2fa", "", SecondFactorRequest{ChallengeToken: challenge.ChallengeToken, RecoveryCode: "wrong"})
+				expectProblem(t, rec, http.StatusUnauthorized, problem.InvalidCredentials.Code)
+			}
+			expectProblem(t, request(t, h, "POST", "/api/login", "", credentials), http.StatusTooManyRequests, problem.TooManyRequests.Code)
+		})
+	}, func(cfg *config.Config) {
+		// Locked out, not rate limited
+		cfg.RateLimit.Auth = "off"
+	})
+}
+
+func TestDataExport(t *testing.T) {
+	onEachBackend(t, func(t *testing.T, h http.Handler) {
+		walt := signUp(t, h, "walt@example.com")
+		request(t, h, "POST", "/api/chirps", walt.Token, Chirp{Body: "say my name"})
+
+		rec := request(t, h, "POST", "/api/users/me/export", walt.Token, nil)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("Starting export: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		location := rec.Header().Get("Location")
+
+		// The archive is built in the background
+		deadline := time.Now().Add(5 * time.Second)
+		for rec.Code == http.StatusAccepted && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			rec = request(t, h, "GET", location, walt.Token, nil)
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Fetching export: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		if _, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len())); err != nil {
+			t.Errorf("Error reading archive: %v", err)
+		}
+
+		jesse := signUp(t, h, "jesse@example.com")
+		expectProblem(t, request(t, h, "GET", location, jesse.Token, nil), http.StatusNotFound, problem.NotFound.Code)
+	})
+}
+
+func TestHealth(t *testing.T) {
+	t.Run("sqlite checks the database", func(t *testing.T) {
+		h := newTestServer(t, useSQLite(t))
+		rec := request(t, h, "GET", "/api/readyz", "", nil)
+		report := decode[health.Report](t, rec)
+		if rec.Code != http.StatusOK || !report.OK() {
+			t.Fatalf("Got status %d: %s", rec.Code, rec.Body.String())
+		}
+		for _, name := range []string{"database", "schema", "shutdown"} {
+			if report.Checks[name].Status != health.StatusOK {
+				t.Errorf("Got %+v for %s, want it passed", report.Checks[name], name)
+			}
+		}
+	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		apiCfg, h := newTestAPI(t)
+		apiCfg.shuttingDown.Store(true)
+
+		rec := request(t, h, "GET", "/api/readyz", "", nil)
+		report := decode[health.Report](t, rec)
+		if rec.Code != http.StatusServiceUnavailable || report.Checks["shutdown"].Error != errShuttingDown.Error() {
+			t.Errorf("Got status %d: %s, want shutdown failing", rec.Code, rec.Body.String())
+		}
+		if rec := request(t, h, "GET", "/api/healthz", "", nil); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Got status %d from /api/healthz, want 503", rec.Code)
+		}
+		// Liveness doesn't depend on readiness
+		if rec := request(t, h, "GET", "/api/livez", "", nil); rec.Code != http.StatusOK {
+			t.Errorf("Got status %d from /api/livez, want 200", rec.Code)
+		}
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	h := newTestServer(t, func(cfg *config.Config) { cfg.RateLimit.Auth = "3/1m" })
+	walt := signUp(t, h, "walt@example.com")
+	rec := request(t, h, "POST", "/api/keys", walt.Token, CreateAPIKeyRequest{Name: "bot", Scopes: []string{auth.ScopeChirpsWrite}})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Creating key: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	apiKey := decode[APIKeyResponse](t, rec)
+
+	// Signing up logged in once from this IP, leaving two requests
+	login := func(headers ...string) *httptest.ResponseRecorder {
+		return request(t, h, "POST", "/api/login", "", CreateUserRequest{Email: "nobody@example.com", Password: testPassword}, headers...)
+	}
+
+	t.Run("made up keys count against the IP", func(t *testing.T) {
+		steps := []struct {
+			remaining string
+			status    int
+		}{
+			{"1", http.StatusUnauthorized},
+			{"0", http.StatusUnauthorized},
+			{"0", http.StatusTooManyRequests},
+		}
+		for i, step := range steps {
+			key, err := auth.MakeAPIKey()
+			if err != nil {
+				t.Fatalf("Error making key: %v", err)
+			}
+			rec := login("Authorization", "ApiKey "+key)
+			if rec.Code != step.status {
+				t.Fatalf("Request %d: got status %d, want %d: %s", i, rec.Code, step.status, rec.Body.String())
+			}
+			if got := rec.Header().Get("RateLimit-Remaining"); got != step.remaining {
+				t.Errorf("Request %d: got RateLimit-Remaining %q, want %q", i, got, step.remaining)
+			}
+		}
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		rec := login()
+		expectProblem(t, rec, http.StatusTooManyRequests, problem.TooManyRequests.Code)
+		want := map[string]string{
+			"RateLimit-Limit":     "3",
+			"RateLimit-Remaining": "0",
+			"RateLimit-Policy":    "3;w=60",
+			"Retry-After":         "20",
+		}
+		for name, value := range want {
+			if got := rec.Header().Get(name); got != value {
+				t.Errorf("Got %s %q, want %q", name, got, value)
+			}
+		}
+		if reset := rec.Header().Get("RateLimit-Reset"); reset == "" || reset == "0" {
+			t.Errorf("Got RateLimit-Reset %q, want the time until the bucket refills", reset)
+		}
+	})
+
+	t.Run("callers have their own buckets", func(t *testing.T) {
+		if rec := login("Authorization", "ApiKey "+apiKey.Key); rec.Code != http.StatusUnauthorized || rec.Header().Get("RateLimit-Remaining") != "2" {
+			t.Errorf("Got status %d and %q remaining with a real key, want a fresh bucket", rec.Code, rec.Header().Get("RateLimit-Remaining"))
+		}
+		if rec := request(t, h, "POST", "/api/login", walt.Token, CreateUserRequest{Email: "nobody@example.com", Password: testPassword}); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Got status %d with a token, want a fresh bucket", rec.Code)
+		}
+	})
+
+	t.Run("probes aren't limited", func(t *testing.T) {
+		rec := request(t, h, "GET", "/api/livez", "", nil)
+		if rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "" {
+			t.Errorf("Got status %d with RateLimit-Limit %q, want 200 unlimited", rec.Code, rec.Header().Get("RateLimit-Limit"))
+		}
+	})
+}
+
+func TestIdempotency(t *testing.T) {
+	apiCfg, h := newTestAPI(t)
+	walt := signUp(t, h, "walt@example.com")
+	chirp := func(key, body string) *httptest.ResponseRecorder {
+		return request(t, h, "POST", "/api/chirps", walt.Token, Chirp{Body: body}, idempotencyKeyHeader, key)
+	}
+
+	t.Run("a retry gets the saved response", func(t *testing.T) {
+		first := chirp("retry", "hello")
+		if first.Code != http.StatusCreated {
+			t.Fatalf("Chirping: got status %d: %s", first.Code, first.Body.String())
+		}
+		again := chirp("retry", "hello")
+		if again.Code != http.StatusCreated || again.Body.String() != first.Body.String() || again.Header().Get(idempotentReplayedHeader) != "true" {
+			t.Errorf("Got status %d and %s, want the first response replayed", again.Code, again.Body.String())
+		}
+
+		chirps := decode[[]Chirp](t, request(t, h, "GET", "/api/chirps", "", nil))
+		if len(chirps) != 1 {
+			t.Errorf("Got %d chirps, want the retry not to post another", len(chirps))
+		}
+	})
+
+	t.Run("a different body is refused", func(t *testing.T) {
+		chirp("reused", "hello")
+		expectProblem(t, chirp("reused", "goodbye"), http.StatusUnprocessableEntity, problem.IdempotencyKeyReused.Code)
+	})
+
+	t.Run("keys are per caller", func(t *testing.T) {
+		jesse := signUp(t, h, "jesse@example.com")
+		chirp("mine", "hello")
+		rec := request(t, h, "POST", "/api/chirps", jesse.Token, Chirp{Body: "hello"}, idempotencyKeyHeader, "mine")
+		if rec.Code != http.StatusCreated || rec.Header().Get(idempotentReplayedHeader) != "" || decode[Chirp](t, rec).UserID.String() != jesse.ID {
+			t.Errorf("Got status %d and %s, want jesse's own chirp", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("anonymous keys are per IP", func(t *testing.T) {
+		signUpFrom := func(ip, email string) *httptest.ResponseRecorder {
+			dat, _ := json.Marshal(CreateUserRequest{Email: email, Password: testPassword})
+			req := httptest.NewRequest("POST", "/api/users", bytes.NewReader(dat))
+			req.RemoteAddr = ip + ":1234"
+			req.Header.Set(idempotencyKeyHeader, "signup")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec
+		}
+		if rec := signUpFrom("192.0.2.10", "skyler@example.com"); rec.Code != http.StatusCreated {
+			t.Fatalf("Signing up: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		rec := signUpFrom("192.0.2.20", "skyler@example.com")
+		if rec.Header().Get(idempotentReplayedHeader) != "" {
+			t.Errorf("Got %s replayed to another IP, want it handled afresh", rec.Body.String())
+		}
+	})
+
+	// A handler the test controls, behind the middleware
+	var (
+		started = make(chan struct{})
+		finish  = make(chan int)
+	)
+	mux := http.NewServeMux()
+	mux.Handle("POST /test", apiCfg.idempotent(func(rw http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		rw.WriteHeader(<-finish)
+	}))
+	send := func() *httptest.ResponseRecorder {
+		return request(t, mux, "POST", "/test", walt.Token, nil, idempotencyKeyHeader, "key")
+	}
+
+	t.Run("a key in use is refused", func(t *testing.T) {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- send() }()
+		<-started
+
+		rec := send()
+		expectProblem(t, rec, http.StatusConflict, problem.IdempotencyKeyInUse.Code)
+		if rec.Header().Get("Retry-After") == "" {
+			t.Errorf("Got no Retry-After, want one")
+		}
+
+		finish <- http.StatusServiceUnavailable
+		<-done
+	})
+
+	t.Run("server errors aren't saved", func(t *testing.T) {
+		// The 503 above was released, so this is handled for real
+		go func() {
+			<-started
+			finish <- http.StatusNoContent
+		}()
+		if rec := send(); rec.Code != http.StatusNoContent || rec.Header().Get(idempotentReplayedHeader) != "" {
+			t.Errorf("Got status %d, want the retry handled", rec.Code)
+		}
+		if rec := send(); rec.Code != http.StatusNoContent || rec.Header().Get(idempotentReplayedHeader) != "true" {
+			t.Errorf("Got status %d, want the 204 replayed", rec.Code)
+		}
+	})
+
+	if rec := request(t, h, "POST", "/api/chirps", walt.Token, Chirp{Body: "hi"}, idempotencyKeyHeader, strings.Repeat("k", maxIdempotencyKeyLength+1)); rec.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for an overlong key, want 400", rec.Code)
+	}
+}
+
+func TestBrowserErrors(t *testing.T) {
+	h := newTestServer(t)
+
+	cases := []struct {
+		name   string
+		path   string
+		status int
+		code   string
+	}{
+		{"verification link without a token", "/api/users/verify", http.StatusBadRequest, problem.ValidationFailed.Code},
+		{"unknown verification link", "/api/users/verify?token=nope", http.StatusBadRequest, problem.ValidationFailed.Code},
+		{"authorize for an unknown client", "/oauth/authorize?client_id=nope&redirect_uri=https://example.com/cb", http.StatusBadRequest, problem.BadRequest.Code},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectProblem(t, request(t, h, "GET", tc.path, "", nil), tc.status, tc.code)
+		})
+	}
+}
+
+func TestNewPasswordHasher(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Hashing with the largest argon2id settings is slow")
+	}
+
+	// The largest settings Validate accepts must make hashes Verify accepts
+	cfg := config.Default()
+	cfg.Secret = "test-secret"
+	cfg.Storage = "memory"
+	cfg.Password.Hash = auth.AlgorithmArgon2id
+	cfg.Password.Argon2MemoryKiB = auth.MaxArgon2Memory
+	cfg.Password.Argon2Iterations = auth.MaxArgon2Iterations
+	cfg.Password.Argon2Parallelism = auth.MaxArgon2Parallelism
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Error validating the largest settings: %v", err)
+	}
+
+	hasher := newPasswordHasher(cfg.Password)
+	hash, err := hasher.Hash(testPassword)
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	if needsRehash, err := hasher.Verify(testPassword, hash); err != nil || needsRehash {
+		t.Errorf("Got rehash %t and error %v, want the hash verified as is", needsRehash, err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	onEachBackend(t, func(t *testing.T, h http.Handler) {
+		post := func(query, contentType, body string) importer.Summary {
+			t.Helper()
+
+			req := httptest.NewRequest("POST", "/admin/import?"+query, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer admin-token")
+			req.Header.Set("Content-Type", contentType)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Importing: got status %d: %s", rec.Code, rec.Body.String())
+			}
+
+			lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+			var last importSummaryResponse
+			if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+				t.Fatalf("Error decoding %q: %v", rec.Body.String(), err)
+			}
+			return last.Summary
+		}
+
+		users := "{\"email\": \"walt@example.com\"}\n{\"email\": \"jesse@example.com\", \"created_at\": \"2020-01-02T03:04:05Z\"}\n"
+		if got := post("type=users", "application/x-ndjson", users); got.Imported != 2 {
+			t.Errorf("Got %+v, want both users imported", got)
+		}
+		if got := post("type=users", "application/x-ndjson", users); got.Skipped != 2 {
+			t.Errorf("Got %+v importing again, want both users skipped", got)
+		}
+
+		chirps := "user_email,body,created_at\njesse@example.com,Yeah science,2020-01-03T00:00:00Z\nnobody@example.com,Who?,2020-01-03T00:00:00Z\n"
+		if got := post("type=chirps", "text/csv", chirps); got.Imported != 1 || got.Failed != 1 {
+			t.Errorf("Got %+v, want one chirp imported and one failed", got)
+		}
+		listed := decode[[]Chirp](t, request(t, h, "GET", "/api/chirps", "", nil))
+		if len(listed) != 1 || listed[0].Body != "Yeah science" || listed[0].CreatedAt.Year() != 2020 {
+			t.Errorf("Got %+v, want the imported chirp", listed)
+		}
+	}, func(cfg *config.Config) {
+		cfg.AdminToken = "admin-token"
+	})
+}
+
+func TestFailedLoginsMetric(t *testing.T) {
+	apiCfg, h := newTestAPI(t)
+	walt := signUp(t, h, "walt@example.com")
+
+	steps := []struct {
+		name string
+		send func() *httptest.ResponseRecorder
+		want float64
+	}{
+		{"wrong password", func() *httptest.ResponseRecorder {
+			return request(t, h, "POST", "/api/login", "", CreateUserRequest{Email: "walt@example.com", Password: "wrong"})
+		}, 1},
+		{"unknown email", func() *httptest.ResponseRecorder {
+			return request(t, h, "POST", "/api/login", "", CreateUserRequest{Email: "nobody@example.com", Password: "wrong"})
+		}, 2},
+		{"wrong current password", func() *httptest.ResponseRecorder {
+			return request(t, h, "PATCH", "/api/users/me", walt.Token, map[string]string{"email": "heisenberg@example.com", "current_password": "wrong"})
+		}, 2},
+	}
+	for _, step := range steps {
+		if rec := step.send(); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: got status %d, want 401: %s", step.name, rec.Code, rec.Body.String())
+		}
+		if got := testutil.ToFloat64(apiCfg.metrics.FailedLogins); got != step.want {
+			t.Errorf("%s: got %v failed logins, want %v", step.name, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/config"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/migrate"
+)
+
+//go:embed sql/schema/*.sql sql/sqlite/schema/*.sql
+var migrationFiles embed.FS
+
+func newMigrator(db *sql.DB, dialect migrate.Dialect) (*migrate.Migrator, error) {
+	dir := "sql/schema"
+	if dialect == migrate.SQLite {
+		dir = "sql/sqlite/schema"
+	}
+	files, err := fs.Sub(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(db, dialect, files)
+}
+
+// prepareSchema applies pending migrations if autoMigrate is set, then
+// makes sure none are left: serving on an old schema would only fail later,
+// one query at a time.
+func prepareSchema(ctx context.Context, db *sql.DB, dialect migrate.Dialect, autoMigrate bool) error {
+	migrator, err := newMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+
+	if autoMigrate {
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't migrate database: %w", err)
+		}
+		for _, migration := range applied {
+			slog.InfoContext(ctx, "Applied migration", "name", migration.Name)
+		}
+	}
+
+	if err := migrator.Check(ctx); err != nil {
+		return fmt.Errorf("%w; run `chirpy migrate up` or set AUTO_MIGRATE=true", err)
+	}
+	return nil
+}
+
+// configuredDBURL is the database the server would use. Subcommands take
+// their own flags, so only the config file and environment count.
+func configuredDBURL() (string, error) {
+	cfg, err := config.Load(flag.NewFlagSet("chirpy", flag.ContinueOnError), nil)
+	if err != nil {
+		return "", err
+	}
+	return cfg.DBURL, nil
+}
+
+// runMigrateCommand implements `chirpy migrate`, which manages the schema of
+// the database in DB_URL with the migrations built into the binary.
+func runMigrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: chirpy migrate up|down|status")
+		fmt.Fprintln(flags.Output(), "up applies every pending migration, down rolls back the newest one.")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	dbURL, err := configuredDBURL()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	db, dialect, err := openDatabase(dbURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	migrator, err := newMigrator(db, dialect)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	switch flags.Arg(0) {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, migration := range applied {
+			fmt.Println("applied", migration.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "migration failed:", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("already up to date")
+		}
+	case "down":
+		migration, err := migrator.Down(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "rollback failed:", err)
+			return 1
+		}
+		fmt.Println("rolled back", migration.Name)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.Applied {
+				appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%-20s %s\n", appliedAt, status.Name)
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+)
+
+const (
+	oauthCodeLifetime  = 10 * time.Minute
+	oauthTokenLifetime = time.Hour
+)
+
+type RegisterOAuthClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// Confidential clients get a secret; public clients (mobile and
+	// single-page apps) rely on PKCE alone.
+	Confidential bool `json:"confidential"`
+}
+
+type OAuthClientResponse struct {
+	ClientID     uuid.UUID `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	CreatedAt    time.Time `json:"created_at"`
+	// ClientSecret is only ever returned once, when the client is registered.
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// oauthError uses the error codes from RFC 6749. Errors found before the
+// client and redirect URI are trusted must not redirect back to the client.
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+	redirect    bool
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+type authorizeRequest struct {
+	Client        database.OauthClient
+	RedirectURI   string
+	Scope         string
+	State         string
+	CodeChallenge string
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<html>
+<body>
+<h1>Authorize {{.Client.Name}}</h1>
+<p>{{.Client.Name}} would like to access your Chirpy account with these permissions:</p>
+<ul>
+{{range .Scopes}}<li>{{.}}</li>
+{{end}}</ul>
+{{if .Message}}<p><strong>{{.Message}}</strong></p>{{end}}
+<form method="POST" action="/oauth/authorize">
+<input type="hidden" name="response_type" value="code">
+<input type="hidden" name="client_id" value="{{.Client.ID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="S256">
+<p><label>Email <input type="email" name="email"></label></p>
+<p><label>Password <input type="password" name="password"></label></p>
+<p><label>Authenticator code, if enabled <input type="text" name="code" inputmode="numeric" autocomplete="one-time-code"></label></p>
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>`))
+
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return false
+	}
+	if u.Scheme == "https" {
+		return true
+	}
+	// Plain http is only allowed for clients running on the user's machine
+	return u.Scheme == "http" && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1")
+}
+
+func (apiCfg *apiConfig) RegisterOAuthClient(rw http.ResponseWriter, r *http.Request) {
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
+	if err != nil {
+		writeAuthError(rw, r, err)
+		return
+	}
+
+	req := RegisterOAuthClientRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
+		return
+	}
+
+	if req.Name == "" {
+		problem.Invalid(rw, r, "name", "required", "Client name is required")
+		return
+	}
+
+	if len(req.RedirectURIs) == 0 {
+		problem.Invalid(rw, r, "redirect_uris", "required", "At least one redirect URI is required")
+		return
+	}
+
+	for _, redirectURI := range req.RedirectURIs {
+		// Redirect URIs are stored space separated, so they can't contain one
+		if !validRedirectURI(redirectURI) || strings.ContainsAny(redirectURI, " \t\n") {
+			problem.Invalid(rw, r, "redirect_uris", "invalid", "Invalid redirect URI: "+redirectURI)
+			return
+		}
+	}
+
+	secret := ""
+	secretHash := sql.NullString{}
+	if req.Confidential {
+		secret, err = auth.MakeRefreshToken()
+		if err != nil {
+			problem.Error(rw, r, problem.Internal, "Error creating client secret")
+			return
+		}
+		secretHash = sql.NullString{String: auth.HashToken(secret), Valid: true}
+	}
+
+	client, err := apiCfg.storage.CreateOAuthClient(r.Context(), database.CreateOAuthClientParams{
+		UserID:       userID,
+		Name:         req.Name,
+		SecretHash:   secretHash,
+		RedirectUris: strings.Join(req.RedirectURIs, " "),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error storing OAuth client", "error", err)
+		problem.Error(rw, r, problem.Internal, "Error storing OAuth client")
+		return
+	}
+
+	resp := OAuthClientResponse{
+		ClientID:     client.ID,
+		Name:         client.Name,
+		RedirectURIs: strings.Fields(client.RedirectUris),
+		CreatedAt:    client.CreatedAt,
+		ClientSecret: secret,
+	}
+
+	writeJSONResponse(rw, http.StatusCreated, resp)
+}
+
+// parseAuthorizeRequest validates the parameters shared by the consent page
+// and the form it posts back, so neither trusts the other.
+func (apiCfg *apiConfig) parseAuthorizeRequest(r *http.Request, values url.Values) (authorizeRequest, *oauthError) {
+	req := authorizeRequest{State: values.Get("state")}
+
+	clientID, err := uuid.Parse(values.Get("client_id"))
+	if err != nil {
+		return req, &oauthError{Code: "invalid_request", Description: "Invalid client_id"}
+	}
+
+	req.Client, err = apiCfg.storage.GetOAuthClient(r.Context(), clientID)
+	if err != nil {
+		return req, &oauthError{Code: "invalid_client", Description: "Unknown client"}
+	}
+
+	redirectURIs := strings.Fields(req.Client.RedirectUris)
+	req.RedirectURI = values.Get("redirect_uri")
+	if req.RedirectURI == "" && len(redirectURIs) == 1 {
+		req.RedirectURI = redirectURIs[0]
+	}
+	if !slices.Contains(redirectURIs, req.RedirectURI) {
+		return req, &oauthError{Code: "invalid_request", Description: "redirect_uri is not registered for this client"}
+	}
+
+	// From here on the redirect URI is trusted, so errors go back to the client
+	if values.Get("response_type") != "code" {
+		return req, &oauthError{Code: "unsupported_response_type", Description: "Only the code response type is supported", redirect: true}
+	}
+
+	req.CodeChallenge = values.Get("code_challenge")
+	if req.CodeChallenge == "" || values.Get("code_challenge_method") != "S256" {
+		return req, &oauthError{Code: "invalid_request", Description: "PKCE with code_challenge_method=S256 is required", redirect: true}
+	}
+
+	scopes := auth.ParseScopes(values.Get("scope"))
+	if len(scopes) == 0 {
+		return req, &oauthError{Code: "invalid_scope", Description: "At least one scope is required", redirect: true}
+	}
+	for _, scope := range scopes {
+		if !auth.ValidScope(scope) {
+			return req, &oauthError{Code: "invalid_scope", Description: "Unknown scope: " + scope, redirect: true}
+		}
+	}
+	req.Scope = auth.JoinScopes(scopes)
+
+	return req, nil
+}
+
+// writeAuthorizeError redirects oauthErr back to the client once the
+// redirect URI is trusted, as RFC 6749 asks. Until then there is nowhere
+// safe to send the user, so it's answered like any other API error.
+func writeAuthorizeError(rw http.ResponseWriter, r *http.Request, req authorizeRequest, oauthErr *oauthError) {
+	if !oauthErr.redirect {
+		problem.Error(rw, r, problem.BadRequest, oauthErr.Description)
+		return
+	}
+
+	query := url.Values{}
+	query.Set("error", oauthErr.Code)
+	query.Set("error_description", oauthErr.Description)
+	redirectWithQuery(rw, r, req.RedirectURI, query, req.State)
+}
+
+func redirectWithQuery(rw http.ResponseWriter, r *http.Request, redirectURI string, query url.Values, state string) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		problem.Error(rw, r, problem.BadRequest, "Invalid redirect URI")
+		return
+	}
+
+	if state != "" {
+		query.Set("state", state)
+	}
+	existing := u.Query()
+	for k, v := range query {
+		existing[k] = v
+	}
+	u.RawQuery = existing.Encode()
+
+	http.Redirect(rw, r, u.String(), http.StatusFound)
+}
+
+func renderConsent(rw http.ResponseWriter, status int, req authorizeRequest, message string) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// The consent page must never be framed by the client asking for access
+	rw.Header().Set("X-Frame-Options", "DENY")
+	rw.WriteHeader(status)
+
+	err := consentTemplate.Execute(rw, struct {
+		authorizeRequest
+		Scopes  []string
+		Message string
+	}{req, auth.ParseScopes(req.Scope), message})
+	if err != nil {
+		slog.Error("Error rendering consent page", "error", err)
+	}
+}
+
+func (apiCfg *apiConfig) OAuthAuthorize(rw http.ResponseWriter, r *http.Request) {
+	req, oauthErr := apiCfg.parseAuthorizeRequest(r, r.URL.Query())
+	if oauthErr != nil {
+		writeAuthorizeError(rw, r, req, oauthErr)
+		return
+	}
+
+	renderConsent(rw, http.StatusOK, req, "")
+}
+
+func (apiCfg *apiConfig) OAuthConsent(rw http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		problem.Error(rw, r, problem.BadRequest, "Invalid form")
+		return
+	}
+
+	req, oauthErr := apiCfg.parseAuthorizeRequest(r, r.PostForm)
+	if oauthErr != nil {
+		writeAuthorizeError(rw, r, req, oauthErr)
+		return
+	}
+
+	if r.PostForm.Get("decision") != "allow" {
+		writeAuthorizeError(rw, r, req, &oauthError{Code: "access_denied", Description: "The user denied the request", redirect: true})
+		return
+	}
+
+	email := r.PostForm.Get("email")
+	ip := clientIP(r)
+	wait, err := apiCfg.loginRetryAfter(r.Context(), email, ip)
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Internal server error")
+		return
+	}
+	if wait > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		renderConsent(rw, http.StatusTooManyRequests, req, "Too many failed login attempts, try again later")
+		return
+	}
+
+	user, err := apiCfg.storage.GetUser(r.Context(), email)
+	if err != nil {
+		apiCfg.hasher.DummyVerify(r.PostForm.Get("password"))
+		apiCfg.recordLoginFailure(r.Context(), email, ip)
+		renderConsent(rw, http.StatusUnauthorized, req, "Incorrect email or password")
+		return
+	}
+
+	if err := apiCfg.checkPassword(r.Context(), user, r.PostForm.Get("password")); err != nil {
+		apiCfg.recordLoginFailure(r.Context(), email, ip)
+		renderConsent(rw, http.StatusUnauthorized, req, "Incorrect email or password")
+		return
+	}
+
+	if user.DeletionRequestedAt.Valid {
+		renderConsent(rw, http.StatusForbidden, req, "This account is scheduled for deletion. Log in to Chirpy to restore it.")
+		return
+	}
+
+	twoFactor, err := apiCfg.twoFactorEnabled(r.Context(), user.ID)
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Internal server error")
+		return
+	}
+
+	if twoFactor {
+		ok, err := apiCfg.verifySecondFactor(r.Context(), user.ID, r.PostForm.Get("code"), "")
+		if err != nil {
+			problem.Error(rw, r, problem.Internal, "Internal server error")
+			return
+		}
+		if !ok {
+			apiCfg.recordLoginFailure(r.Context(), email, ip)
+			renderConsent(rw, http.StatusUnauthorized, req, "Invalid authenticator code")
+			return
+		}
+	}
+
+	apiCfg.clearLoginFailures(r.Context(), email)
+
+	code, err := auth.MakeRefreshToken()
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Error creating authorization code")
+		return
+	}
+
+	err = apiCfg.storage.CreateOAuthCode(r.Context(), database.CreateOAuthCodeParams{
+		CodeHash:      auth.HashToken(code),
+		ClientID:      req.Client.ID,
+		UserID:        user.ID,
+		RedirectUri:   req.RedirectURI,
+		Scopes:        req.Scope,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(oauthCodeLifetime),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error storing authorization code", "error", err)
+		problem.Error(rw, r, problem.Internal, "Error storing authorization code")
+		return
+	}
+
+	query := url.Values{}
+	query.Set("code", code)
+	redirectWithQuery(rw, r, req.RedirectURI, query, req.State)
+}
+
+func writeTokenError(rw http.ResponseWriter, status int, code, description string) {
+	rw.Header().Set("Cache-Control", "no-store")
+	writeJSONResponse(rw, status, oauthError{Code: code, Description: description})
+}
+
+func (apiCfg *apiConfig) OAuthToken(rw http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(rw, http.StatusBadRequest, "invalid_request", "Invalid form")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeTokenError(rw, http.StatusBadRequest, "unsupported_grant_type", "Only authorization_code is supported")
+		return
+	}
+
+	// Confidential clients may authenticate with HTTP Basic or form fields
+	clientIDStr, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientIDStr = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	clientID, err := uuid.Parse(clientIDStr)
+	if err != nil {
+		writeTokenError(rw, http.StatusUnauthorized, "invalid_client", "Invalid client_id")
+		return
+	}
+
+	client, err := apiCfg.storage.GetOAuthClient(r.Context(), clientID)
+	if err != nil {
+		writeTokenError(rw, http.StatusUnauthorized, "invalid_client", "Unknown client")
+		return
+	}
+
+	if client.SecretHash.Valid {
+		given := auth.HashToken(clientSecret)
+		if subtle.ConstantTimeCompare([]byte(given), []byte(client.SecretHash.String)) != 1 {
+			writeTokenError(rw, http.StatusUnauthorized, "invalid_client", "Invalid client credentials")
+			return
+		}
+	}
+
+	// Consuming the code marks it used, so a replayed code fails here
+	code, err := apiCfg.storage.ConsumeOAuthCode(r.Context(), auth.HashToken(r.PostForm.Get("code")))
+	if err != nil {
+		writeTokenError(rw, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+
+	if code.ClientID != client.ID || code.RedirectUri != r.PostForm.Get("redirect_uri") {
+		writeTokenError(rw, http.StatusBadRequest, "invalid_grant", "Authorization code was issued to another client")
+		return
+	}
+
+	if !auth.VerifyPKCE(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		writeTokenError(rw, http.StatusBadRequest, "invalid_grant", "Invalid code_verifier")
+		return
+	}
+
+	accessToken, err := auth.MakeScopedJWT(code.UserID, apiCfg.secret, oauthTokenLifetime, code.Scopes)
+	if err != nil {
+		writeTokenError(rw, http.StatusInternalServerError, "server_error", "Error creating token")
+		return
+	}
+
+	response := OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(oauthTokenLifetime.Seconds()),
+		Scope:       code.Scopes,
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	writeJSONResponse(rw, http.StatusOK, response)
+}
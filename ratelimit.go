@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/config"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/ratelimit"
+)
+
+const rateLimitSweepInterval = time.Minute
+
+// rateLimitGroup is a set of routes that share a limit.
+type rateLimitGroup struct {
+	name  string
+	limit ratelimit.Limit
+}
+
+// rateLimits maps mux patterns to their group. Routes not listed fall in
+// the api group if they're under /api/ or /oauth/, and aren't limited
+// otherwise.
+type rateLimits struct {
+	limiter *ratelimit.Limiter
+	routes  map[string]rateLimitGroup
+	api     rateLimitGroup
+}
+
+func newRateLimits(limiter *ratelimit.Limiter, cfg config.RateLimitConfig) *rateLimits {
+	// Validate has already checked these parse
+	parse := func(name, spec string) rateLimitGroup {
+		limit, _ := ratelimit.ParseLimit(spec)
+		return rateLimitGroup{name: name, limit: limit}
+	}
+	authGroup := parse("auth", cfg.Auth)
+	limits := &rateLimits{
+		limiter: limiter,
+		routes: map[string]rateLimitGroup{
+			"POST /api/login":           authGroup,
+			"POST /api/login/2fa":       authGroup,
+			"POST /api/refresh":         authGroup,
+			"POST /api/password/forgot": authGroup,
+			"POST /api/password/reset":  authGroup,
+			"POST /api/users/restore":   authGroup,
+			"POST /oauth/token":         authGroup,
+			"POST /api/users":           parse("signup", cfg.Signup),
+			"POST /api/chirps":          parse("chirps", cfg.Chirps),
+			// Probes are polled by the orchestrator, which mustn't be
+			// turned away
+			"GET /api/healthz": {},
+			"GET /api/livez":   {},
+			"GET /api/readyz":  {},
+		},
+		api: parse("api", cfg.API),
+	}
+	return limits
+}
+
+// setupRateLimits keeps buckets in memory, or in Postgres so that every
+// replica counts against the same limits.
+func (apiCfg *apiConfig) setupRateLimits(cfg config.RateLimitConfig) error {
+	var store ratelimit.Store = ratelimit.NewMemory()
+	if cfg.Store == "postgres" {
+		if apiCfg.postgres == nil {
+			return errors.New("the postgres rate limit store needs Postgres storage")
+		}
+		store = ratelimit.NewPostgres(apiCfg.database)
+	}
+	apiCfg.rateLimits = newRateLimits(ratelimit.New(store), cfg)
+	return nil
+}
+
+func (l *rateLimits) group(pattern string) rateLimitGroup {
+	if group, ok := l.routes[pattern]; ok {
+		return group
+	}
+	_, path, _ := strings.Cut(pattern, " ")
+	if strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/oauth/") {
+		return l.api
+	}
+	return rateLimitGroup{}
+}
+
+// maxWindow is the longest any bucket takes to refill, after which an idle
+// bucket can be forgotten.
+func (l *rateLimits) maxWindow() time.Duration {
+	window := l.api.limit.Window()
+	for _, group := range l.routes {
+		window = max(window, group.limit.Window())
+	}
+	return window
+}
+
+// rateLimit turns requests away with a 429 once their route group's limit
+// is used up. Each user and API key gets their own bucket; requests without
+// valid credentials share one per client IP. Every limited response carries
+// the RateLimit headers from the IETF draft.
+func (apiCfg *apiConfig) rateLimit(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		group := apiCfg.rateLimits.group(pattern)
+		if group.limit.Unlimited() {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		decision, err := apiCfg.rateLimits.limiter.Allow(r.Context(), group.name+":"+apiCfg.rateLimitKey(r), group.limit)
+		if err != nil {
+			// A broken store shouldn't take the API down with it
+			slog.ErrorContext(r.Context(), "Error checking rate limit", "error", err)
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		header := rw.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+		header.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+		header.Set("RateLimit-Policy", strconv.Itoa(decision.Limit)+";w="+strconv.Itoa(ceilSeconds(group.limit.Window())))
+		if !decision.Allowed {
+			header.Set("Retry-After", strconv.Itoa(ceilSeconds(decision.RetryAfter)))
+			problem.Error(rw, r, problem.TooManyRequests, "Rate limit exceeded, try again later")
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// rateLimitKey is who the request counts against: the caller if they sent
+// credentials, and their IP address otherwise.
+func (apiCfg *apiConfig) rateLimitKey(r *http.Request) string {
+	if caller := apiCfg.callerKey(r); caller != "" {
+		return caller
+	}
+	return "ip:" + clientIP(r)
+}
+
+// callerKey identifies who sent r by their access token or API key, or is
+// empty. The token isn't checked for scope or revocation here; the handler
+// does that, and a forged token doesn't get past the signature check. An
+// API key has no signature, so it only counts once it's found in storage;
+// otherwise a client could get a fresh bucket by making a new one up.
+func (apiCfg *apiConfig) callerKey(r *http.Request) string {
+	if token, err := auth.GetBearerToken(r.Header); err == nil {
+		if userID, _, err := auth.ValidateScopedJWT(token, apiCfg.secret); err == nil {
+			return "user:" + userID.String()
+		}
+	}
+	if key, err := auth.GetAPIKey(r.Header); err == nil {
+		apiKey, err := apiCfg.storage.GetAPIKeyByHash(r.Context(), auth.HashToken(key))
+		if err == nil && !(apiKey.ExpiresAt.Valid && apiKey.ExpiresAt.Time.Before(time.Now())) {
+			return "key:" + apiKey.ID.String()
+		}
+	}
+	return ""
+}
+
+// sweepRateLimits drops buckets that have been idle long enough to be full.
+func (apiCfg *apiConfig) sweepRateLimits(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := apiCfg.rateLimits.limiter.Sweep(ctx, apiCfg.rateLimits.maxWindow()); err != nil {
+			slog.ErrorContext(ctx, "Error sweeping rate limits", "error", err)
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+type clientIPKey struct{}
+
+// realIP works out the client's IP once for every handler. When the peer
+// is a trusted proxy, X-Forwarded-For is read from the right, skipping
+// trusted proxies, and the first address that isn't one is the client;
+// anything further left could have been made up by the client.
+func realIP(trusted []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if isTrusted(trusted, ip) {
+			hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+				if err != nil {
+					break
+				}
+				ip = hop.Unmap().String()
+				if !isTrusted(trusted, ip) {
+					break
+				}
+			}
+		}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+func isTrusted(trusted []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
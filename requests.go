@@ -7,12 +7,12 @@ import (
 
 func (cfg *apiConfig) NumOfRequests(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Set("Content-Type", "text/html")
-	count := cfg.fileserverHits.Load()
+	count := cfg.metrics.FileserverHits()
 	template := fmt.Sprintf("<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p></body></html>", count)
 	rw.Write([]byte(template))
 }
 
 func (cfg *apiConfig) ResetRequests(rw http.ResponseWriter, r *http.Request) {
-	cfg.fileserverHits.Store(0)
+	cfg.metrics.ResetFileserverHits()
 	rw.Write([]byte("resetted request count"))
 }
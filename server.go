@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newServer wraps mux in the settings that keep slow, oversized or overly
+// frequent clients from tying the server up, and in tracing, logging and
+// metrics for every request.
+//
+// bodyLimits overrides MaxBodyBytes for the routes it names, by mux pattern.
+func (apiCfg *apiConfig) newServer(cfg *config.Config, mux *http.ServeMux, bodyLimits map[string]int64) *http.Server {
+	// Validate has already checked the list parses
+	trusted, _ := config.ParseTrustedProxies(cfg.TrustedProxies)
+	handler := limitBodies(mux, int64(cfg.MaxBodyBytes), bodyLimits)
+	handler = apiCfg.rateLimit(mux, handler)
+	handler = traceRequests(mux, realIP(trusted, accessLog(instrument(apiCfg.metrics, handler))))
+	if cfg.H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: cfg.IdleTimeout})
+	}
+
+	return &http.Server{
+		Handler:           handler,
+		Addr:              cfg.Addr,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// limitBodies caps every request body at limit, or at the route's own
+// limit. Decoding an oversized body then fails instead of reading it all
+// into memory.
+func limitBodies(mux *http.ServeMux, limit int64, overrides map[string]int64) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := limit
+		if _, pattern := mux.Handler(r); pattern != "" {
+			if override, ok := overrides[pattern]; ok {
+				n = override
+			}
+		}
+		r.Body = http.MaxBytesReader(rw, r.Body, n)
+		mux.ServeHTTP(rw, r)
+	})
+}
+
+// listenAndServe serves HTTPS if a certificate is configured, and plain
+// HTTP otherwise. HTTP/2 is always offered over TLS.
+func (apiCfg *apiConfig) listenAndServe(server *http.Server, cfg *config.Config) error {
+	if cfg.TLSCertFile == "" {
+		slog.Info("Starting server", "addr", server.Addr)
+		return server.ListenAndServe()
+	}
+
+	certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	apiCfg.goBackground(func() {
+		certs.reloadOnSIGHUP(apiCfg.stopping)
+	})
+
+	server.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+	slog.Info("Starting server with TLS", "addr", server.Addr)
+	return server.ListenAndServeTLS("", "")
+}
+
+// certReloader hands out the certificate last read from disk, so renewed
+// certificates can be picked up with a SIGHUP instead of a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("couldn't load TLS certificate: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// reloadOnSIGHUP keeps the old certificate if the new one doesn't load, so
+// a bad renewal doesn't take the server down.
+func (c *certReloader) reloadOnSIGHUP(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			if err := c.reload(); err != nil {
+				slog.Error("Error reloading TLS certificate, keeping the old one", "error", err)
+				continue
+			}
+			slog.Info("Reloaded TLS certificate")
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// goBackground runs fn outside any request. Shutdown waits for it before
+// closing the database, so fn should watch apiCfg.stopping if it could run
+// for long.
+func (apiCfg *apiConfig) goBackground(fn func()) {
+	apiCfg.background.Add(1)
+	go func() {
+		defer apiCfg.background.Done()
+		fn()
+	}()
+}
+
+// streamContext is ctx, but also cancelled once shutdown starts. Handlers
+// that can keep a connection busy for a long time use it so they don't hold
+// up draining.
+func (apiCfg *apiConfig) streamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(apiCfg.stopping, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// shutdown stops the server in an order that loses no work: readiness fails
+// first so load balancers stop sending traffic, then in-flight requests and
+// background work finish, and the database is closed and the last spans
+// flushed at the end. Everything after the delay shares one timeout.
+func (apiCfg *apiConfig) shutdown(server *http.Server, delay, timeout time.Duration) {
+	slog.Info("Shutting down: failing readiness checks")
+	apiCfg.shuttingDown.Store(true)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	slog.Info("Draining connections")
+	apiCfg.stop()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error draining connections", "error", err)
+		server.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		apiCfg.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("Gave up waiting for background work")
+	}
+
+	if err := apiCfg.storage.Close(); err != nil {
+		slog.Error("Error closing storage", "error", err)
+	}
+	if err := apiCfg.stopTracing(ctx); err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
+	slog.Info("Shutdown complete")
+}
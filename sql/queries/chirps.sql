@@ -9,12 +9,21 @@ VALUES (
 RETURNING *;
 
 -- name: GetAllChirps :many
+SELECT chirps.* FROM chirps
+JOIN users ON users.id = chirps.user_id
+WHERE users.deletion_requested_at IS NULL
+ORDER BY chirps.created_at ASC;
+
+-- name: GetChirpsForUser :many
 SELECT * FROM chirps
+WHERE user_id = $1
 ORDER BY created_at ASC;
 
 -- name: GetOneChirp :one
-SELECT * FROM chirps
-WHERE id = $1;
+SELECT chirps.* FROM chirps
+JOIN users ON users.id = chirps.user_id
+WHERE chirps.id = $1
+AND users.deletion_requested_at IS NULL;
 
 -- name: DeleteOneChirp :exec
 DELETE FROM chirps
@@ -0,0 +1,47 @@
+-- name: CreateDataExport :one
+INSERT INTO data_exports (id, created_at, updated_at, user_id, status)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    'pending'
+)
+RETURNING *;
+
+-- name: GetDataExport :one
+SELECT * FROM data_exports
+WHERE id = $1
+AND user_id = $2;
+
+-- name: CompleteDataExport :exec
+UPDATE data_exports
+SET status = 'ready',
+    archive = $2,
+    completed_at = NOW(),
+    expires_at = $3,
+    updated_at = NOW()
+WHERE id = $1;
+
+-- name: FailDataExport :exec
+UPDATE data_exports
+SET status = 'failed',
+    updated_at = NOW()
+WHERE id = $1;
+
+-- name: DeleteDataExportsForUser :exec
+DELETE FROM data_exports
+WHERE user_id = $1;
+
+-- name: DeleteExpiredDataExports :execrows
+DELETE FROM data_exports
+WHERE expires_at < $1;
+
+-- name: FailStaleDataExports :execrows
+-- Exports still pending long after they started were being built by a
+-- server that stopped.
+UPDATE data_exports
+SET status = 'failed',
+    updated_at = NOW()
+WHERE status = 'pending'
+AND created_at < $1;
@@ -0,0 +1,30 @@
+-- name: ClaimIdempotencyKey :one
+-- Takes the key unless it's in use and younger than @expired_before, in
+-- which case no row comes back.
+INSERT INTO idempotency_keys (key, fingerprint, created_at)
+VALUES (@key, @fingerprint, @created_at)
+ON CONFLICT (key) DO UPDATE
+SET fingerprint = EXCLUDED.fingerprint,
+    created_at = EXCLUDED.created_at,
+    status_code = NULL,
+    content_type = '',
+    body = NULL
+WHERE idempotency_keys.created_at < @expired_before
+RETURNING key;
+
+-- name: GetIdempotencyKey :one
+SELECT * FROM idempotency_keys
+WHERE key = $1;
+
+-- name: CompleteIdempotencyKey :exec
+UPDATE idempotency_keys
+SET status_code = $2, content_type = $3, body = $4
+WHERE key = $1;
+
+-- name: DeleteIdempotencyKey :exec
+DELETE FROM idempotency_keys
+WHERE key = $1;
+
+-- name: DeleteExpiredIdempotencyKeys :execrows
+DELETE FROM idempotency_keys
+WHERE created_at < $1;
@@ -0,0 +1,21 @@
+-- name: ImportUser :execrows
+INSERT INTO users (id, created_at, updated_at, email, hashed_password)
+VALUES (
+    @id,
+    @created_at,
+    @created_at,
+    @email,
+    @hashed_password
+)
+ON CONFLICT DO NOTHING;
+
+-- name: ImportChirp :execrows
+INSERT INTO chirps (id, created_at, updated_at, body, user_id)
+VALUES (
+    @id,
+    @created_at,
+    @created_at,
+    @body,
+    @user_id
+)
+ON CONFLICT (id) DO NOTHING;
\ No newline at end of file
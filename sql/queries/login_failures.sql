@@ -0,0 +1,33 @@
+-- name: GetLoginFailure :one
+SELECT * FROM login_failures
+WHERE key = $1;
+
+-- name: RecordLoginFailure :one
+INSERT INTO login_failures (key, failures, last_failed_at, locked_until)
+VALUES (
+    @key,
+    1,
+    @failed_at,
+    NULL
+)
+ON CONFLICT (key) DO UPDATE
+SET failures = CASE
+        WHEN login_failures.last_failed_at < @window_start THEN 1
+        ELSE login_failures.failures + 1
+    END,
+    last_failed_at = @failed_at
+RETURNING *;
+
+-- name: LockLogin :exec
+UPDATE login_failures
+SET locked_until = $2
+WHERE key = $1;
+
+-- name: GetLockedLogins :many
+SELECT * FROM login_failures
+WHERE locked_until > $1
+ORDER BY locked_until DESC;
+
+-- name: ClearLoginFailures :exec
+DELETE FROM login_failures
+WHERE key = $1;
\ No newline at end of file
@@ -0,0 +1,20 @@
+-- name: TakeRateLimitToken :one
+-- The bucket refills at @rate tokens a second up to @burst, then gives up
+-- a token if it has a whole one.
+INSERT INTO rate_limit_buckets (key, tokens, allowed, updated_at)
+VALUES (
+    @key,
+    @burst::double precision - 1,
+    true,
+    @now
+)
+ON CONFLICT (key) DO UPDATE
+SET tokens = LEAST(@burst::double precision, rate_limit_buckets.tokens + GREATEST(EXTRACT(EPOCH FROM @now - rate_limit_buckets.updated_at)::double precision, 0) * @rate::double precision)
+        - (LEAST(@burst::double precision, rate_limit_buckets.tokens + GREATEST(EXTRACT(EPOCH FROM @now - rate_limit_buckets.updated_at)::double precision, 0) * @rate::double precision) >= 1)::int,
+    allowed = LEAST(@burst::double precision, rate_limit_buckets.tokens + GREATEST(EXTRACT(EPOCH FROM @now - rate_limit_buckets.updated_at)::double precision, 0) * @rate::double precision) >= 1,
+    updated_at = GREATEST(rate_limit_buckets.updated_at, @now)
+RETURNING tokens, allowed;
+
+-- name: DeleteIdleRateLimitBuckets :execrows
+DELETE FROM rate_limit_buckets
+WHERE updated_at < $1;
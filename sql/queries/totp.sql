@@ -0,0 +1,58 @@
+-- name: StartTOTPEnrolment :one
+INSERT INTO user_totp (user_id, created_at, updated_at, secret, enabled, last_step)
+VALUES (
+    $1,
+    NOW(),
+    NOW(),
+    $2,
+    FALSE,
+    0
+)
+ON CONFLICT (user_id) DO UPDATE
+SET secret = EXCLUDED.secret,
+    updated_at = NOW(),
+    last_step = 0
+WHERE user_totp.enabled = FALSE
+RETURNING *;
+
+-- name: GetTOTPForUser :one
+SELECT * FROM user_totp
+WHERE user_id = $1;
+
+-- name: EnableTOTP :exec
+UPDATE user_totp
+SET enabled = TRUE,
+    last_step = $2,
+    updated_at = NOW()
+WHERE user_id = $1;
+
+-- name: UseTOTPStep :execrows
+UPDATE user_totp
+SET last_step = $2,
+    updated_at = NOW()
+WHERE user_id = $1
+AND last_step < $2;
+
+-- name: DeleteTOTP :exec
+DELETE FROM user_totp
+WHERE user_id = $1;
+
+-- name: CreateRecoveryCode :exec
+INSERT INTO recovery_codes (code_hash, created_at, user_id, used_at)
+VALUES (
+    $1,
+    NOW(),
+    $2,
+    NULL
+);
+
+-- name: UseRecoveryCode :execrows
+UPDATE recovery_codes
+SET used_at = NOW()
+WHERE user_id = $1
+AND code_hash = $2
+AND used_at IS NULL;
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM recovery_codes
+WHERE user_id = $1;
\ No newline at end of file
@@ -0,0 +1,27 @@
+-- name: CreateUserToken :exec
+INSERT INTO user_tokens (token_hash, created_at, user_id, purpose, email, expires_at, used_at)
+VALUES (
+    $1,
+    NOW(),
+    $2,
+    $3,
+    $4,
+    $5,
+    NULL
+);
+
+-- name: GetUserToken :one
+SELECT * FROM user_tokens
+WHERE token_hash = $1
+AND purpose = $2
+AND used_at IS NULL
+AND expires_at > NOW();
+
+-- name: ConsumeUserToken :one
+UPDATE user_tokens
+SET used_at = NOW()
+WHERE token_hash = $1
+AND purpose = $2
+AND used_at IS NULL
+AND expires_at > NOW()
+RETURNING *;
\ No newline at end of file
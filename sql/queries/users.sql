@@ -16,8 +16,63 @@ DELETE FROM users;
 SELECT * FROM users
 WHERE email = $1;
 
+-- name: GetUserByID :one
+SELECT * FROM users
+WHERE id = $1;
+
 -- name: UpdateUser :one
 UPDATE users 
-SET email = $1, hashed_password = $2 
+SET email = $1, hashed_password = $2,
+    email_verified_at = CASE WHEN email = $1 THEN email_verified_at ELSE NULL END
 WHERE id = $3
-RETURNING id, email, created_at;
\ No newline at end of file
+RETURNING id, email, created_at;
+
+-- name: PatchUser :one
+UPDATE users
+SET email = COALESCE(sqlc.narg('email'), email),
+    hashed_password = COALESCE(sqlc.narg('hashed_password'), hashed_password),
+    email_verified_at = CASE
+        WHEN sqlc.narg('email') IS NULL OR sqlc.narg('email') = email THEN email_verified_at
+        ELSE NULL
+    END,
+    updated_at = NOW()
+WHERE id = sqlc.arg('id')
+RETURNING *;
+
+-- name: UpdateUserPassword :exec
+UPDATE users
+SET hashed_password = $2,
+    updated_at = NOW()
+WHERE id = $1;
+
+-- name: MarkEmailVerified :execrows
+UPDATE users
+SET email_verified_at = NOW(),
+    updated_at = NOW()
+WHERE id = $1
+AND email = $2;
+
+-- name: RehashUserPassword :exec
+UPDATE users
+SET hashed_password = @new_hash
+WHERE id = @id
+AND hashed_password = @old_hash;
+
+-- name: RequestUserDeletion :one
+UPDATE users
+SET deletion_requested_at = NOW(),
+    updated_at = NOW()
+WHERE id = $1
+AND deletion_requested_at IS NULL
+RETURNING *;
+
+-- name: CancelUserDeletion :execrows
+UPDATE users
+SET deletion_requested_at = NULL,
+    updated_at = NOW()
+WHERE id = $1
+AND deletion_requested_at IS NOT NULL;
+
+-- name: PurgeDeletedUsers :execrows
+DELETE FROM users
+WHERE deletion_requested_at < $1;
\ No newline at end of file
@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE idempotency_keys (
+    key TEXT PRIMARY KEY,
+    fingerprint TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    status_code INTEGER,
+    content_type TEXT NOT NULL DEFAULT '',
+    body BLOB
+);
+
+-- +goose Down
+DROP TABLE idempotency_keys;
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
+)
+
+const (
+	twoFactorChallengeLifetime = 5 * time.Minute
+	recoveryCodeCount          = 10
+	totpIssuer                 = "Chirpy"
+)
+
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+type TwoFactorEnrolmentResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// SecondFactorRequest carries either a code from the authenticator app or
+// one of the recovery codes handed out at enrolment.
+type SecondFactorRequest struct {
+	ChallengeToken string `json:"challenge_token,omitempty"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+func (apiCfg *apiConfig) twoFactorEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	totp, err := apiCfg.storage.GetTOTPForUser(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return totp.Enabled, nil
+}
+
+// verifySecondFactor checks a TOTP or recovery code and burns it, so the same
+// code can't be replayed within its validity window.
+func (apiCfg *apiConfig) verifySecondFactor(ctx context.Context, userID uuid.UUID, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		totp, err := apiCfg.storage.GetTOTPForUser(ctx, userID)
+		if err != nil {
+			return false, err
+		}
+
+		step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now(), apiCfg.totpWindow)
+		if !ok {
+			return false, nil
+		}
+
+		used, err := apiCfg.storage.UseTOTPStep(ctx, database.UseTOTPStepParams{
+			UserID:   userID,
+			LastStep: step,
+		})
+		if err != nil {
+			return false, err
+		}
+		return used == 1, nil
+	}
+
+	if recoveryCode != "" {
+		used, err := apiCfg.storage.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+			UserID:   userID,
+			CodeHash: auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode)),
+		})
+		if err != nil {
+			return false, err
+		}
+		return used == 1, nil
+	}
+
+	return false, nil
+}
+
+func (apiCfg *apiConfig) EnrolTwoFactor(rw http.ResponseWriter, r *http.Request) {
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
+	if err != nil {
+		writeAuthError(rw, r, err)
+		return
+	}
+
+	user, err := apiCfg.storage.GetUserByID(r.Context(), userID)
+	if err != nil {
+		problem.Error(rw, r, problem.NotFound, "User not found")
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Error creating secret")
+		return
+	}
+
+	// Starting again replaces an unconfirmed secret but never an active one
+	_, err = apiCfg.storage.StartTOTPEnrolment(r.Context(), database.StartTOTPEnrolmentParams{
+		UserID: userID,
+		Secret: secret,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Error(rw, r, problem.Conflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error starting 2FA enrolment", "error", err)
+		problem.Error(rw, r, problem.Internal, "Error starting enrolment")
+		return
+	}
+
+	response := TwoFactorEnrolmentResponse{
+		Secret:     secret,
+		OTPAuthURI: auth.TOTPURI(totpIssuer, user.Email, secret),
+	}
+
+	writeJSONResponse(rw, http.StatusCreated, response)
+}
+
+func (apiCfg *apiConfig) ConfirmTwoFactor(rw http.ResponseWriter, r *http.Request) {
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
+	if err != nil {
+		writeAuthError(rw, r, err)
+		return
+	}
+
+	req := SecondFactorRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
+		return
+	}
+
+	totp, err := apiCfg.storage.GetTOTPForUser(r.Context(), userID)
+	if err != nil {
+		problem.Error(rw, r, problem.BadRequest, "Two-factor enrolment has not been started")
+		return
+	}
+
+	if totp.Enabled {
+		problem.Error(rw, r, problem.Conflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(totp.Secret, req.Code, time.Now(), apiCfg.totpWindow)
+	if !ok {
+		problem.Invalid(rw, r, "code", "invalid", "Invalid code")
+		return
+	}
+
+	codes, err := auth.MakeRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Error creating recovery codes")
+		return
+	}
+
+	// 2FA is never switched on without its recovery codes
+	err = apiCfg.storage.Atomic(r.Context(), func(q store.Queries) error {
+		if err := q.DeleteRecoveryCodes(r.Context(), userID); err != nil {
+			return err
+		}
+
+		for _, code := range codes {
+			err := q.CreateRecoveryCode(r.Context(), database.CreateRecoveryCodeParams{
+				CodeHash: auth.HashToken(code),
+				UserID:   userID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return q.EnableTOTP(r.Context(), database.EnableTOTPParams{
+			UserID:   userID,
+			LastStep: step,
+		})
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error enabling 2FA", "error", err)
+		problem.Error(rw, r, problem.Internal, "Error enabling two-factor authentication")
+		return
+	}
+
+	writeJSONResponse(rw, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func (apiCfg *apiConfig) DisableTwoFactor(rw http.ResponseWriter, r *http.Request) {
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
+	if err != nil {
+		writeAuthError(rw, r, err)
+		return
+	}
+
+	req := SecondFactorRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
+		return
+	}
+
+	enabled, err := apiCfg.twoFactorEnabled(r.Context(), userID)
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Internal server error")
+		return
+	}
+
+	// A stolen access token alone must not be enough to switch 2FA off
+	if enabled {
+		ok, err := apiCfg.verifySecondFactor(r.Context(), userID, req.Code, req.RecoveryCode)
+		if err != nil {
+			problem.Error(rw, r, problem.Internal, "Internal server error")
+			return
+		}
+		if !ok {
+			problem.Error(rw, r, problem.InvalidCredentials, "Invalid code")
+			return
+		}
+	}
+
+	err = apiCfg.storage.Atomic(r.Context(), func(q store.Queries) error {
+		if err := q.DeleteTOTP(r.Context(), userID); err != nil {
+			return err
+		}
+		return q.DeleteRecoveryCodes(r.Context(), userID)
+	})
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Failed to disable two-factor authentication")
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (apiCfg *apiConfig) LoginTwoFactor(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	req := SecondFactorRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
+		return
+	}
+
+	userID, scope, err := auth.ValidateScopedJWT(req.ChallengeToken, apiCfg.secret)
+	if err != nil || scope != auth.ScopeTwoFactorChallenge {
+		problem.Error(rw, r, problem.InvalidToken, "Invalid or expired challenge token")
+		return
+	}
+
+	user, err := apiCfg.storage.GetUserByID(r.Context(), userID)
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Internal server error")
+		return
+	}
+
+	// Deleted since the challenge was issued
+	if user.DeletionRequestedAt.Valid {
+		problem.Error(rw, r, problem.InvalidToken, "Invalid or expired challenge token")
+		return
+	}
+
+	// Six digit codes are guessable too, so they share the password lockout
+	ip := clientIP(r)
+	wait, err := apiCfg.loginRetryAfter(r.Context(), user.Email, ip)
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Internal server error")
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(rw, r, wait)
+		return
+	}
+
+	ok, err := apiCfg.verifySecondFactor(r.Context(), userID, req.Code, req.RecoveryCode)
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Internal server error")
+		return
+	}
+	if !ok {
+		apiCfg.recordLoginFailure(r.Context(), user.Email, ip)
+		problem.Error(rw, r, problem.InvalidCredentials, "Invalid code")
+		return
+	}
+
+	apiCfg.clearLoginFailures(r.Context(), user.Email)
+
+	setRequestUser(r, user.ID)
+	response, err := apiCfg.issueLoginTokens(r.Context(), user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error issuing login tokens", "error", err)
+		problem.Error(rw, r, problem.Internal, "Error creating token")
+		return
+	}
+
+	writeJSONResponse(rw, http.StatusOK, response)
+}
@@ -1,20 +1,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"net/mail"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 
 	"github.com/google/uuid"
 	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
-	hash "github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
 	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/logging"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
 )
 
 type User struct {
@@ -44,6 +47,22 @@ type LoginResponse struct {
 	RefreshToken string    `json:"refresh_token"`
 }
 
+// UpdateUserRequest only changes the fields that are present. Changing the
+// email or password requires the current password.
+type UpdateUserRequest struct {
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+// UpdateUserResponse carries a fresh token pair after a password change,
+// because every existing session is revoked.
+type UpdateUserResponse struct {
+	User
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
 type UserResponse struct {
 	ID        string    `json:"id"`
 	Email     string    `json:"email"`
@@ -51,16 +70,15 @@ type UserResponse struct {
 }
 
 func (cfg *apiConfig) ResetUsers(rw http.ResponseWriter, r *http.Request) {
-	platform := os.Getenv("PLATFORM")
-	if platform != "dev" {
-		http.Error(rw, "Forbidden", http.StatusForbidden)
+	if cfg.config.Platform != "dev" {
+		problem.Error(rw, r, problem.Forbidden, "Resetting users is only allowed on the dev platform")
 		return
 	}
 
 	// Now safely proceed to delete the users
-	err := cfg.database.DeleteAllUsers(r.Context())
+	err := cfg.storage.DeleteAllUsers(r.Context())
 	if err != nil {
-		http.Error(rw, "Failed to reset users", http.StatusInternalServerError)
+		problem.Error(rw, r, problem.Internal, "Failed to reset users")
 		return
 	}
 
@@ -74,33 +92,32 @@ func (apiCfg *apiConfig) AddUser(rw http.ResponseWriter, r *http.Request) {
 	req := CreateUserRequest{}
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		// If JSON decoding fails, return InternalServerError
-		log.Printf("Error decoding parameters: %s", err)
-		rw.WriteHeader(http.StatusInternalServerError)
+		slog.InfoContext(r.Context(), "Error decoding parameters", "error", err)
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
 		return
 	}
 
 	if req.Password == "" {
-		log.Printf("Password is required")
-		rw.WriteHeader(http.StatusBadRequest)
+		problem.Invalid(rw, r, "password", "required", "Password is required")
 		return
 	}
 
 	// Validate email format
 	_, err = mail.ParseAddress(req.Email)
 	if err != nil {
-		// If email is invalid, return BadRequest
-		log.Printf("Invalid email address: %s", err)
-		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("Invalid email address"))
+		problem.Invalid(rw, r, "email", "invalid", "Invalid email address")
+		return
+	}
+
+	if !apiCfg.checkPasswordPolicy(rw, r, req.Password, req.Email) {
 		return
 	}
 
 	// Hash the password
-	hashedPassword, err := hash.HashPassword(req.Password)
+	hashedPassword, err := apiCfg.hasher.Hash(req.Password)
 	if err != nil {
-		log.Printf("Error hashing password: %s", err)
-		rw.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error hashing password", "error", err)
+		problem.Error(rw, r, problem.Internal, "Couldn't hash password")
 		return
 	}
 
@@ -111,21 +128,25 @@ func (apiCfg *apiConfig) AddUser(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	// Attempt to create the user in the database
-	user, err := apiCfg.database.CreateUser(r.Context(), createUser)
+	user, err := apiCfg.storage.CreateUser(r.Context(), createUser)
 	if err != nil {
 		// Detect duplicate email error
 		if isDuplicateKeyError(err) { // Check for unique key violation
-			log.Printf("User already exists with email: %s", createUser.Email)
-			rw.WriteHeader(http.StatusBadRequest)
-			rw.Write([]byte("User already exists"))
+			slog.InfoContext(r.Context(), "User already exists", logging.KeyEmail, createUser.Email)
+			problem.Error(rw, r, problem.EmailTaken, "Email is already in use")
 			return
 		}
 
 		// Handle all other errors
-		log.Printf("Error creating user: %s", err)
-		rw.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error creating user", "error", err)
+		problem.Error(rw, r, problem.Internal, "Couldn't create user")
 		return
 	}
+	// A failed verification email can be resent later, so don't fail signup
+	if err := apiCfg.sendVerificationEmail(r.Context(), user.ID, user.Email); err != nil {
+		slog.ErrorContext(r.Context(), "Error sending verification email", "error", err)
+	}
+
 	// Map database user to response user
 	newUser := User{
 		ID:        user.ID,
@@ -140,7 +161,7 @@ func (apiCfg *apiConfig) AddUser(rw http.ResponseWriter, r *http.Request) {
 	err = encoder.Encode(newUser)
 	if err != nil {
 		// If response encoding fails, log but do not reset status
-		log.Printf("Error encoding response: %s", err)
+		slog.ErrorContext(r.Context(), "Error encoding response", "error", err)
 	}
 }
 
@@ -149,129 +170,329 @@ func (apiCfg *apiConfig) LoginUser(rw http.ResponseWriter, r *http.Request) {
 
 	loginRequest := LoginForUser{}
 	if err := json.NewDecoder(r.Body).Decode(&loginRequest); err != nil {
-		resp := errorResponse{Error: "Invalid JSON payload"}
-		writeJSONResponse(rw, http.StatusBadRequest, resp)
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
 		return
 	}
 
 	if loginRequest.Email == "" || loginRequest.Password == "" {
-		resp := errorResponse{Error: "Email and password are required"}
-		writeJSONResponse(rw, http.StatusBadRequest, resp)
+		problem.Error(rw, r, problem.BadRequest, "Email and password are required")
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := apiCfg.loginRetryAfter(r.Context(), loginRequest.Email, ip)
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Internal server error")
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(rw, r, wait)
 		return
 	}
 
-	user, err := apiCfg.database.GetUser(r.Context(), loginRequest.Email)
+	user, err := apiCfg.storage.GetUser(r.Context(), loginRequest.Email)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			resp := errorResponse{Error: "Incorrect email or password"}
-			writeJSONResponse(rw, http.StatusUnauthorized, resp)
+			// Take as long as a wrong password so the email can't be probed
+			apiCfg.hasher.DummyVerify(loginRequest.Password)
+			apiCfg.metrics.FailedLogins.Inc()
+			apiCfg.recordLoginFailure(r.Context(), loginRequest.Email, ip)
+			problem.Error(rw, r, problem.InvalidCredentials, "Incorrect email or password")
 			return
 		}
-		resp := errorResponse{Error: "Internal server error"}
-		writeJSONResponse(rw, http.StatusInternalServerError, resp)
+		problem.Error(rw, r, problem.Internal, "Internal server error")
 		return
 	}
 
-	if err := auth.CheckPasswordHash(loginRequest.Password, user.HashedPassword); err != nil {
-		resp := errorResponse{Error: "Incorrect email or password"}
-		writeJSONResponse(rw, http.StatusUnauthorized, resp)
+	if err := apiCfg.checkPassword(r.Context(), user, loginRequest.Password); err != nil {
+		apiCfg.metrics.FailedLogins.Inc()
+		apiCfg.recordLoginFailure(r.Context(), loginRequest.Email, ip)
+		problem.Error(rw, r, problem.InvalidCredentials, "Incorrect email or password")
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Subject:   user.ID.String(),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)), // always 1 hour
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-	})
+	if user.DeletionRequestedAt.Valid {
+		apiCfg.writePendingDeletion(rw, r, user)
+		return
+	}
 
-	// Sign the token
-	tokenString, err := token.SignedString([]byte(apiCfg.secret))
+	twoFactor, err := apiCfg.twoFactorEnabled(r.Context(), user.ID)
 	if err != nil {
-		resp := errorResponse{Error: "Error creating token"}
-		writeJSONResponse(rw, http.StatusInternalServerError, resp)
+		problem.Error(rw, r, problem.Internal, "Internal server error")
 		return
 	}
 
-	// Generate refresh token
-	refreshToken, err := auth.MakeRefreshToken()
+	// Enrolled users only get a challenge here; tokens come from /api/login/2fa.
+	// Failures are only cleared once the second factor is in too, or the
+	// password alone would reset the lockout on guessing codes.
+	if twoFactor {
+		challenge, err := auth.MakeScopedJWT(user.ID, apiCfg.secret, twoFactorChallengeLifetime, auth.ScopeTwoFactorChallenge)
+		if err != nil {
+			problem.Error(rw, r, problem.Internal, "Error creating token")
+			return
+		}
+
+		response := TwoFactorChallengeResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+		}
+		writeJSONResponse(rw, http.StatusOK, response)
+		return
+	}
+
+	apiCfg.clearLoginFailures(r.Context(), loginRequest.Email)
+
+	setRequestUser(r, user.ID)
+	response, err := apiCfg.issueLoginTokens(r.Context(), user)
 	if err != nil {
-		resp := errorResponse{Error: "Error creating refresh token"}
-		writeJSONResponse(rw, http.StatusInternalServerError, resp)
+		slog.ErrorContext(r.Context(), "Error issuing login tokens", "error", err)
+		problem.Error(rw, r, problem.Internal, "Error creating token")
 		return
 	}
 
-	// Store refresh token in database
-	_, err = apiCfg.database.CreateRefreshtoken(r.Context(), database.CreateRefreshtokenParams{
+	writeJSONResponse(rw, http.StatusOK, response)
+}
+
+// checkPassword verifies a login and, when the stored hash was made with an
+// outdated algorithm or cost, replaces it with one from the current hasher.
+func (apiCfg *apiConfig) checkPassword(ctx context.Context, user database.User, password string) error {
+	needsRehash, err := apiCfg.hasher.Verify(password, user.HashedPassword)
+	if errors.Is(err, auth.ErrNoPassword) {
+		// These accounts can only get in through a password reset. Take as
+		// long as a real check so they look like any other wrong password.
+		apiCfg.hasher.DummyVerify(password)
+		return err
+	}
+	if err != nil {
+		if !errors.Is(err, auth.ErrMismatchedPassword) {
+			slog.ErrorContext(ctx, "Error verifying password hash", "error", err)
+		}
+		return err
+	}
+
+	if needsRehash {
+		newHash, err := apiCfg.hasher.Hash(password)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error rehashing password", "error", err)
+			return nil
+		}
+
+		// Only replaces the hash we checked, in case the password just changed
+		err = apiCfg.storage.RehashUserPassword(ctx, database.RehashUserPasswordParams{
+			NewHash: newHash,
+			ID:      user.ID,
+			OldHash: user.HashedPassword,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error storing rehashed password", "error", err)
+		}
+	}
+
+	return nil
+}
+
+// errAccountUnavailable means the account was deleted, or scheduled for
+// deletion, while the user was logging in.
+var errAccountUnavailable = errors.New("account is no longer available")
+
+// startSession stores a new refresh token for the user. Run inside a
+// transaction, it can't race with the account being deleted or every session
+// being revoked.
+func startSession(ctx context.Context, q store.Queries, userID uuid.UUID) (string, error) {
+	user, err := q.GetUserByID(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errAccountUnavailable
+	}
+	if err != nil {
+		return "", err
+	}
+	if user.DeletionRequestedAt.Valid {
+		return "", errAccountUnavailable
+	}
+
+	refreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = q.CreateRefreshtoken(ctx, database.CreateRefreshtokenParams{
 		Token:     refreshToken,
-		UserID:    user.ID,
+		UserID:    userID,
 		ExpiresAt: time.Now().Add(60 * 24 * time.Hour), // 60 days
 	})
 	if err != nil {
-		resp := errorResponse{Error: "Error storing refresh token"}
-		writeJSONResponse(rw, http.StatusInternalServerError, resp)
-		return
+		return "", err
 	}
 
-	response := LoginResponse{
+	return refreshToken, nil
+}
+
+func (apiCfg *apiConfig) makeAccessToken(userID uuid.UUID) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   userID.String(),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)), // always 1 hour
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	})
+
+	return token.SignedString([]byte(apiCfg.secret))
+}
+
+// issueLoginTokens creates the access and refresh token pair handed out once
+// a user has fully logged in.
+func (apiCfg *apiConfig) issueLoginTokens(ctx context.Context, user database.User) (LoginResponse, error) {
+	var refreshToken string
+	err := apiCfg.storage.Atomic(ctx, func(q store.Queries) error {
+		var err error
+		refreshToken, err = startSession(ctx, q, user.ID)
+		return err
+	})
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	apiCfg.metrics.Logins.Inc()
+
+	tokenString, err := apiCfg.makeAccessToken(user.ID)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	return LoginResponse{
 		ID:           user.ID.String(),
 		CreatedAt:    user.CreatedAt,
 		UpdatedAt:    user.UpdatedAt,
 		Email:        user.Email,
 		Token:        tokenString,
 		RefreshToken: refreshToken,
-	}
-
-	writeJSONResponse(rw, http.StatusOK, response)
+	}, nil
 }
 
-func (apiCfg *apiConfig) ChangeEmailAndPassword(rw http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
+func (apiCfg *apiConfig) UpdateMe(rw http.ResponseWriter, r *http.Request) {
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
 	if err != nil {
-		resp := errorResponse{Error: "Authentication required"}
-		writeJSONResponse(rw, http.StatusUnauthorized, resp)
+		writeAuthError(rw, r, err)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, apiCfg.secret)
-	if err != nil {
-		resp := errorResponse{Error: "Invalid token"}
-		writeJSONResponse(rw, http.StatusUnauthorized, resp)
+	req := UpdateUserRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
 		return
 	}
 
-	user := CreateUserRequest{}
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&user); err != nil {
-		resp := errorResponse{Error: "Invalid request body"}
-		writeJSONResponse(rw, http.StatusBadRequest, resp)
+	user, err := apiCfg.storage.GetUserByID(r.Context(), userID)
+	if err != nil {
+		problem.Error(rw, r, problem.NotFound, "User not found")
 		return
 	}
 
-	newPassword, err := auth.HashPassword(user.Password)
-	if err != nil {
-		resp := errorResponse{Error: "Couldn't hash password"}
-		writeJSONResponse(rw, http.StatusBadRequest, resp)
-		return
+	params := database.PatchUserParams{ID: userID}
+	newEmail := user.Email
+
+	if req.Email != nil {
+		if _, err := mail.ParseAddress(*req.Email); err != nil {
+			problem.Invalid(rw, r, "email", "invalid", "Invalid email address")
+			return
+		}
+		params.Email = sql.NullString{String: *req.Email, Valid: true}
+		newEmail = *req.Email
 	}
 
-	params := database.UpdateUserParams{
-		Email:          user.Email,
-		HashedPassword: newPassword,
-		ID:             userID,
+	if req.Password != nil {
+		if !apiCfg.checkPasswordPolicy(rw, r, *req.Password, newEmail) {
+			return
+		}
 	}
 
-	updatedUser, err := apiCfg.database.UpdateUser(r.Context(), params)
+	// A stolen access token alone must not be enough to take over the account
+	if req.Email != nil || req.Password != nil {
+		ip := clientIP(r)
+		wait, err := apiCfg.loginRetryAfter(r.Context(), user.Email, ip)
+		if err != nil {
+			problem.Error(rw, r, problem.Internal, "Internal server error")
+			return
+		}
+		if wait > 0 {
+			writeTooManyAttempts(rw, r, wait)
+			return
+		}
+
+		if req.CurrentPassword == "" {
+			problem.Invalid(rw, r, "current_password", "required", "current_password is required to change email or password")
+			return
+		}
+
+		if err := apiCfg.checkPassword(r.Context(), user, req.CurrentPassword); err != nil {
+			apiCfg.recordLoginFailure(r.Context(), user.Email, ip)
+			problem.Error(rw, r, problem.InvalidCredentials, "Current password is incorrect")
+			return
+		}
+	}
+
+	if req.Password != nil {
+		hashedPassword, err := apiCfg.hasher.Hash(*req.Password)
+		if err != nil {
+			problem.Error(rw, r, problem.Internal, "Couldn't hash password")
+			return
+		}
+		params.HashedPassword = sql.NullString{String: hashedPassword, Valid: true}
+	}
+
+	// The update, the logout of other sessions and this client's new session
+	// either all happen or none do
+	var updatedUser database.User
+	var refreshToken string
+	err = apiCfg.storage.Atomic(r.Context(), func(q store.Queries) error {
+		var err error
+		updatedUser, err = q.PatchUser(r.Context(), params)
+		if err != nil {
+			return err
+		}
+
+		if req.Password == nil {
+			return nil
+		}
+
+		// Log out every other session, then hand this client a new one
+		if err := q.RevokeAllRefreshTokensForUser(r.Context(), userID); err != nil {
+			return err
+		}
+		refreshToken, err = startSession(r.Context(), q, userID)
+		return err
+	})
 	if err != nil {
-		resp := errorResponse{Error: "Couldn't update user"}
-		writeJSONResponse(rw, http.StatusBadRequest, resp)
+		if isDuplicateKeyError(err) {
+			problem.Error(rw, r, problem.EmailTaken, "Email is already in use")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Error updating user", "error", err)
+		problem.Error(rw, r, problem.Internal, "Couldn't update user")
 		return
 	}
 
-	userResponse := UserResponse{
-		ID:        updatedUser.ID.String(),
-		Email:     updatedUser.Email,
-		CreatedAt: updatedUser.CreatedAt,
+	if updatedUser.Email != user.Email {
+		if err := apiCfg.sendVerificationEmail(r.Context(), updatedUser.ID, updatedUser.Email); err != nil {
+			slog.ErrorContext(r.Context(), "Error sending verification email", "error", err)
+		}
+	}
+
+	response := UpdateUserResponse{
+		User: User{
+			ID:        updatedUser.ID,
+			CreatedAt: updatedUser.CreatedAt,
+			UpdatedAt: updatedUser.UpdatedAt,
+			Email:     updatedUser.Email,
+		},
 	}
 
-	writeJSONResponse(rw, http.StatusOK, userResponse)
+	if refreshToken != "" {
+		token, err := apiCfg.makeAccessToken(userID)
+		if err != nil {
+			problem.Error(rw, r, problem.Internal, "Error creating token")
+			return
+		}
+		response.Token = token
+		response.RefreshToken = refreshToken
+	}
+
+	writeJSONResponse(rw, http.StatusOK, response)
 }
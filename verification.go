@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/auth"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/database"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/mailer"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/problem"
+	"github.com/jonathanpetrone/bootdevServerCourse/internal/store"
+)
+
+const (
+	tokenPurposeVerifyEmail   = "verify_email"
+	tokenPurposeResetPassword = "reset_password"
+
+	emailVerificationLifetime = 48 * time.Hour
+	passwordResetLifetime     = time.Hour
+	mailSendTimeout           = 30 * time.Second
+)
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// sendMail delivers in the background so a slow mail server neither holds up
+// the request nor reveals through timing whether an account exists.
+func (apiCfg *apiConfig) sendMail(msg mailer.Message) {
+	apiCfg.goBackground(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailSendTimeout)
+		defer cancel()
+
+		if err := apiCfg.mailer.Send(ctx, msg); err != nil {
+			slog.ErrorContext(ctx, "Error sending mail", "error", err)
+		}
+	})
+}
+
+// createUserToken stores a single-use token for purpose, bound to the email
+// address it is about to be sent to.
+func (apiCfg *apiConfig) createUserToken(ctx context.Context, userID uuid.UUID, email, purpose string, lifetime time.Duration) (string, error) {
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = apiCfg.storage.CreateUserToken(ctx, database.CreateUserTokenParams{
+		TokenHash: auth.HashToken(token),
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		ExpiresAt: time.Now().Add(lifetime),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (apiCfg *apiConfig) sendVerificationEmail(ctx context.Context, userID uuid.UUID, email string) error {
+	token, err := apiCfg.createUserToken(ctx, userID, email, tokenPurposeVerifyEmail, emailVerificationLifetime)
+	if err != nil {
+		return err
+	}
+
+	link := apiCfg.baseURL + "/api/users/verify?token=" + url.QueryEscape(token)
+	apiCfg.sendMail(mailer.Message{
+		To:      email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf("Welcome to Chirpy!\n\nConfirm your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %d hours.", link, int(emailVerificationLifetime.Hours())),
+	})
+	return nil
+}
+
+// requireVerified reports whether the user may act, given the server's
+// policy on unverified accounts.
+func (apiCfg *apiConfig) requireVerified(ctx context.Context, userID uuid.UUID) (bool, error) {
+	if !apiCfg.requireVerifiedEmail {
+		return true, nil
+	}
+
+	user, err := apiCfg.storage.GetUserByID(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return user.EmailVerifiedAt.Valid, nil
+}
+
+func (apiCfg *apiConfig) VerifyEmail(rw http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		problem.Invalid(rw, r, "token", "required", "Verification token is required")
+		return
+	}
+
+	// The link is only used up if the address really gets verified
+	var verified int64
+	err := apiCfg.storage.Atomic(r.Context(), func(q store.Queries) error {
+		userToken, err := q.ConsumeUserToken(r.Context(), database.ConsumeUserTokenParams{
+			TokenHash: auth.HashToken(token),
+			Purpose:   tokenPurposeVerifyEmail,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Only verifies if the account still has the address the link was sent to
+		verified, err = q.MarkEmailVerified(r.Context(), database.MarkEmailVerifiedParams{
+			ID:    userToken.UserID,
+			Email: userToken.Email,
+		})
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Invalid(rw, r, "token", "invalid", "Invalid or expired verification link")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error verifying email", "error", err)
+		problem.Error(rw, r, problem.Internal, "Failed to verify email")
+		return
+	}
+
+	if verified == 0 {
+		problem.Error(rw, r, problem.Conflict, "The email address on this account has changed")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Write([]byte("Email verified"))
+}
+
+func (apiCfg *apiConfig) ResendVerification(rw http.ResponseWriter, r *http.Request) {
+	userID, err := apiCfg.authenticate(r, auth.ScopeAccount)
+	if err != nil {
+		writeAuthError(rw, r, err)
+		return
+	}
+
+	user, err := apiCfg.storage.GetUserByID(r.Context(), userID)
+	if err != nil {
+		problem.Error(rw, r, problem.NotFound, "User not found")
+		return
+	}
+
+	if user.EmailVerifiedAt.Valid {
+		problem.Error(rw, r, problem.Conflict, "Email address is already verified")
+		return
+	}
+
+	if err := apiCfg.sendVerificationEmail(r.Context(), user.ID, user.Email); err != nil {
+		slog.ErrorContext(r.Context(), "Error creating verification token", "error", err)
+		problem.Error(rw, r, problem.Internal, "Error sending verification email")
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func (apiCfg *apiConfig) ForgotPassword(rw http.ResponseWriter, r *http.Request) {
+	req := ForgotPasswordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
+		return
+	}
+
+	// Always answer the same way so this can't be used to find accounts
+	user, err := apiCfg.storage.GetUser(r.Context(), req.Email)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(r.Context(), "Error looking up user for password reset", "error", err)
+		}
+		rw.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	token, err := apiCfg.createUserToken(r.Context(), user.ID, user.Email, tokenPurposeResetPassword, passwordResetLifetime)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating password reset token", "error", err)
+		rw.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	apiCfg.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your Chirpy account.\n\n"+
+			"Use this token with POST /api/password/reset to choose a new one:\n\n%s\n\n"+
+			"The token expires in %d minutes. If you didn't ask for this, you can ignore this email.",
+			token, int(passwordResetLifetime.Minutes())),
+	})
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func (apiCfg *apiConfig) ResetPassword(rw http.ResponseWriter, r *http.Request) {
+	req := ResetPasswordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(rw, r, problem.InvalidJSON, "Invalid JSON payload")
+		return
+	}
+
+	if req.Token == "" || req.Password == "" {
+		problem.Error(rw, r, problem.BadRequest, "Token and password are required")
+		return
+	}
+
+	tokenParams := database.GetUserTokenParams{
+		TokenHash: auth.HashToken(req.Token),
+		Purpose:   tokenPurposeResetPassword,
+	}
+
+	// Look before consuming, so a rejected password doesn't burn the token
+	userToken, err := apiCfg.storage.GetUserToken(r.Context(), tokenParams)
+	if err != nil {
+		problem.Invalid(rw, r, "token", "invalid", "Invalid or expired reset token")
+		return
+	}
+
+	user, err := apiCfg.storage.GetUserByID(r.Context(), userToken.UserID)
+	if err != nil || user.Email != userToken.Email {
+		problem.Invalid(rw, r, "token", "invalid", "Invalid or expired reset token")
+		return
+	}
+
+	if !apiCfg.checkPasswordPolicy(rw, r, req.Password, user.Email) {
+		return
+	}
+
+	hashedPassword, err := apiCfg.hasher.Hash(req.Password)
+	if err != nil {
+		problem.Error(rw, r, problem.Internal, "Couldn't hash password")
+		return
+	}
+
+	err = apiCfg.storage.Atomic(r.Context(), func(q store.Queries) error {
+		_, err := q.ConsumeUserToken(r.Context(), database.ConsumeUserTokenParams(tokenParams))
+		if err != nil {
+			return err
+		}
+
+		err = q.UpdateUserPassword(r.Context(), database.UpdateUserPasswordParams{
+			ID:             user.ID,
+			HashedPassword: hashedPassword,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Whoever knew the old password shouldn't stay logged in
+		return q.RevokeAllRefreshTokensForUser(r.Context(), user.ID)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Invalid(rw, r, "token", "invalid", "Invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error resetting password", "error", err)
+		problem.Error(rw, r, problem.Internal, "Couldn't update password")
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}